@@ -0,0 +1,230 @@
+package txndedup
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// AccountCanonicalizer 账户规范化函数，无法识别的账户应原样返回
+type AccountCanonicalizer func(account string) string
+
+// 内置账户规范化规则名称
+const (
+	CanonicalizerIBAN  = "iban"  // IBAN：去除空白和连字符并转大写
+	CanonicalizerCard  = "card"  // 银行卡号：12-19位数字，去除空白和连字符
+	CanonicalizerPhone = "phone" // 手机号钱包：仅保留数字和前导+
+)
+
+var (
+	accountCanonicalizers = map[string]AccountCanonicalizer{
+		CanonicalizerIBAN:  CanonicalizeIBAN,
+		CanonicalizerCard:  CanonicalizeCardPAN,
+		CanonicalizerPhone: CanonicalizePhone,
+	}
+	accountCanonicalizersMu sync.RWMutex
+)
+
+// RegisterAccountCanonicalizer 注册自定义账户规范化规则，可在 FingerprintConfig.AccountCanonicalizers 中按名称引用
+func RegisterAccountCanonicalizer(name string, canonicalizer AccountCanonicalizer) {
+	accountCanonicalizersMu.Lock()
+	defer accountCanonicalizersMu.Unlock()
+
+	accountCanonicalizers[name] = canonicalizer
+}
+
+// lookupAccountCanonicalizer 按名称查找账户规范化规则
+func lookupAccountCanonicalizer(name string) (AccountCanonicalizer, error) {
+	accountCanonicalizersMu.RLock()
+	defer accountCanonicalizersMu.RUnlock()
+
+	canonicalizer, exists := accountCanonicalizers[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown account canonicalizer %q", name)
+	}
+	return canonicalizer, nil
+}
+
+// CanonicalizeIBAN 规范化IBAN，如 "de89 3704 0044 0532 0130 00" -> "DE89370400440532013000"
+func CanonicalizeIBAN(account string) string {
+	compact := strings.ToUpper(removeSeparators(account))
+	if len(compact) < 15 || len(compact) > 34 {
+		return account
+	}
+
+	// 国家代码 + 校验位
+	if !isASCIIUpper(compact[0]) || !isASCIIUpper(compact[1]) || !isASCIIDigit(compact[2]) || !isASCIIDigit(compact[3]) {
+		return account
+	}
+	for i := 4; i < len(compact); i++ {
+		if !isASCIIUpper(compact[i]) && !isASCIIDigit(compact[i]) {
+			return account
+		}
+	}
+
+	return compact
+}
+
+// CanonicalizeCardPAN 规范化银行卡号，如 "6222 0000 1234" -> "622200001234"
+func CanonicalizeCardPAN(account string) string {
+	compact := removeSeparators(account)
+	if len(compact) < 12 || len(compact) > 19 {
+		return account
+	}
+	for i := 0; i < len(compact); i++ {
+		if !isASCIIDigit(compact[i]) {
+			return account
+		}
+	}
+	return compact
+}
+
+// CanonicalizePhone 规范化手机号钱包ID，如 "+86 138-0013-8000" -> "+8613800138000"
+func CanonicalizePhone(account string) string {
+	var b strings.Builder
+	digits := 0
+
+	for i, r := range strings.TrimSpace(account) {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+			digits++
+		case r == '+' && i == 0:
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '(' || r == ')' || r == '.':
+		default:
+			return account
+		}
+	}
+
+	if digits < 7 || digits > 15 {
+		return account
+	}
+	return b.String()
+}
+
+// removeSeparators 去除空白和连字符
+func removeSeparators(account string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '-' {
+			return -1
+		}
+		return r
+	}, account)
+}
+
+func isASCIIUpper(c byte) bool { return c >= 'A' && c <= 'Z' }
+
+func isASCIIDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// 账户相似度算法
+const (
+	SimilarityLevenshtein = "levenshtein"
+	SimilarityJaroWinkler = "jaro_winkler"
+)
+
+// AccountSimilarity 计算两个账户的相似度，取值 [0,1]
+// 比较前去除空白和连字符并转大写；algorithm 为空时使用 Levenshtein
+func AccountSimilarity(algorithm, a, b string) float64 {
+	a = strings.ToUpper(removeSeparators(a))
+	b = strings.ToUpper(removeSeparators(b))
+
+	switch algorithm {
+	case SimilarityJaroWinkler:
+		return jaroWinkler(a, b)
+	default:
+		return levenshteinSimilarity(a, b)
+	}
+}
+
+// levenshteinSimilarity 基于编辑距离的相似度 1 - distance/maxLen
+func levenshteinSimilarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	maxLen := max(len(ra), len(rb))
+	if maxLen == 0 {
+		return 1
+	}
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return 1 - float64(prev[len(rb)])/float64(maxLen)
+}
+
+// jaroWinkler Jaro-Winkler 相似度
+func jaroWinkler(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+	if len(ra) == 0 || len(rb) == 0 {
+		return 0
+	}
+
+	matchDistance := max(max(len(ra), len(rb))/2-1, 0)
+
+	matchedA := make([]bool, len(ra))
+	matchedB := make([]bool, len(rb))
+	matches := 0
+
+	for i := range ra {
+		start := max(0, i-matchDistance)
+		end := min(len(rb)-1, i+matchDistance)
+		for j := start; j <= end; j++ {
+			if matchedB[j] || ra[i] != rb[j] {
+				continue
+			}
+			matchedA[i] = true
+			matchedB[j] = true
+			matches++
+			break
+		}
+	}
+
+	if matches == 0 {
+		return 0
+	}
+
+	// 统计换位
+	transpositions := 0
+	j := 0
+	for i := range ra {
+		if !matchedA[i] {
+			continue
+		}
+		for !matchedB[j] {
+			j++
+		}
+		if ra[i] != rb[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	m := float64(matches)
+	jaro := (m/float64(len(ra)) + m/float64(len(rb)) + (m-float64(transpositions)/2)/m) / 3
+
+	// 公共前缀加权，最多4个字符
+	prefix := 0
+	for prefix < min(4, len(ra), len(rb)) && ra[prefix] == rb[prefix] {
+		prefix++
+	}
+
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
@@ -0,0 +1,503 @@
+package txndedup
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// FsyncPolicy 磁盘存储的刷盘策略
+type FsyncPolicy string
+
+const (
+	FsyncAlways   FsyncPolicy = "always"   // 每次提交都刷盘，掉电不丢数据
+	FsyncInterval FsyncPolicy = "interval" // 按 FsyncInterval 定期刷盘，掉电可能丢失最近一个间隔内的写入
+	FsyncNever    FsyncPolicy = "never"    // 不主动刷盘，由操作系统决定，仅能应对进程崩溃
+)
+
+const (
+	// defaultFsyncInterval interval 策略的默认刷盘间隔
+	defaultFsyncInterval = time.Second
+	// defaultBoltOpenTimeout 等待文件锁的默认超时
+	defaultBoltOpenTimeout = time.Second
+	// boltCompactBatchSize 每个写事务清理的记录数，避免长时间阻塞写入
+	boltCompactBatchSize = 1000
+)
+
+// 桶名
+var (
+	boltRecordsBucket = []byte("records") // 指纹|时间戳|交易ID -> 记录
+	boltExpiryBucket  = []byte("expiry")  // 时间戳|记录key -> 空，按时间顺序清理
+	boltTxIDBucket    = []byte("txid")    // 交易ID -> 主指纹下的记录key
+	boltIdemBucket    = []byte("idem")    // 幂等键 -> 交易ID
+)
+
+// BoltStorage 基于 bbolt 的本地磁盘存储，适用于无法部署 Redis 的单节点场景
+// 记录key按 指纹|毫秒时间戳|交易ID 排列，时间窗口查询为一次前缀范围扫描；全部写入在单个事务中完成，崩溃后重启不会出现部分写入
+type BoltStorage struct {
+	db     *bolt.DB
+	config *Config
+
+	// 后台清理与刷盘协程，Shutdown 时取消并等待退出，进行中的清理在处理完当前批次后退出
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewBoltStorage 打开或创建磁盘存储，启动时清理已过期的记录
+func NewBoltStorage(config *Config) (*BoltStorage, error) {
+	boltConfig := config.BoltConfig
+
+	timeout := boltConfig.OpenTimeout
+	if timeout <= 0 {
+		timeout = defaultBoltOpenTimeout
+	}
+
+	db, err := bolt.Open(boltConfig.Path, 0600, &bolt.Options{
+		Timeout: timeout,
+		NoSync:  boltConfig.FsyncPolicy == FsyncInterval || boltConfig.FsyncPolicy == FsyncNever,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open %s failed: %w", boltConfig.Path, err)
+	}
+
+	storage := &BoltStorage{
+		db:     db,
+		config: config,
+	}
+	storage.ctx, storage.cancel = context.WithCancel(context.Background())
+
+	if err := storage.recover(boltConfig.CheckOnOpen); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// 启动清理协程
+	storage.wg.Add(1)
+	go storage.startCleanup()
+
+	if boltConfig.FsyncPolicy == FsyncInterval {
+		interval := boltConfig.FsyncInterval
+		if interval <= 0 {
+			interval = defaultFsyncInterval
+		}
+		storage.wg.Add(1)
+		go storage.startSync(interval)
+	}
+
+	return storage, nil
+}
+
+// recover 创建缺失的桶，可选地校验页结构，并清理停机期间过期的记录
+func (bs *BoltStorage) recover(check bool) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltRecordsBucket, boltExpiryBucket, boltTxIDBucket, boltIdemBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("create buckets failed: %w", err)
+	}
+
+	if check {
+		err := bs.db.View(func(tx *bolt.Tx) error {
+			for err := range tx.Check() {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("check %s failed: %w", bs.db.Path(), err)
+		}
+	}
+
+	return bs.Cleanup(context.Background(), bs.config.Retention())
+}
+
+// Store 存储交易记录
+func (bs *BoltStorage) Store(ctx context.Context, fingerprint string, record *TransactionRecord) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		return bs.put(tx, fingerprint, record, record.Fingerprint == "" || record.Fingerprint == fingerprint)
+	})
+	if err != nil {
+		return fmt.Errorf("store record failed: %w", err)
+	}
+	return nil
+}
+
+// GetSimilar 获取相似交易
+func (bs *BoltStorage) GetSimilar(ctx context.Context, fingerprint string, timeWindow time.Duration) ([]*TransactionRecord, error) {
+	var records []*TransactionRecord
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		records, err = bs.scan(tx, fingerprint, time.Now().Add(-timeWindow))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get similar records failed: %w", err)
+	}
+	return records, nil
+}
+
+// Reserve 原子地检查并预留
+// bbolt 同一时间只有一个写事务，检查与写入在同一写事务中完成
+func (bs *BoltStorage) Reserve(ctx context.Context, fingerprints []string, timeWindow time.Duration, decide ReserveFunc) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		cutoffTime := time.Now().Add(-timeWindow)
+
+		lists := make([][]*TransactionRecord, len(fingerprints))
+		for i, fingerprint := range fingerprints {
+			records, err := bs.scan(tx, fingerprint, cutoffTime)
+			if err != nil {
+				return fmt.Errorf("get similar records failed: %w", err)
+			}
+			lists[i] = records
+		}
+
+		record, err := decide(mergeRecords(lists...))
+		if err != nil || record == nil {
+			return err
+		}
+
+		if record.IdempotencyKey != "" && tx.Bucket(boltIdemBucket).Get([]byte(record.IdempotencyKey)) != nil {
+			return ErrIdempotencyKeyExists
+		}
+
+		for i, fingerprint := range fingerprints {
+			if err := bs.put(tx, fingerprint, record, i == 0); err != nil {
+				return fmt.Errorf("reserve record failed: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// Get 按交易ID获取记录
+func (bs *BoltStorage) Get(ctx context.Context, transactionID string) (*TransactionRecord, error) {
+	var record *TransactionRecord
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, _, err = bs.get(tx, transactionID)
+		return err
+	})
+	return record, err
+}
+
+// GetByIdempotencyKey 按幂等键获取记录
+func (bs *BoltStorage) GetByIdempotencyKey(ctx context.Context, idempotencyKey string) (*TransactionRecord, error) {
+	var record *TransactionRecord
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		transactionID := tx.Bucket(boltIdemBucket).Get([]byte(idempotencyKey))
+		if transactionID == nil {
+			return ErrTransactionNotFound
+		}
+
+		var err error
+		record, _, err = bs.get(tx, string(transactionID))
+		return err
+	})
+	return record, err
+}
+
+// Update 按交易ID更新记录，同一事务中更新全部指纹下的副本
+func (bs *BoltStorage) Update(ctx context.Context, transactionID string, update RecordUpdateFunc) (*TransactionRecord, error) {
+	var updated *TransactionRecord
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		record, key, err := bs.get(tx, transactionID)
+		if err != nil {
+			return err
+		}
+
+		update(record)
+		record.UpdatedAt = time.Now()
+		data, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("marshal record failed: %w", err)
+		}
+
+		records := tx.Bucket(boltRecordsBucket)
+		keys := [][]byte{key}
+		for _, fingerprint := range record.Fingerprints {
+			if fpKey := boltRecordKey(fingerprint, record.CreatedAt, transactionID); !bytes.Equal(fpKey, key) {
+				keys = append(keys, fpKey)
+			}
+		}
+		for _, k := range keys {
+			// 副本可能已被裁剪
+			if records.Get(k) == nil {
+				continue
+			}
+			if err := records.Put(k, data); err != nil {
+				return err
+			}
+		}
+
+		updated = record
+		return nil
+	})
+	if err == ErrTransactionNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("update record failed: %w", err)
+	}
+	return updated, nil
+}
+
+// Cleanup 按时间顺序清理过期记录，每个写事务最多清理 boltCompactBatchSize 条
+// 清理只释放页供后续写入复用，不缩小文件
+func (bs *BoltStorage) Cleanup(ctx context.Context, timeWindow time.Duration) error {
+	cutoff := boltTimestamp(time.Now().Add(-timeWindow))
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		removed := 0
+		err := bs.db.Update(func(tx *bolt.Tx) error {
+			var expired [][]byte
+			c := tx.Bucket(boltExpiryBucket).Cursor()
+			for k, _ := c.First(); k != nil && len(expired) < boltCompactBatchSize; k, _ = c.Next() {
+				if bytes.Compare(k[:8], cutoff) >= 0 {
+					break
+				}
+				expired = append(expired, append([]byte(nil), k...))
+			}
+
+			for _, k := range expired {
+				if err := bs.remove(tx, k[8:]); err != nil {
+					return err
+				}
+			}
+			removed = len(expired)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("cleanup failed: %w", err)
+		}
+
+		if removed < boltCompactBatchSize {
+			return nil
+		}
+	}
+}
+
+// Shutdown 停止后台协程并关闭数据库，刷盘后返回；ctx 先结束时数据库保持打开，可再次调用
+func (bs *BoltStorage) Shutdown(ctx context.Context) error {
+	bs.cancel()
+	if err := waitContext(ctx, &bs.wg); err != nil {
+		return err
+	}
+
+	bs.closeOnce.Do(func() {
+		if err := bs.db.Sync(); err != nil {
+			bs.db.Close()
+			bs.closeErr = fmt.Errorf("sync failed: %w", err)
+			return
+		}
+		bs.closeErr = bs.db.Close()
+	})
+	return bs.closeErr
+}
+
+// Close 停止后台协程并关闭数据库，刷盘后返回
+func (bs *BoltStorage) Close() error {
+	return bs.Shutdown(context.Background())
+}
+
+// put 写入指纹下的记录，indexed 为true时写入交易ID与幂等键索引，并按 MaxRecordsPerKey 裁剪
+func (bs *BoltStorage) put(tx *bolt.Tx, fingerprint string, record *TransactionRecord, indexed bool) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal record failed: %w", err)
+	}
+
+	key := boltRecordKey(fingerprint, record.CreatedAt, record.TransactionID)
+	if err := tx.Bucket(boltRecordsBucket).Put(key, data); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltExpiryBucket).Put(boltExpiryKey(key), nil); err != nil {
+		return err
+	}
+
+	if indexed {
+		if err := tx.Bucket(boltTxIDBucket).Put([]byte(record.TransactionID), key); err != nil {
+			return err
+		}
+		if record.IdempotencyKey != "" {
+			if err := tx.Bucket(boltIdemBucket).Put([]byte(record.IdempotencyKey), []byte(record.TransactionID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bs.trim(tx, fingerprint)
+}
+
+// trim 删除超出 MaxRecordsPerKey 的最旧记录
+func (bs *BoltStorage) trim(tx *bolt.Tx, fingerprint string) error {
+	limit := bs.config.MaxRecordsPerKey
+	if limit <= 0 {
+		return nil
+	}
+
+	prefix := boltFingerprintPrefix(fingerprint)
+	var keys [][]byte
+	c := tx.Bucket(boltRecordsBucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+
+	for i := 0; i < len(keys)-limit; i++ {
+		if err := bs.remove(tx, keys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove 删除记录及其过期索引，交易ID与幂等键索引仍指向该记录时一并删除
+func (bs *BoltStorage) remove(tx *bolt.Tx, key []byte) error {
+	records := tx.Bucket(boltRecordsBucket)
+	data := records.Get(key)
+	if data != nil {
+		var record TransactionRecord
+		if err := json.Unmarshal(data, &record); err == nil {
+			txIDs := tx.Bucket(boltTxIDBucket)
+			if indexed := txIDs.Get([]byte(record.TransactionID)); bytes.Equal(indexed, key) {
+				if err := txIDs.Delete([]byte(record.TransactionID)); err != nil {
+					return err
+				}
+				if record.IdempotencyKey != "" {
+					idem := tx.Bucket(boltIdemBucket)
+					if string(idem.Get([]byte(record.IdempotencyKey))) == record.TransactionID {
+						if err := idem.Delete([]byte(record.IdempotencyKey)); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+		if err := records.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(boltExpiryBucket).Delete(boltExpiryKey(key))
+}
+
+// scan 按前缀范围扫描指纹下截止时间之后的记录
+func (bs *BoltStorage) scan(tx *bolt.Tx, fingerprint string, cutoffTime time.Time) ([]*TransactionRecord, error) {
+	prefix := boltFingerprintPrefix(fingerprint)
+	start := append(append([]byte(nil), prefix...), boltTimestamp(cutoffTime)...)
+
+	var records []*TransactionRecord
+	c := tx.Bucket(boltRecordsBucket).Cursor()
+	for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var record TransactionRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			continue // 跳过无法解析的记录
+		}
+		records = append(records, &record)
+	}
+	return records, nil
+}
+
+// get 按交易ID读取记录及其在主指纹下的key
+func (bs *BoltStorage) get(tx *bolt.Tx, transactionID string) (*TransactionRecord, []byte, error) {
+	key := tx.Bucket(boltTxIDBucket).Get([]byte(transactionID))
+	if key == nil {
+		return nil, nil, ErrTransactionNotFound
+	}
+
+	data := tx.Bucket(boltRecordsBucket).Get(key)
+	if data == nil {
+		return nil, nil, ErrTransactionNotFound
+	}
+
+	var record TransactionRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, nil, fmt.Errorf("unmarshal record failed: %w", err)
+	}
+	// 事务结束后 bbolt 返回的切片失效，需要拷贝
+	return &record, append([]byte(nil), key...), nil
+}
+
+// startCleanup 启动清理协程，关闭时进行中的清理在处理完当前批次后退出
+func (bs *BoltStorage) startCleanup() {
+	defer bs.wg.Done()
+
+	ticker := time.NewTicker(bs.config.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-bs.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := bs.Cleanup(bs.ctx, bs.config.Retention()); err != nil && bs.ctx.Err() == nil {
+			bs.config.Logger.Errorf("cleanup failed: %v", err)
+		}
+	}
+}
+
+// startSync 按间隔刷盘
+func (bs *BoltStorage) startSync(interval time.Duration) {
+	defer bs.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-bs.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := bs.db.Sync(); err != nil {
+			bs.config.Logger.Errorf("sync failed: %v", err)
+		}
+	}
+}
+
+// boltFingerprintPrefix 指纹前缀，以NUL分隔避免指纹之间互为前缀
+func boltFingerprintPrefix(fingerprint string) []byte {
+	return append([]byte(fingerprint), 0)
+}
+
+// boltRecordKey 构建记录key：指纹|毫秒时间戳（大端序）|交易ID
+func boltRecordKey(fingerprint string, createdAt time.Time, transactionID string) []byte {
+	key := boltFingerprintPrefix(fingerprint)
+	key = append(key, boltTimestamp(createdAt)...)
+	return append(key, transactionID...)
+}
+
+// boltExpiryKey 构建过期索引key：记录的毫秒时间戳|记录key
+func boltExpiryKey(recordKey []byte) []byte {
+	i := bytes.IndexByte(recordKey, 0)
+	key := append([]byte(nil), recordKey[i+1:i+9]...)
+	return append(key, recordKey...)
+}
+
+// boltTimestamp 将时间编码为大端序毫秒时间戳，字节序与时间顺序一致
+func boltTimestamp(t time.Time) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(t.UnixMilli()))
+	return buf
+}
@@ -1,39 +1,74 @@
 package txndedup
 
 import (
-	"github.com/sirupsen/logrus"
+	"errors"
+	"fmt"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 // Config 检测器配置
 type Config struct {
 	// 基础配置
-	TimeWindow       time.Duration `json:"time_window"`         // 时间窗口
+	TimeWindow       time.Duration `json:"time_window"`         // 时间窗口，不小于各规则的时间窗口，热更新的规则同样受此限制
 	CleanupInterval  time.Duration `json:"cleanup_interval"`    // 清理间隔
 	MaxRecordsPerKey int           `json:"max_records_per_key"` // 每个指纹最大记录数
 
 	// 指纹配置
 	FingerprintConfig FingerprintConfig `json:"fingerprint_config"`
+	Fingerprinter     Fingerprinter     `json:"-"` // 自定义指纹策略，为空时使用 FingerprintConfig
 
 	// 风险规则
-	RiskRules []RiskRule `json:"risk_rules"`
+	RiskRules []RiskRule    `json:"risk_rules"`
+	Scoring   ScoringConfig `json:"scoring"` // 评分模式，默认关闭，按规则顺序取第一条命中的规则
+
+	// 消息配置
+	DefaultLocale  string         `json:"default_locale"` // 默认语言
+	MessageCatalog MessageCatalog `json:"-"`              // 自定义消息目录，同一语言下优先于内置目录
 
 	// 日志配置
 	Logger   logrus.FieldLogger `json:"-"`
 	LogLevel logrus.Level       `json:"log_level"`
 
 	// 存储配置
-	StorageType string       `json:"storage_type"` // "memory" | "redis"
-	RedisConfig *RedisConfig `json:"redis_config,omitempty"`
+	StorageType  string        `json:"storage_type"` // "memory" | "redis" | "sql" | "bolt"
+	MemoryConfig *MemoryConfig `json:"memory_config,omitempty"`
+	RedisConfig  *RedisConfig  `json:"redis_config,omitempty"`
+	SQLConfig    *SQLConfig    `json:"sql_config,omitempty"`
+	BoltConfig   *BoltConfig   `json:"bolt_config,omitempty"`
 
 	// 性能配置
 	EnableAsync    bool `json:"enable_async"`     // 异步处理
 	WorkerPoolSize int  `json:"worker_pool_size"` // 工作池大小
 }
 
+// MemoryConfig 内存存储配置，为空时使用默认值
+type MemoryConfig struct {
+	Shards       int           `json:"shards"`        // 分片数，向上取整为2的幂，默认64
+	ExpiryBucket time.Duration `json:"expiry_bucket"` // 过期桶宽度，记录按桶过期，最多比保留时长晚一个桶宽清理，默认10秒
+
+	// 容量上限，按分片均分，0表示不限制；多指纹记录在每个指纹下分别计数
+	MaxRecords     int                  `json:"max_records"`     // 记录数上限
+	MaxBytes       int64                `json:"max_bytes"`       // 估算字节数上限
+	EvictionPolicy MemoryEvictionPolicy `json:"eviction_policy"` // 超出上限时的策略，默认 "lru"
+
+	// 快照文件，配置后启动时自动恢复（丢弃超出保留时长的记录），关闭时写入最终快照
+	SnapshotPath     string        `json:"snapshot_path,omitempty"`
+	SnapshotInterval time.Duration `json:"snapshot_interval"` // 定期快照间隔，0表示只在关闭时写入
+
+	// 预写日志目录，配置后每次写入、状态更新和清理先写入日志再应用，启动时在快照之后重放；需同时配置 SnapshotPath，
+	// 快照完成后删除已被快照覆盖的段
+	WALDir           string        `json:"wal_dir,omitempty"`
+	WALFsyncPolicy   FsyncPolicy   `json:"wal_fsync_policy"`   // 刷盘策略，默认 "always"，并发写入合并刷盘
+	WALFsyncInterval time.Duration `json:"wal_fsync_interval"` // interval 策略的刷盘间隔，默认1秒
+	WALSegmentSize   int64         `json:"wal_segment_size"`   // 段大小，超过后切换到新段，默认64MB
+}
+
 // RedisConfig Redis配置
 type RedisConfig struct {
-	Address      string        `json:"address"`
+	Address      string        `json:"address"`  // 单节点地址
+	Username     string        `json:"username"` // ACL用户名
 	Password     string        `json:"password"`
 	DB           int           `json:"db"`
 	PoolSize     int           `json:"pool_size"`
@@ -43,14 +78,62 @@ type RedisConfig struct {
 	WriteTimeout time.Duration `json:"write_timeout"`
 	IdleTimeout  time.Duration `json:"idle_timeout"`
 	KeyPrefix    string        `json:"key_prefix"`
+
+	RecordTTL     time.Duration `json:"record_ttl"`     // 记录及索引的过期时间，为0时使用 Config.Retention()
+	MigrateScores bool          `json:"migrate_scores"` // 启动时将旧版本的秒级score迁移为毫秒级，见 RedisStorage.MigrateScores
+
+	// 集群模式，配置后忽略 Address 与 DB
+	ClusterAddresses []string `json:"cluster_addresses,omitempty"`
+
+	// Sentinel模式，配置 MasterName 后通过 SentinelAddresses 发现主节点
+	MasterName        string   `json:"master_name,omitempty"`
+	SentinelAddresses []string `json:"sentinel_addresses,omitempty"`
+	SentinelPassword  string   `json:"sentinel_password,omitempty"`
+
+	TLS *RedisTLSConfig `json:"tls,omitempty"`
+}
+
+// RedisTLSConfig Redis TLS配置
+type RedisTLSConfig struct {
+	Enabled            bool   `json:"enabled"`
+	CAFile             string `json:"ca_file"`   // 为空时使用系统根证书
+	CertFile           string `json:"cert_file"` // 客户端证书，双向认证时与 KeyFile 同时配置
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"` // 为空时使用连接地址的主机名
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// SQLConfig SQL存储配置，需在程序中导入对应的 database/sql 驱动
+type SQLConfig struct {
+	Driver          string        `json:"driver"`            // 驱动名，如 "pgx"、"postgres"、"mysql"、"sqlite3"
+	DSN             string        `json:"dsn"`               // 数据源
+	Dialect         SQLDialect    `json:"dialect,omitempty"` // 为空时按驱动名推断
+	TablePrefix     string        `json:"table_prefix"`      // 表名前缀，默认 "txndedup_"
+	MaxOpenConns    int           `json:"max_open_conns"`    // 为0时不限制，SQLite 默认为1
+	MaxIdleConns    int           `json:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `json:"conn_max_lifetime"`
+	CleanupBatch    int           `json:"cleanup_batch"` // 清理时每批删除的行数，默认1000
+	SkipMigrate     bool          `json:"skip_migrate"`  // 不在启动时执行迁移，由发布流程调用 SQLStorage.Migrate
+}
+
+// BoltConfig 本地磁盘存储配置
+type BoltConfig struct {
+	Path          string        `json:"path"`           // 数据文件路径，同一时间只能被一个进程打开
+	FsyncPolicy   FsyncPolicy   `json:"fsync_policy"`   // 刷盘策略，默认 "always"
+	FsyncInterval time.Duration `json:"fsync_interval"` // interval 策略的刷盘间隔，默认1秒
+	OpenTimeout   time.Duration `json:"open_timeout"`   // 等待文件锁的超时，默认1秒
+	CheckOnOpen   bool          `json:"check_on_open"`  // 启动时校验全部页结构，数据量大时较慢
 }
 
+// defaultMaxRecordsPerKey 每个指纹默认最大记录数
+const defaultMaxRecordsPerKey = 100
+
 // DefaultConfig 默认配置
 func DefaultConfig() *Config {
 	return &Config{
-		TimeWindow:       5 * time.Minute,
+		TimeWindow:       30 * time.Minute, // 不小于各规则的时间窗口
 		CleanupInterval:  1 * time.Minute,
-		MaxRecordsPerKey: 100,
+		MaxRecordsPerKey: defaultMaxRecordsPerKey,
 
 		FingerprintConfig: FingerprintConfig{
 			IncludeFromAccount:  true,
@@ -59,7 +142,7 @@ func DefaultConfig() *Config {
 			IncludeCurrency:     true,
 			IncludeBusinessType: true,
 			IncludeChannel:      false,
-			AmountPrecision:     2, // 精确到分
+			AmountPrecision:     AmountPrecisionCurrency, // 按货币的最小单位
 		},
 
 		RiskRules: []RiskRule{
@@ -72,6 +155,7 @@ func DefaultConfig() *Config {
 				CheckSameIP:     false,
 				CheckSameDevice: false,
 				CheckStatus:     []TransactionStatus{StatusPending},
+				Weight:          100,
 			},
 			{
 				Name:            "rapid_duplicate",
@@ -82,6 +166,7 @@ func DefaultConfig() *Config {
 				CheckSameIP:     true,
 				CheckSameDevice: true,
 				CheckStatus:     []TransactionStatus{StatusSuccess, StatusPending},
+				Weight:          60,
 			},
 			{
 				Name:            "frequent_duplicate",
@@ -92,6 +177,7 @@ func DefaultConfig() *Config {
 				CheckSameIP:     false,
 				CheckSameDevice: false,
 				CheckStatus:     []TransactionStatus{StatusSuccess},
+				Weight:          40,
 			},
 			{
 				Name:            "recent_duplicate",
@@ -102,9 +188,21 @@ func DefaultConfig() *Config {
 				CheckSameIP:     false,
 				CheckSameDevice: false,
 				CheckStatus:     []TransactionStatus{StatusSuccess},
+				Weight:          10,
 			},
 		},
 
+		Scoring: ScoringConfig{
+			Enabled: false,
+			Thresholds: []ScoreThreshold{
+				{MinScore: 100, RiskLevel: RiskLevelHigh, Action: ActionBlock},
+				{MinScore: 50, RiskLevel: RiskLevelHigh, Action: ActionWarn},
+				{MinScore: 30, RiskLevel: RiskLevelMedium, Action: ActionWarn},
+			},
+		},
+
+		DefaultLocale: DefaultLocale,
+
 		Logger:         logrus.StandardLogger(),
 		LogLevel:       logrus.InfoLevel,
 		StorageType:    "memory",
@@ -113,19 +211,265 @@ func DefaultConfig() *Config {
 	}
 }
 
-// Validate 验证配置
+// Retention 记录保留时长：全局时间窗口与各规则时间窗口中的最大值
+// 内存存储按此清理过期记录，Redis 存储按此设置过期时间
+func (c *Config) Retention() time.Duration {
+	retention := c.TimeWindow
+	for _, rule := range c.RiskRules {
+		retention = max(retention, rule.TimeWindow)
+	}
+	return retention
+}
+
+// Validate 验证配置，返回全部校验错误（errors.Join），可通过 errors.Is 判断错误类型
 func (c *Config) Validate() error {
+	var errs []error
+
 	if c.TimeWindow <= 0 {
-		return ErrInvalidTimeWindow
+		errs = append(errs, ErrInvalidTimeWindow)
 	}
 
 	if c.CleanupInterval <= 0 {
-		return ErrInvalidCleanupInterval
+		errs = append(errs, ErrInvalidCleanupInterval)
+	}
+
+	if c.MaxRecordsPerKey <= 0 {
+		errs = append(errs, fmt.Errorf("%w: max_records_per_key must be positive, got %d", ErrInvalidConfig, c.MaxRecordsPerKey))
+	}
+
+	if c.WorkerPoolSize <= 0 {
+		errs = append(errs, fmt.Errorf("%w: worker_pool_size must be positive, got %d", ErrInvalidConfig, c.WorkerPoolSize))
+	}
+
+	if c.StorageType == "memory" && c.MemoryConfig != nil {
+		if c.MemoryConfig.Shards < 0 {
+			errs = append(errs, fmt.Errorf("%w: memory_config: shards must not be negative, got %d", ErrInvalidConfig, c.MemoryConfig.Shards))
+		}
+		if c.MemoryConfig.ExpiryBucket < 0 {
+			errs = append(errs, fmt.Errorf("%w: memory_config: expiry_bucket must not be negative, got %v", ErrInvalidConfig, c.MemoryConfig.ExpiryBucket))
+		}
+		if c.MemoryConfig.MaxRecords < 0 || c.MemoryConfig.MaxBytes < 0 {
+			errs = append(errs, fmt.Errorf("%w: memory_config: max_records and max_bytes must not be negative", ErrInvalidConfig))
+		}
+		if c.MemoryConfig.SnapshotInterval < 0 {
+			errs = append(errs, fmt.Errorf("%w: memory_config: snapshot_interval must not be negative, got %v", ErrInvalidConfig, c.MemoryConfig.SnapshotInterval))
+		}
+		if c.MemoryConfig.SnapshotInterval > 0 && c.MemoryConfig.SnapshotPath == "" {
+			errs = append(errs, fmt.Errorf("%w: memory_config: snapshot_interval requires snapshot_path", ErrInvalidConfig))
+		}
+		if c.MemoryConfig.WALDir != "" && c.MemoryConfig.SnapshotPath == "" {
+			errs = append(errs, fmt.Errorf("%w: memory_config: wal_dir requires snapshot_path", ErrInvalidConfig))
+		}
+		switch c.MemoryConfig.WALFsyncPolicy {
+		case "", FsyncAlways, FsyncInterval, FsyncNever:
+		default:
+			errs = append(errs, fmt.Errorf("%w: memory_config: unknown wal_fsync_policy %q", ErrInvalidConfig, c.MemoryConfig.WALFsyncPolicy))
+		}
+		if c.MemoryConfig.WALFsyncInterval < 0 || c.MemoryConfig.WALSegmentSize < 0 {
+			errs = append(errs, fmt.Errorf("%w: memory_config: wal_fsync_interval and wal_segment_size must not be negative", ErrInvalidConfig))
+		}
+		switch c.MemoryConfig.EvictionPolicy {
+		case "", EvictLRU, EvictOldest, EvictReject:
+		default:
+			errs = append(errs, fmt.Errorf("%w: memory_config: unknown eviction_policy %q", ErrInvalidConfig, c.MemoryConfig.EvictionPolicy))
+		}
+	}
+
+	if c.StorageType == "sql" {
+		if c.SQLConfig == nil {
+			errs = append(errs, ErrMissingSQLConfig)
+		} else {
+			errs = append(errs, c.SQLConfig.validate()...)
+		}
 	}
 
-	if c.StorageType == "redis" && c.RedisConfig == nil {
-		return ErrMissingRedisConfig
+	if c.StorageType == "bolt" {
+		switch {
+		case c.BoltConfig == nil:
+			errs = append(errs, ErrMissingBoltConfig)
+		case c.BoltConfig.Path == "":
+			errs = append(errs, fmt.Errorf("%w: bolt_config: path is required", ErrInvalidConfig))
+		}
+		if c.BoltConfig != nil {
+			switch c.BoltConfig.FsyncPolicy {
+			case "", FsyncAlways, FsyncInterval, FsyncNever:
+			default:
+				errs = append(errs, fmt.Errorf("%w: bolt_config: unknown fsync_policy %q", ErrInvalidConfig, c.BoltConfig.FsyncPolicy))
+			}
+		}
 	}
 
-	return nil
+	if c.StorageType == "redis" {
+		if c.RedisConfig == nil {
+			errs = append(errs, ErrMissingRedisConfig)
+		} else {
+			errs = append(errs, c.RedisConfig.validate()...)
+		}
+	}
+
+	// 不含任何字段的指纹配置使全部请求得到相同的指纹，自定义 Fingerprinter 不使用该配置
+	if c.Fingerprinter == nil && !c.FingerprintConfig.hasComponents() {
+		errs = append(errs, fmt.Errorf("%w: at least one fingerprint component must be included", ErrInvalidFingerprintConfig))
+	}
+
+	if c.FingerprintConfig.AmountPrecision < AmountPrecisionCurrency {
+		errs = append(errs, fmt.Errorf("%w: invalid amount precision %d", ErrInvalidFingerprintConfig, c.FingerprintConfig.AmountPrecision))
+	}
+
+	for _, name := range c.FingerprintConfig.AccountCanonicalizers {
+		if _, err := lookupAccountCanonicalizer(name); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %v", ErrInvalidFingerprintConfig, err))
+		}
+	}
+
+	for _, field := range c.FingerprintConfig.ExtraFields {
+		if _, err := newExtraFieldNormalizer(field); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %v", ErrInvalidFingerprintConfig, err))
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, rule := range c.RiskRules {
+		invalid := func(format string, args ...interface{}) {
+			errs = append(errs, fmt.Errorf("%w: rule %q (#%d): %s", ErrInvalidRiskRule, rule.Name, i, fmt.Sprintf(format, args...)))
+		}
+
+		switch {
+		case rule.Name == "":
+			invalid("name is required")
+		case names[rule.Name]:
+			invalid("duplicate rule name")
+		}
+		names[rule.Name] = true
+
+		if !validRiskLevel(rule.RiskLevel) {
+			invalid("invalid risk level %q", rule.RiskLevel)
+		}
+		if !validAction(rule.Action) {
+			invalid("invalid action %q", rule.Action)
+		}
+		if rule.MaxCount < 0 {
+			invalid("max_count must not be negative, got %d", rule.MaxCount)
+		}
+		if rule.TimeWindow <= 0 {
+			invalid("time_window must be positive, got %v", rule.TimeWindow)
+		} else if c.TimeWindow > 0 && rule.TimeWindow > c.TimeWindow {
+			invalid("time_window %v exceeds global time_window %v", rule.TimeWindow, c.TimeWindow)
+		}
+		for _, status := range rule.CheckStatus {
+			if !validStatus(status) {
+				invalid("invalid status %q", status)
+			}
+		}
+		if rule.AmountTolerance.Units < 0 || rule.AmountTolerancePercent < 0 {
+			invalid("amount tolerance must not be negative")
+		}
+		if rule.PayeeSimilarity < 0 || rule.PayeeSimilarity > 1 {
+			invalid("payee_similarity must be within [0, 1], got %v", rule.PayeeSimilarity)
+		}
+		switch rule.SimilarityAlgorithm {
+		case "", SimilarityLevenshtein, SimilarityJaroWinkler:
+		default:
+			invalid("unknown similarity algorithm %q", rule.SimilarityAlgorithm)
+		}
+		if rule.Condition != "" {
+			if _, err := CompileExpression(rule.Condition); err != nil {
+				invalid("%v", err)
+			}
+		}
+		if rule.Message != "" {
+			if _, err := parseMessageTemplate(rule.Message); err != nil {
+				invalid("invalid message template: %v", err)
+			}
+		}
+	}
+
+	for _, threshold := range c.Scoring.Thresholds {
+		if !validRiskLevel(threshold.RiskLevel) || !validAction(threshold.Action) {
+			errs = append(errs, fmt.Errorf("%w: invalid score threshold %v: %s/%s", ErrInvalidConfig, threshold.MinScore, threshold.RiskLevel, threshold.Action))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// hasComponents 是否至少包含一个参与指纹计算的字段
+func (fc FingerprintConfig) hasComponents() bool {
+	return fc.IncludeFromAccount || fc.IncludeToAccount || fc.IncludeAmount || fc.IncludeCurrency ||
+		fc.IncludeBusinessType || fc.IncludeChannel || len(fc.ExtraFields) > 0
+}
+
+// validate 校验Redis部署模式与TLS配置
+func (rc *RedisConfig) validate() []error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%w: redis_config: %s", ErrInvalidConfig, fmt.Sprintf(format, args...)))
+	}
+
+	switch {
+	case len(rc.ClusterAddresses) > 0 && rc.MasterName != "":
+		invalid("cluster_addresses and master_name are mutually exclusive")
+	case rc.MasterName != "" && len(rc.SentinelAddresses) == 0:
+		invalid("sentinel_addresses is required when master_name is set")
+	case rc.MasterName == "" && len(rc.SentinelAddresses) > 0:
+		invalid("master_name is required when sentinel_addresses is set")
+	case len(rc.ClusterAddresses) == 0 && rc.MasterName == "" && rc.Address == "":
+		invalid("address, cluster_addresses or master_name is required")
+	}
+
+	if len(rc.ClusterAddresses) > 0 && rc.DB != 0 {
+		invalid("db must be 0 in cluster mode, got %d", rc.DB)
+	}
+
+	if rc.TLS != nil && (rc.TLS.CertFile == "") != (rc.TLS.KeyFile == "") {
+		invalid("tls cert_file and key_file must be set together")
+	}
+
+	return errs
+}
+
+// validate 校验SQL驱动、方言与表名前缀
+func (sc *SQLConfig) validate() []error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%w: sql_config: %s", ErrInvalidConfig, fmt.Sprintf(format, args...)))
+	}
+
+	if sc.Driver == "" {
+		invalid("driver is required")
+	}
+
+	dialect := sc.Dialect
+	if dialect == "" {
+		dialect = dialectForDriver(sc.Driver)
+	}
+	switch dialect {
+	case SQLDialectPostgres, SQLDialectMySQL, SQLDialectSQLite:
+	case "":
+		invalid("dialect is required for driver %q", sc.Driver)
+	default:
+		invalid("unsupported dialect %q", dialect)
+	}
+
+	// 表名直接拼接到语句中，只允许字母、数字和下划线
+	for _, c := range sc.TablePrefix {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			invalid("table_prefix may only contain letters, digits and underscores, got %q", sc.TablePrefix)
+			break
+		}
+	}
+
+	return errs
+}
+
+func validRiskLevel(level RiskLevel) bool {
+	return level == RiskLevelLow || level == RiskLevelMedium || level == RiskLevelHigh
+}
+
+func validAction(action SuggestionAction) bool {
+	return action == ActionAllow || action == ActionWarn || action == ActionBlock
+}
+
+func validStatus(status TransactionStatus) bool {
+	return status == StatusPending || status == StatusSuccess || status == StatusFailed || status == StatusCancelled
 }
@@ -0,0 +1,295 @@
+package txndedup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// LoadConfig 从JSON或YAML文件加载配置，按扩展名 .yaml/.yml 识别YAML，其余按JSON解析
+// 文件中未出现的字段保留 DefaultConfig 的默认值；时间字段支持 "30s"、"5m" 等格式，也兼容纳秒整数
+// 加载后执行完整校验，返回全部校验错误
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	if err := decodeFile(path, config); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// decodeFile 按扩展名解析JSON或YAML文件，拒绝未知字段
+func decodeFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read %s failed: %w", path, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if data, err = yaml.YAMLToJSON(data); err != nil {
+			return fmt.Errorf("parse %s failed: %w", path, err)
+		}
+	}
+
+	if err := decodeJSON(data, v); err != nil {
+		return fmt.Errorf("parse %s failed: %w", path, err)
+	}
+	return nil
+}
+
+// decodeJSON 解析JSON，拒绝未知字段
+// Config、RiskRule、RedisConfig 的 UnmarshalJSON 同样使用该函数，嵌套字段中的拼写错误也会被发现
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// duration 支持 "30s" 格式的时间字段，兼容纳秒整数
+type duration time.Duration
+
+// MarshalJSON 序列化为 "30s" 格式
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON 解析 "30s" 格式或纳秒整数
+func (d *duration) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		value, err := time.ParseDuration(text)
+		if err != nil {
+			return err
+		}
+		*d = duration(value)
+		return nil
+	}
+
+	var nanos int64
+	if err := json.Unmarshal(data, &nanos); err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	*d = duration(nanos)
+	return nil
+}
+
+// configJSON Config 的JSON表示，时间字段使用 duration
+type configJSON struct {
+	*configAlias
+	TimeWindow      duration `json:"time_window"`
+	CleanupInterval duration `json:"cleanup_interval"`
+}
+
+type configAlias Config
+
+// MarshalJSON 序列化配置，时间字段输出为 "30s" 格式
+func (c Config) MarshalJSON() ([]byte, error) {
+	return json.Marshal(configJSON{
+		configAlias:     (*configAlias)(&c),
+		TimeWindow:      duration(c.TimeWindow),
+		CleanupInterval: duration(c.CleanupInterval),
+	})
+}
+
+// UnmarshalJSON 解析配置，时间字段支持 "30s" 格式
+func (c *Config) UnmarshalJSON(data []byte) error {
+	aux := configJSON{
+		configAlias:     (*configAlias)(c),
+		TimeWindow:      duration(c.TimeWindow),
+		CleanupInterval: duration(c.CleanupInterval),
+	}
+	if err := decodeJSON(data, &aux); err != nil {
+		return err
+	}
+	c.TimeWindow = time.Duration(aux.TimeWindow)
+	c.CleanupInterval = time.Duration(aux.CleanupInterval)
+	return nil
+}
+
+// riskRuleJSON RiskRule 的JSON表示
+type riskRuleJSON struct {
+	*riskRuleAlias
+	TimeWindow duration `json:"time_window"`
+}
+
+type riskRuleAlias RiskRule
+
+// MarshalJSON 序列化规则，时间窗口输出为 "30s" 格式
+func (r RiskRule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(riskRuleJSON{
+		riskRuleAlias: (*riskRuleAlias)(&r),
+		TimeWindow:    duration(r.TimeWindow),
+	})
+}
+
+// UnmarshalJSON 解析规则，时间窗口支持 "30s" 格式
+// 解析前先清空规则，避免覆盖默认配置中的规则列表时残留原规则的字段
+func (r *RiskRule) UnmarshalJSON(data []byte) error {
+	*r = RiskRule{}
+	aux := riskRuleJSON{
+		riskRuleAlias: (*riskRuleAlias)(r),
+	}
+	if err := decodeJSON(data, &aux); err != nil {
+		return err
+	}
+	r.TimeWindow = time.Duration(aux.TimeWindow)
+	return nil
+}
+
+// memoryConfigJSON MemoryConfig 的JSON表示
+type memoryConfigJSON struct {
+	*memoryConfigAlias
+	ExpiryBucket     duration `json:"expiry_bucket"`
+	SnapshotInterval duration `json:"snapshot_interval"`
+	WALFsyncInterval duration `json:"wal_fsync_interval"`
+}
+
+type memoryConfigAlias MemoryConfig
+
+// MarshalJSON 序列化内存存储配置，时间字段输出为 "30s" 格式
+func (mc MemoryConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(memoryConfigJSON{
+		memoryConfigAlias: (*memoryConfigAlias)(&mc),
+		ExpiryBucket:      duration(mc.ExpiryBucket),
+		SnapshotInterval:  duration(mc.SnapshotInterval),
+		WALFsyncInterval:  duration(mc.WALFsyncInterval),
+	})
+}
+
+// UnmarshalJSON 解析内存存储配置，时间字段支持 "30s" 格式
+func (mc *MemoryConfig) UnmarshalJSON(data []byte) error {
+	aux := memoryConfigJSON{
+		memoryConfigAlias: (*memoryConfigAlias)(mc),
+		ExpiryBucket:      duration(mc.ExpiryBucket),
+		SnapshotInterval:  duration(mc.SnapshotInterval),
+		WALFsyncInterval:  duration(mc.WALFsyncInterval),
+	}
+	if err := decodeJSON(data, &aux); err != nil {
+		return err
+	}
+	mc.ExpiryBucket = time.Duration(aux.ExpiryBucket)
+	mc.SnapshotInterval = time.Duration(aux.SnapshotInterval)
+	mc.WALFsyncInterval = time.Duration(aux.WALFsyncInterval)
+	return nil
+}
+
+// redisConfigJSON RedisConfig 的JSON表示
+type redisConfigJSON struct {
+	*redisConfigAlias
+	DialTimeout  duration `json:"dial_timeout"`
+	ReadTimeout  duration `json:"read_timeout"`
+	WriteTimeout duration `json:"write_timeout"`
+	IdleTimeout  duration `json:"idle_timeout"`
+	RecordTTL    duration `json:"record_ttl"`
+}
+
+type redisConfigAlias RedisConfig
+
+// MarshalJSON 序列化Redis配置，超时时间输出为 "30s" 格式
+func (rc RedisConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(redisConfigJSON{
+		redisConfigAlias: (*redisConfigAlias)(&rc),
+		DialTimeout:      duration(rc.DialTimeout),
+		ReadTimeout:      duration(rc.ReadTimeout),
+		WriteTimeout:     duration(rc.WriteTimeout),
+		IdleTimeout:      duration(rc.IdleTimeout),
+		RecordTTL:        duration(rc.RecordTTL),
+	})
+}
+
+// UnmarshalJSON 解析Redis配置，超时时间支持 "30s" 格式
+func (rc *RedisConfig) UnmarshalJSON(data []byte) error {
+	aux := redisConfigJSON{
+		redisConfigAlias: (*redisConfigAlias)(rc),
+		DialTimeout:      duration(rc.DialTimeout),
+		ReadTimeout:      duration(rc.ReadTimeout),
+		WriteTimeout:     duration(rc.WriteTimeout),
+		IdleTimeout:      duration(rc.IdleTimeout),
+		RecordTTL:        duration(rc.RecordTTL),
+	}
+	if err := decodeJSON(data, &aux); err != nil {
+		return err
+	}
+	rc.DialTimeout = time.Duration(aux.DialTimeout)
+	rc.ReadTimeout = time.Duration(aux.ReadTimeout)
+	rc.WriteTimeout = time.Duration(aux.WriteTimeout)
+	rc.IdleTimeout = time.Duration(aux.IdleTimeout)
+	rc.RecordTTL = time.Duration(aux.RecordTTL)
+	return nil
+}
+
+// sqlConfigJSON SQLConfig 的JSON表示
+type sqlConfigJSON struct {
+	*sqlConfigAlias
+	ConnMaxLifetime duration `json:"conn_max_lifetime"`
+}
+
+type sqlConfigAlias SQLConfig
+
+// MarshalJSON 序列化SQL配置，连接最大存活时间输出为 "30s" 格式
+func (sc SQLConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sqlConfigJSON{
+		sqlConfigAlias:  (*sqlConfigAlias)(&sc),
+		ConnMaxLifetime: duration(sc.ConnMaxLifetime),
+	})
+}
+
+// UnmarshalJSON 解析SQL配置，连接最大存活时间支持 "30s" 格式
+func (sc *SQLConfig) UnmarshalJSON(data []byte) error {
+	aux := sqlConfigJSON{
+		sqlConfigAlias:  (*sqlConfigAlias)(sc),
+		ConnMaxLifetime: duration(sc.ConnMaxLifetime),
+	}
+	if err := decodeJSON(data, &aux); err != nil {
+		return err
+	}
+	sc.ConnMaxLifetime = time.Duration(aux.ConnMaxLifetime)
+	return nil
+}
+
+// boltConfigJSON BoltConfig 的JSON表示
+type boltConfigJSON struct {
+	*boltConfigAlias
+	FsyncInterval duration `json:"fsync_interval"`
+	OpenTimeout   duration `json:"open_timeout"`
+}
+
+type boltConfigAlias BoltConfig
+
+// MarshalJSON 序列化磁盘存储配置，时间字段输出为 "30s" 格式
+func (bc BoltConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(boltConfigJSON{
+		boltConfigAlias: (*boltConfigAlias)(&bc),
+		FsyncInterval:   duration(bc.FsyncInterval),
+		OpenTimeout:     duration(bc.OpenTimeout),
+	})
+}
+
+// UnmarshalJSON 解析磁盘存储配置，时间字段支持 "30s" 格式
+func (bc *BoltConfig) UnmarshalJSON(data []byte) error {
+	aux := boltConfigJSON{
+		boltConfigAlias: (*boltConfigAlias)(bc),
+		FsyncInterval:   duration(bc.FsyncInterval),
+		OpenTimeout:     duration(bc.OpenTimeout),
+	}
+	if err := decodeJSON(data, &aux); err != nil {
+		return err
+	}
+	bc.FsyncInterval = time.Duration(aux.FsyncInterval)
+	bc.OpenTimeout = time.Duration(aux.OpenTimeout)
+	return nil
+}
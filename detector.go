@@ -2,7 +2,11 @@ package txndedup
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -10,10 +14,16 @@ import (
 
 // Detector 重复交易检测器
 type Detector struct {
-	config               *Config
-	storage              Storage
-	fingerprintGenerator *FingerprintGenerator
-	riskAssessor         *RiskAssessor
+	config  *Config
+	storage Storage
+	rules   atomic.Pointer[activeRules] // 当前规则，可通过 UpdateRules 热更新
+
+	// 生命周期：Start 启动存储的后台任务，Shutdown 停止检测器与存储的后台协程
+	lifecycleMu sync.Mutex
+	started     bool
+	closed      bool
+	done        chan struct{} // Shutdown 时关闭，通知检测器的后台协程退出
+	workers     sync.WaitGroup
 }
 
 // New 创建检测器
@@ -29,52 +39,223 @@ func New(config *Config) (*Detector, error) {
 		return nil, fmt.Errorf("create storage failed: %w", err)
 	}
 
-	// 创建指纹生成器
-	fingerprintGenerator := NewFingerprintGenerator(config.FingerprintConfig)
+	detector := &Detector{
+		config:  config,
+		storage: storage,
+		done:    make(chan struct{}),
+	}
 
-	// 创建风险评估器
-	riskAssessor := NewRiskAssessor(config.RiskRules)
+	ruleSet := &RuleSet{
+		RiskRules:         config.RiskRules,
+		Scoring:           config.Scoring,
+		FingerprintConfig: config.FingerprintConfig,
+	}
+	ruleSet = ruleSet.clone()
+	ruleSet.Version = ruleSetVersion(ruleSet)
+	detector.rules.Store(newActiveRules(config, ruleSet))
 
-	return &Detector{
-		config:               config,
-		storage:              storage,
-		fingerprintGenerator: fingerprintGenerator,
-		riskAssessor:         riskAssessor,
-	}, nil
+	return detector, nil
+}
+
+// CheckOption 检测选项
+type CheckOption func(opts *checkOptions)
+
+// checkOptions 单次检测的选项
+type checkOptions struct {
+	explain bool
+}
+
+// WithExplain 在检测结果的 Explanation 中返回每条规则的评估过程
+func WithExplain() CheckOption {
+	return func(opts *checkOptions) {
+		opts.explain = true
+	}
+}
+
+// newCheckOptions 应用检测选项
+func newCheckOptions(opts []CheckOption) checkOptions {
+	var options checkOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
 }
 
 // CheckDuplicate 检测重复交易
-func (d *Detector) CheckDuplicate(ctx context.Context, request *TransactionRequest) (*DuplicateCheckResult, error) {
+func (d *Detector) CheckDuplicate(ctx context.Context, request *TransactionRequest, opts ...CheckOption) (*DuplicateCheckResult, error) {
+	options := newCheckOptions(opts)
+	rules := d.rules.Load()
+
+	// 幂等键优先
+	if request.IdempotencyKey != "" {
+		result, err := d.checkIdempotencyKey(ctx, rules, request)
+		if err != nil || result != nil {
+			return result, err
+		}
+	}
+
 	// 生成指纹
-	fingerprint := d.fingerprintGenerator.Generate(request)
+	fingerprints, err := rules.generateFingerprints(request)
+	if err != nil {
+		return nil, err
+	}
 
 	// 查找相似交易
-	similarTx, err := d.storage.GetSimilar(ctx, fingerprint, d.config.TimeWindow)
+	lists := make([][]*TransactionRecord, 0, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		similarTx, err := d.storage.GetSimilar(ctx, fingerprint, rules.horizon)
+		if err != nil {
+			return nil, fmt.Errorf("get similar transactions failed: %w", err)
+		}
+		lists = append(lists, similarTx)
+	}
+	similarTx := mergeRecords(lists...)
+
+	result := d.assess(ctx, rules, request, fingerprints, similarTx, options)
+
+	d.config.Logger.WithFields(map[string]interface{}{
+		"fingerprint":       shortFingerprint(fingerprints[0]),
+		"similar_count":     len(similarTx),
+		"risk_level":        result.RiskLevel,
+		"suggestion_action": result.SuggestionAction,
+	}).Info("duplicate check completed")
+
+	return result, nil
+}
+
+// CheckAndReserve 原子地检测重复交易并预留一笔PENDING记录
+// 检测结果不为BLOCK时写入PENDING记录，并通过 DuplicateCheckResult.TransactionID 返回预留的交易ID；
+// 调用方需在交易完成或放弃后调用 UpdateTransactionStatus 更新状态
+func (d *Detector) CheckAndReserve(ctx context.Context, request *TransactionRequest, opts ...CheckOption) (*DuplicateCheckResult, error) {
+	options := newCheckOptions(opts)
+	rules := d.rules.Load()
+
+	if request.IdempotencyKey != "" {
+		result, err := d.checkIdempotencyKey(ctx, rules, request)
+		if err != nil || result != nil {
+			return result, err
+		}
+	}
+
+	fingerprints, err := rules.generateFingerprints(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *DuplicateCheckResult
+	err = d.storage.Reserve(ctx, fingerprints, rules.horizon, func(similarTx []*TransactionRecord) (*TransactionRecord, error) {
+		result = d.assess(ctx, rules, request, fingerprints, similarTx, options)
+		if result.SuggestionAction == ActionBlock {
+			return nil, nil
+		}
+
+		record := newRecordFromRequest(request, StatusPending)
+		setFingerprints(record, fingerprints)
+		result.TransactionID = record.TransactionID
+		return record, nil
+	})
+	if errors.Is(err, ErrIdempotencyKeyExists) {
+		// 相同幂等键的请求已抢先预留
+		result, err := d.checkIdempotencyKey(ctx, rules, request)
+		if err == nil && result == nil {
+			err = ErrIdempotencyKeyExists
+		}
+		return result, err
+	}
 	if err != nil {
-		return nil, fmt.Errorf("get similar transactions failed: %w", err)
+		return nil, fmt.Errorf("reserve transaction failed: %w", err)
 	}
 
-	// 风险评估
-	riskLevel, action, message := d.riskAssessor.Assess(request, similarTx)
+	d.config.Logger.WithFields(map[string]interface{}{
+		"fingerprint":       shortFingerprint(fingerprints[0]),
+		"similar_count":     len(result.SimilarTransactions),
+		"risk_level":        result.RiskLevel,
+		"suggestion_action": result.SuggestionAction,
+		"transaction_id":    result.TransactionID,
+	}).Info("duplicate check and reserve completed")
+
+	return result, nil
+}
+
+// checkIdempotencyKey 按幂等键查找原交易
+// 找到且请求内容一致时返回重放结果，内容不一致时返回 ErrIdempotencyKeyConflict，未找到时返回nil
+func (d *Detector) checkIdempotencyKey(ctx context.Context, rules *activeRules, request *TransactionRequest) (*DuplicateCheckResult, error) {
+	original, err := d.storage.GetByIdempotencyKey(ctx, request.IdempotencyKey)
+	if errors.Is(err, ErrTransactionNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get transaction by idempotency key failed: %w", err)
+	}
+
+	if original.PayloadHash != payloadHash(request) {
+		return nil, ErrIdempotencyKeyConflict
+	}
+
+	key := MessageKeyIdempotentReplay
+	if original.Status == StatusPending {
+		key = MessageKeyIdempotentPending
+	}
+	message := rules.riskAssessor.messages.message(requestLocale(ctx, request), key, &MessageData{Request: request})
+
+	d.config.Logger.WithFields(map[string]interface{}{
+		"transaction_id": original.TransactionID,
+		"status":         original.Status,
+	}).Info("idempotent replay detected")
+
+	return &DuplicateCheckResult{
+		IsDuplicate:         true,
+		SimilarTransactions: []*TransactionRecord{original},
+		RiskLevel:           RiskLevelHigh,
+		SuggestionAction:    ActionBlock,
+		Message:             message,
+		Fingerprint:         original.Fingerprint,
+		CheckedAt:           time.Now(),
+		IdempotentReplay:    true,
+		OriginalTransaction: original,
+		RulesVersion:        rules.ruleSet.Version,
+	}, nil
+}
+
+// assess 根据相似交易生成检测结果
+func (d *Detector) assess(ctx context.Context, rules *activeRules, request *TransactionRequest, fingerprints []string, similarTx []*TransactionRecord, options checkOptions) *DuplicateCheckResult {
+	assessment := rules.riskAssessor.evaluate(request, similarTx, options.explain, requestLocale(ctx, request))
 
 	result := &DuplicateCheckResult{
 		IsDuplicate:         len(similarTx) > 0,
 		SimilarTransactions: similarTx,
-		RiskLevel:           riskLevel,
-		SuggestionAction:    action,
-		Message:             message,
-		Fingerprint:         fingerprint,
+		RiskLevel:           assessment.RiskLevel,
+		SuggestionAction:    assessment.Action,
+		Message:             assessment.Message,
+		Fingerprint:         fingerprints[0],
 		CheckedAt:           time.Now(),
+		Score:               assessment.Score,
+		MatchedRules:        assessment.MatchedRules,
+		Explanation:         assessment.Explanation,
+		RulesVersion:        rules.ruleSet.Version,
+	}
+	if len(fingerprints) > 1 {
+		result.Fingerprints = fingerprints
 	}
 
-	d.config.Logger.WithFields(map[string]interface{}{
-		"fingerprint":       fingerprint[:8],
-		"similar_count":     len(similarTx),
-		"risk_level":        riskLevel,
-		"suggestion_action": action,
-	}).Info("duplicate check completed")
+	return result
+}
 
-	return result, nil
+// requestLocale 返回提示消息的语言，请求中的 Locale 优先于上下文
+func requestLocale(ctx context.Context, request *TransactionRequest) string {
+	if request.Locale != "" {
+		return request.Locale
+	}
+	return LocaleFromContext(ctx)
+}
+
+// generateFingerprints 生成请求指纹
+func (r *activeRules) generateFingerprints(request *TransactionRequest) ([]string, error) {
+	fingerprints := r.fingerprinter.Fingerprints(request)
+	if len(fingerprints) == 0 {
+		return nil, fmt.Errorf("%w: no fingerprint generated", ErrInvalidTransactionRequest)
+	}
+	return fingerprints, nil
 }
 
 // RecordTransaction 记录交易
@@ -87,18 +268,27 @@ func (d *Detector) RecordTransaction(ctx context.Context, record *TransactionRec
 		record.CreatedAt = time.Now()
 	}
 	record.UpdatedAt = time.Now()
+	if record.IdempotencyKey != "" && record.PayloadHash == "" {
+		record.PayloadHash = payloadHash(requestFromRecord(record))
+	}
 
 	// 生成指纹
-	record.Fingerprint = d.fingerprintGenerator.GenerateFromRecord(record)
+	fingerprints, err := d.rules.Load().generateFingerprints(requestFromRecord(record))
+	if err != nil {
+		return err
+	}
+	setFingerprints(record, fingerprints)
 
 	// 存储记录
-	if err := d.storage.Store(ctx, record.Fingerprint, record); err != nil {
-		return fmt.Errorf("store transaction failed: %w", err)
+	for _, fingerprint := range fingerprints {
+		if err := d.storage.Store(ctx, fingerprint, record); err != nil {
+			return fmt.Errorf("store transaction failed: %w", err)
+		}
 	}
 
 	d.config.Logger.WithFields(map[string]interface{}{
 		"transaction_id": record.TransactionID,
-		"fingerprint":    record.Fingerprint[:8],
+		"fingerprint":    shortFingerprint(record.Fingerprint),
 		"status":         record.Status,
 	}).Info("transaction recorded")
 
@@ -107,20 +297,135 @@ func (d *Detector) RecordTransaction(ctx context.Context, record *TransactionRec
 
 // UpdateTransactionStatus 更新交易状态
 func (d *Detector) UpdateTransactionStatus(ctx context.Context, transactionID string, status TransactionStatus) error {
-	// 这里可以实现状态更新逻辑
-	// 由于我们使用指纹作为key，需要额外的索引来支持按transactionID查找
+	record, err := d.storage.Update(ctx, transactionID, func(record *TransactionRecord) {
+		record.Status = status
+	})
+	if err != nil {
+		if errors.Is(err, ErrTransactionNotFound) {
+			return err
+		}
+		return fmt.Errorf("update transaction status failed: %w", err)
+	}
+
 	d.config.Logger.WithFields(map[string]interface{}{
 		"transaction_id": transactionID,
+		"fingerprint":    shortFingerprint(record.Fingerprint),
 		"new_status":     status,
 	}).Info("transaction status updated")
 
 	return nil
 }
 
-// Close 关闭检测器
-func (d *Detector) Close() error {
-	if d.storage != nil {
-		return d.storage.Close()
+// CompleteTransaction 更新交易最终状态并保存响应，相同幂等键的重放请求将通过
+// DuplicateCheckResult.OriginalTransaction 取回该响应
+func (d *Detector) CompleteTransaction(ctx context.Context, transactionID string, status TransactionStatus, response json.RawMessage) error {
+	_, err := d.storage.Update(ctx, transactionID, func(record *TransactionRecord) {
+		record.Status = status
+		record.Response = response
+	})
+	if err != nil {
+		if errors.Is(err, ErrTransactionNotFound) {
+			return err
+		}
+		return fmt.Errorf("complete transaction failed: %w", err)
 	}
+
+	d.config.Logger.WithFields(map[string]interface{}{
+		"transaction_id": transactionID,
+		"new_status":     status,
+	}).Info("transaction completed")
+
 	return nil
 }
+
+// newRecordFromRequest 根据交易请求创建记录
+func newRecordFromRequest(request *TransactionRequest, status TransactionStatus) *TransactionRecord {
+	now := time.Now()
+	return &TransactionRecord{
+		TransactionID: uuid.New().String(),
+		FromAccount:   request.FromAccount,
+		ToAccount:     request.ToAccount,
+		Amount:        request.Amount,
+		Currency:      request.Currency,
+		BusinessType:  request.BusinessType,
+		Channel:       request.Channel,
+		Status:        status,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		UserIP:        request.UserIP,
+		DeviceID:      request.DeviceID,
+		UserAgent:     request.UserAgent,
+		Extra:         request.Extra,
+
+		IdempotencyKey: request.IdempotencyKey,
+		PayloadHash:    payloadHash(request),
+	}
+}
+
+// setFingerprints 设置记录指纹，单一指纹时不填充 Fingerprints
+func setFingerprints(record *TransactionRecord, fingerprints []string) {
+	record.Fingerprint = fingerprints[0]
+	record.Fingerprints = nil
+	if len(fingerprints) > 1 {
+		record.Fingerprints = fingerprints
+	}
+}
+
+// shortFingerprint 截取指纹前缀用于日志
+func shortFingerprint(fingerprint string) string {
+	if len(fingerprint) > 8 {
+		return fingerprint[:8]
+	}
+	return fingerprint
+}
+
+// Start 启动存储的后台任务（如 Redis 存储的过期索引清理），后台任务在 Shutdown 或 ctx 取消后停止
+// 内存与磁盘存储在创建时即启动清理，SQL 存储的清理由调用方按审计保留期执行；不调用 Start 时检测器同样可用
+func (d *Detector) Start(ctx context.Context) error {
+	d.lifecycleMu.Lock()
+	defer d.lifecycleMu.Unlock()
+
+	if d.closed {
+		return ErrDetectorClosed
+	}
+	if d.started {
+		return ErrDetectorStarted
+	}
+
+	if starter, ok := d.storage.(StorageStarter); ok {
+		if err := starter.Start(ctx); err != nil {
+			return fmt.Errorf("start storage failed: %w", err)
+		}
+	}
+	d.started = true
+
+	return nil
+}
+
+// Shutdown 停止检测器的后台协程（如 WatchRuleFile）与存储的后台任务，等待进行中的清理退出后关闭存储
+// ctx 先结束时返回 ctx.Err()，可再次调用以完成关闭
+func (d *Detector) Shutdown(ctx context.Context) error {
+	d.lifecycleMu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.done)
+	}
+	d.lifecycleMu.Unlock()
+
+	if err := waitContext(ctx, &d.workers); err != nil {
+		return err
+	}
+
+	if d.storage == nil {
+		return nil
+	}
+	if shutdowner, ok := d.storage.(StorageShutdowner); ok {
+		return shutdowner.Shutdown(ctx)
+	}
+	return d.storage.Close()
+}
+
+// Close 关闭检测器，等待后台协程退出
+func (d *Detector) Close() error {
+	return d.Shutdown(context.Background())
+}
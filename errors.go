@@ -3,10 +3,24 @@ package txndedup
 import "errors"
 
 var (
+	ErrInvalidConfig             = errors.New("invalid config")
 	ErrInvalidTimeWindow         = errors.New("invalid time window")
 	ErrInvalidCleanupInterval    = errors.New("invalid cleanup interval")
 	ErrMissingRedisConfig        = errors.New("missing redis config")
+	ErrMissingSQLConfig          = errors.New("missing sql config")
+	ErrMissingBoltConfig         = errors.New("missing bolt config")
+	ErrInvalidFingerprintConfig  = errors.New("invalid fingerprint config")
+	ErrInvalidRiskRule           = errors.New("invalid risk rule")
 	ErrUnsupportedStorageType    = errors.New("unsupported storage type")
 	ErrInvalidTransactionRequest = errors.New("invalid transaction request")
+	ErrAmountOverflow            = errors.New("amount out of range")
 	ErrTransactionNotFound       = errors.New("transaction not found")
+	ErrIdempotencyKeyExists      = errors.New("idempotency key already exists")
+	ErrIdempotencyKeyConflict    = errors.New("idempotency key reused with a different payload")
+	ErrReservationConflict       = errors.New("reservation conflict, too many concurrent updates")
+	ErrStorageFull               = errors.New("storage capacity exceeded")
+	ErrDetectorStarted           = errors.New("detector already started")
+	ErrDetectorClosed            = errors.New("detector closed")
+	ErrInvalidSnapshot           = errors.New("invalid snapshot")
+	ErrInvalidWAL                = errors.New("invalid write-ahead log")
 )
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"log"
+
+	"github.com/wzynn/txndedup"
 )
 
 func main() {
@@ -20,10 +22,14 @@ func main() {
 	ctx := context.Background()
 
 	// 模拟交易请求
+	amount, err := txndedup.MoneyFromFloat(100.00, "USD")
+	if err != nil {
+		log.Fatal(err)
+	}
 	request := &txndedup.TransactionRequest{
 		FromAccount:  "account_001",
 		ToAccount:    "account_002",
-		Amount:       100.00,
+		Amount:       amount,
 		Currency:     "USD",
 		BusinessType: "transfer",
 		Channel:      "web",
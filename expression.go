@@ -0,0 +1,900 @@
+package txndedup
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Expression 编译后的规则条件表达式
+//
+// 表达式可访问的变量：
+//   - req：当前交易请求，其字段也可直接以顶层变量访问，如 amount、channel
+//   - similar：经规则过滤后的相似交易列表
+//
+// 请求与记录字段：from_account、to_account、amount、currency、business_type、channel、
+// user_ip、device_id、user_agent、idempotency_key、extra；记录另有 transaction_id、status、
+// age_seconds（距创建的秒数）
+//
+// 函数：count(list)、count(list, pred)、exists(list, pred)、all(list, pred)、sum(list, expr)、
+// contains(s, sub)、starts_with(s, prefix)、lower(s)；pred/expr 中以 s 表示当前元素
+//
+// 示例：amount > 10000 && count(similar, s.channel != req.channel) >= 1
+type Expression struct {
+	source string
+	root   exprNode
+}
+
+// CompileExpression 解析并类型检查表达式，表达式结果必须为布尔值
+func CompileExpression(source string) (*Expression, error) {
+	root, err := parseExpression(source)
+	if err != nil {
+		return nil, fmt.Errorf("parse expression failed: %w", err)
+	}
+
+	typ, err := root.check(newCheckScope())
+	if err != nil {
+		return nil, fmt.Errorf("check expression failed: %w", err)
+	}
+	if typ.kind != kindBool && typ.kind != kindDyn {
+		return nil, fmt.Errorf("check expression failed: expression must be bool, got %s", typ)
+	}
+
+	return &Expression{source: source, root: root}, nil
+}
+
+// String 返回表达式源码
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Eval 对交易请求及相似交易求值
+func (e *Expression) Eval(request *TransactionRequest, similarTx []*TransactionRecord) (bool, error) {
+	items := make([]interface{}, len(similarTx))
+	for i, tx := range similarTx {
+		items[i] = tx
+	}
+
+	env := &evalScope{
+		vars: map[string]interface{}{
+			"req":     request,
+			"similar": items,
+		},
+		now: time.Now(),
+	}
+
+	value, err := e.root.eval(env)
+	if err != nil {
+		return false, err
+	}
+
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression result is %T, not bool", value)
+	}
+	return result, nil
+}
+
+// typeKind 表达式类型
+type typeKind int
+
+const (
+	kindDyn typeKind = iota // 运行时确定，如 extra 中的值
+	kindBool
+	kindNumber
+	kindString
+	kindList
+	kindRequest
+	kindRecord
+	kindMap
+)
+
+// exprType 表达式静态类型
+type exprType struct {
+	kind typeKind
+	elem *exprType // 列表元素类型
+}
+
+var (
+	typeDyn     = exprType{kind: kindDyn}
+	typeBool    = exprType{kind: kindBool}
+	typeNumber  = exprType{kind: kindNumber}
+	typeString  = exprType{kind: kindString}
+	typeRequest = exprType{kind: kindRequest}
+	typeRecord  = exprType{kind: kindRecord}
+	typeMap     = exprType{kind: kindMap}
+)
+
+func listOf(elem exprType) exprType {
+	return exprType{kind: kindList, elem: &elem}
+}
+
+func (t exprType) String() string {
+	switch t.kind {
+	case kindBool:
+		return "bool"
+	case kindNumber:
+		return "number"
+	case kindString:
+		return "string"
+	case kindList:
+		return "list<" + t.elem.String() + ">"
+	case kindRequest:
+		return "request"
+	case kindRecord:
+		return "record"
+	case kindMap:
+		return "map"
+	default:
+		return "dyn"
+	}
+}
+
+// is 类型是否兼容，dyn 与任意类型兼容
+func (t exprType) is(kind typeKind) bool {
+	return t.kind == kind || t.kind == kindDyn
+}
+
+// fieldDef 对象字段定义
+type fieldDef struct {
+	typ exprType
+	get func(object interface{}, env *evalScope) interface{}
+}
+
+// requestFields 请求字段
+var requestFields = map[string]fieldDef{
+	"from_account":    stringField(func(r *TransactionRequest) string { return r.FromAccount }),
+	"to_account":      stringField(func(r *TransactionRequest) string { return r.ToAccount }),
+	"currency":        stringField(func(r *TransactionRequest) string { return r.Currency }),
+	"business_type":   stringField(func(r *TransactionRequest) string { return r.BusinessType }),
+	"channel":         stringField(func(r *TransactionRequest) string { return r.Channel }),
+	"user_ip":         stringField(func(r *TransactionRequest) string { return r.UserIP }),
+	"device_id":       stringField(func(r *TransactionRequest) string { return r.DeviceID }),
+	"user_agent":      stringField(func(r *TransactionRequest) string { return r.UserAgent }),
+	"idempotency_key": stringField(func(r *TransactionRequest) string { return r.IdempotencyKey }),
+	"amount": {typ: typeNumber, get: func(object interface{}, _ *evalScope) interface{} {
+		return object.(*TransactionRequest).Amount.Float64()
+	}},
+	"extra": {typ: typeMap, get: func(object interface{}, _ *evalScope) interface{} {
+		return object.(*TransactionRequest).Extra
+	}},
+}
+
+// recordFields 记录字段
+var recordFields = map[string]fieldDef{
+	"transaction_id":  recordStringField(func(r *TransactionRecord) string { return r.TransactionID }),
+	"from_account":    recordStringField(func(r *TransactionRecord) string { return r.FromAccount }),
+	"to_account":      recordStringField(func(r *TransactionRecord) string { return r.ToAccount }),
+	"currency":        recordStringField(func(r *TransactionRecord) string { return r.Currency }),
+	"business_type":   recordStringField(func(r *TransactionRecord) string { return r.BusinessType }),
+	"channel":         recordStringField(func(r *TransactionRecord) string { return r.Channel }),
+	"status":          recordStringField(func(r *TransactionRecord) string { return string(r.Status) }),
+	"user_ip":         recordStringField(func(r *TransactionRecord) string { return r.UserIP }),
+	"device_id":       recordStringField(func(r *TransactionRecord) string { return r.DeviceID }),
+	"user_agent":      recordStringField(func(r *TransactionRecord) string { return r.UserAgent }),
+	"idempotency_key": recordStringField(func(r *TransactionRecord) string { return r.IdempotencyKey }),
+	"amount": {typ: typeNumber, get: func(object interface{}, _ *evalScope) interface{} {
+		return object.(*TransactionRecord).Amount.Float64()
+	}},
+	"age_seconds": {typ: typeNumber, get: func(object interface{}, env *evalScope) interface{} {
+		return env.now.Sub(object.(*TransactionRecord).CreatedAt).Seconds()
+	}},
+	"extra": {typ: typeMap, get: func(object interface{}, _ *evalScope) interface{} {
+		return object.(*TransactionRecord).Extra
+	}},
+}
+
+func stringField(get func(*TransactionRequest) string) fieldDef {
+	return fieldDef{typ: typeString, get: func(object interface{}, _ *evalScope) interface{} {
+		return get(object.(*TransactionRequest))
+	}}
+}
+
+func recordStringField(get func(*TransactionRecord) string) fieldDef {
+	return fieldDef{typ: typeString, get: func(object interface{}, _ *evalScope) interface{} {
+		return get(object.(*TransactionRecord))
+	}}
+}
+
+// checkScope 类型检查作用域
+type checkScope struct {
+	vars   map[string]exprType
+	parent *checkScope
+}
+
+func newCheckScope() *checkScope {
+	return &checkScope{vars: map[string]exprType{
+		"req":     typeRequest,
+		"similar": listOf(typeRecord),
+	}}
+}
+
+func (s *checkScope) lookup(name string) (exprType, bool) {
+	for scope := s; scope != nil; scope = scope.parent {
+		if typ, exists := scope.vars[name]; exists {
+			return typ, true
+		}
+	}
+	return exprType{}, false
+}
+
+func (s *checkScope) with(name string, typ exprType) *checkScope {
+	return &checkScope{vars: map[string]exprType{name: typ}, parent: s}
+}
+
+// evalScope 求值作用域
+type evalScope struct {
+	vars   map[string]interface{}
+	parent *evalScope
+	now    time.Time
+}
+
+func (s *evalScope) lookup(name string) (interface{}, bool) {
+	for scope := s; scope != nil; scope = scope.parent {
+		if value, exists := scope.vars[name]; exists {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+func (s *evalScope) with(name string, value interface{}) *evalScope {
+	return &evalScope{vars: map[string]interface{}{name: value}, parent: s, now: s.now}
+}
+
+// macroVar 谓词函数中当前元素的变量名
+const macroVar = "s"
+
+// exprNode 语法树节点
+type exprNode interface {
+	check(scope *checkScope) (exprType, error)
+	eval(env *evalScope) (interface{}, error)
+}
+
+// literalNode 字面量
+type literalNode struct {
+	value interface{}
+	pos   int
+}
+
+func (n *literalNode) check(*checkScope) (exprType, error) {
+	switch n.value.(type) {
+	case bool:
+		return typeBool, nil
+	case float64:
+		return typeNumber, nil
+	default:
+		return typeString, nil
+	}
+}
+
+func (n *literalNode) eval(*evalScope) (interface{}, error) {
+	return n.value, nil
+}
+
+// identNode 变量，未定义的变量解析为请求字段
+type identNode struct {
+	name string
+	pos  int
+}
+
+func (n *identNode) check(scope *checkScope) (exprType, error) {
+	if typ, exists := scope.lookup(n.name); exists {
+		return typ, nil
+	}
+	if field, exists := requestFields[n.name]; exists {
+		return field.typ, nil
+	}
+	return exprType{}, fmt.Errorf("undefined variable %q at position %d", n.name, n.pos)
+}
+
+func (n *identNode) eval(env *evalScope) (interface{}, error) {
+	if value, exists := env.lookup(n.name); exists {
+		return value, nil
+	}
+	request, _ := env.lookup("req")
+	return requestFields[n.name].get(request, env), nil
+}
+
+// fieldNode 字段访问
+type fieldNode struct {
+	object exprNode
+	field  string
+	pos    int
+}
+
+func (n *fieldNode) check(scope *checkScope) (exprType, error) {
+	typ, err := n.object.check(scope)
+	if err != nil {
+		return exprType{}, err
+	}
+
+	var fields map[string]fieldDef
+	switch typ.kind {
+	case kindRequest:
+		fields = requestFields
+	case kindRecord:
+		fields = recordFields
+	case kindMap, kindDyn:
+		return typeDyn, nil
+	default:
+		return exprType{}, fmt.Errorf("type %s has no field %q at position %d", typ, n.field, n.pos)
+	}
+
+	field, exists := fields[n.field]
+	if !exists {
+		return exprType{}, fmt.Errorf("unknown field %q on %s at position %d", n.field, typ, n.pos)
+	}
+	return field.typ, nil
+}
+
+func (n *fieldNode) eval(env *evalScope) (interface{}, error) {
+	object, err := n.object.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return getField(object, n.field, env, n.pos)
+}
+
+// getField 运行时读取字段
+func getField(object interface{}, name string, env *evalScope, pos int) (interface{}, error) {
+	switch o := object.(type) {
+	case *TransactionRequest:
+		if field, exists := requestFields[name]; exists {
+			return field.get(o, env), nil
+		}
+	case *TransactionRecord:
+		if field, exists := recordFields[name]; exists {
+			return field.get(o, env), nil
+		}
+	case map[string]interface{}:
+		return normalizeDyn(o[name]), nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot access field %q of %T at position %d", name, object, pos)
+}
+
+// indexNode 下标访问，支持 map[string] 和 list[number]
+type indexNode struct {
+	object exprNode
+	key    exprNode
+	pos    int
+}
+
+func (n *indexNode) check(scope *checkScope) (exprType, error) {
+	typ, err := n.object.check(scope)
+	if err != nil {
+		return exprType{}, err
+	}
+	keyType, err := n.key.check(scope)
+	if err != nil {
+		return exprType{}, err
+	}
+
+	switch typ.kind {
+	case kindMap:
+		if !keyType.is(kindString) {
+			return exprType{}, fmt.Errorf("map key must be string, got %s at position %d", keyType, n.pos)
+		}
+		return typeDyn, nil
+	case kindList:
+		if !keyType.is(kindNumber) {
+			return exprType{}, fmt.Errorf("list index must be number, got %s at position %d", keyType, n.pos)
+		}
+		return *typ.elem, nil
+	case kindDyn:
+		return typeDyn, nil
+	}
+	return exprType{}, fmt.Errorf("type %s cannot be indexed at position %d", typ, n.pos)
+}
+
+func (n *indexNode) eval(env *evalScope) (interface{}, error) {
+	object, err := n.object.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	key, err := n.key.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch o := object.(type) {
+	case map[string]interface{}:
+		k, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key must be string at position %d", n.pos)
+		}
+		return normalizeDyn(o[k]), nil
+	case []interface{}:
+		i, ok := key.(float64)
+		if !ok || i != math.Trunc(i) {
+			return nil, fmt.Errorf("list index must be integer at position %d", n.pos)
+		}
+		// 先按 float64 比较，超出 int 范围的下标转换后会回绕
+		if i < 0 || i >= float64(len(o)) {
+			return nil, fmt.Errorf("list index %v out of range at position %d", i, n.pos)
+		}
+		return o[int(i)], nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot index %T at position %d", object, n.pos)
+}
+
+// listNode 列表字面量
+type listNode struct {
+	items []exprNode
+	pos   int
+}
+
+func (n *listNode) check(scope *checkScope) (exprType, error) {
+	elem := typeDyn
+	for i, item := range n.items {
+		typ, err := item.check(scope)
+		if err != nil {
+			return exprType{}, err
+		}
+		if i == 0 {
+			elem = typ
+		} else if typ.kind != elem.kind {
+			elem = typeDyn
+		}
+	}
+	return listOf(elem), nil
+}
+
+func (n *listNode) eval(env *evalScope) (interface{}, error) {
+	items := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		value, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = value
+	}
+	return items, nil
+}
+
+// unaryNode 一元运算
+type unaryNode struct {
+	op      string
+	operand exprNode
+	pos     int
+}
+
+func (n *unaryNode) check(scope *checkScope) (exprType, error) {
+	typ, err := n.operand.check(scope)
+	if err != nil {
+		return exprType{}, err
+	}
+	if n.op == "!" {
+		if !typ.is(kindBool) {
+			return exprType{}, fmt.Errorf("operator ! requires bool, got %s at position %d", typ, n.pos)
+		}
+		return typeBool, nil
+	}
+	if !typ.is(kindNumber) {
+		return exprType{}, fmt.Errorf("operator - requires number, got %s at position %d", typ, n.pos)
+	}
+	return typeNumber, nil
+}
+
+func (n *unaryNode) eval(env *evalScope) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operator ! requires bool, got %T at position %d", value, n.pos)
+		}
+		return !b, nil
+	}
+	f, ok := value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("operator - requires number, got %T at position %d", value, n.pos)
+	}
+	return -f, nil
+}
+
+// binaryNode 二元运算
+type binaryNode struct {
+	op          string
+	left, right exprNode
+	pos         int
+}
+
+func (n *binaryNode) check(scope *checkScope) (exprType, error) {
+	left, err := n.left.check(scope)
+	if err != nil {
+		return exprType{}, err
+	}
+	right, err := n.right.check(scope)
+	if err != nil {
+		return exprType{}, err
+	}
+
+	mismatch := func() error {
+		return fmt.Errorf("operator %s cannot be applied to %s and %s at position %d", n.op, left, right, n.pos)
+	}
+
+	switch n.op {
+	case "&&", "||":
+		if !left.is(kindBool) || !right.is(kindBool) {
+			return exprType{}, mismatch()
+		}
+		return typeBool, nil
+
+	case "==", "!=":
+		if left.kind != kindDyn && right.kind != kindDyn && left.kind != right.kind {
+			return exprType{}, mismatch()
+		}
+		return typeBool, nil
+
+	case "<", "<=", ">", ">=":
+		if left.kind == kindDyn || right.kind == kindDyn {
+			return typeBool, nil
+		}
+		if left.kind != right.kind || (left.kind != kindNumber && left.kind != kindString) {
+			return exprType{}, mismatch()
+		}
+		return typeBool, nil
+
+	case "in":
+		if right.kind == kindDyn {
+			return typeBool, nil
+		}
+		if right.kind != kindList {
+			return exprType{}, mismatch()
+		}
+		if left.kind != kindDyn && right.elem.kind != kindDyn && left.kind != right.elem.kind {
+			return exprType{}, mismatch()
+		}
+		return typeBool, nil
+
+	case "+":
+		if left.kind == kindString && right.is(kindString) || right.kind == kindString && left.is(kindString) {
+			return typeString, nil
+		}
+		fallthrough
+
+	default: // - * / %
+		if !left.is(kindNumber) || !right.is(kindNumber) {
+			return exprType{}, mismatch()
+		}
+		if left.kind == kindDyn || right.kind == kindDyn {
+			return typeDyn, nil
+		}
+		return typeNumber, nil
+	}
+}
+
+func (n *binaryNode) eval(env *evalScope) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// 短路求值
+	if n.op == "&&" || n.op == "||" {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operator %s requires bool, got %T at position %d", n.op, left, n.pos)
+		}
+		if (n.op == "&&" && !l) || (n.op == "||" && l) {
+			return l, nil
+		}
+		right, err := n.right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operator %s requires bool, got %T at position %d", n.op, right, n.pos)
+		}
+		return r, nil
+	}
+
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==", "!=":
+		equal, err := equalValues(left, right)
+		if err != nil {
+			return nil, fmt.Errorf("%v at position %d", err, n.pos)
+		}
+		return equal == (n.op == "=="), nil
+
+	case "in":
+		items, ok := right.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("operator in requires list, got %T at position %d", right, n.pos)
+		}
+		for _, item := range items {
+			equal, err := equalValues(left, item)
+			if err != nil {
+				return nil, fmt.Errorf("%v at position %d", err, n.pos)
+			}
+			if equal {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "<", "<=", ">", ">=":
+		cmp, err := compareValues(left, right)
+		if err != nil {
+			return nil, fmt.Errorf("%v at position %d", err, n.pos)
+		}
+		switch n.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	}
+
+	if n.op == "+" {
+		if l, ok := left.(string); ok {
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		}
+	}
+
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("operator %s cannot be applied to %T and %T at position %d", n.op, left, right, n.pos)
+	}
+
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero at position %d", n.pos)
+		}
+		return l / r, nil
+	default:
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero at position %d", n.pos)
+		}
+		return math.Mod(l, r), nil
+	}
+}
+
+// equalValues 比较两个标量值是否相等，类型不同视为不相等
+func equalValues(left, right interface{}) (bool, error) {
+	for _, value := range []interface{}{left, right} {
+		switch value.(type) {
+		case nil, bool, string, float64, *TransactionRequest, *TransactionRecord:
+		default:
+			return false, fmt.Errorf("cannot compare %T for equality", value)
+		}
+	}
+	return left == right, nil
+}
+
+// compareValues 比较两个数字或两个字符串
+func compareValues(left, right interface{}) (int, error) {
+	switch l := left.(type) {
+	case float64:
+		if r, ok := right.(float64); ok {
+			switch {
+			case l < r:
+				return -1, nil
+			case l > r:
+				return 1, nil
+			default:
+				return 0, nil
+			}
+		}
+	case string:
+		if r, ok := right.(string); ok {
+			return strings.Compare(l, r), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %T and %T", left, right)
+}
+
+// callNode 函数调用
+type callNode struct {
+	name string
+	args []exprNode
+	pos  int
+}
+
+func (n *callNode) check(scope *checkScope) (exprType, error) {
+	argError := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%s: %s at position %d", n.name, fmt.Sprintf(format, args...), n.pos)
+	}
+
+	switch n.name {
+	case "count", "exists", "all", "sum":
+		minArgs := 2
+		if n.name == "count" {
+			minArgs = 1
+		}
+		if len(n.args) < minArgs || len(n.args) > 2 {
+			return exprType{}, argError("wrong number of arguments")
+		}
+
+		listType, err := n.args[0].check(scope)
+		if err != nil {
+			return exprType{}, err
+		}
+		if !listType.is(kindList) {
+			return exprType{}, argError("first argument must be list, got %s", listType)
+		}
+
+		elem := typeDyn
+		if listType.kind == kindList {
+			elem = *listType.elem
+		}
+
+		if len(n.args) == 2 {
+			bodyType, err := n.args[1].check(scope.with(macroVar, elem))
+			if err != nil {
+				return exprType{}, err
+			}
+			want := kindBool
+			if n.name == "sum" {
+				want = kindNumber
+			}
+			if !bodyType.is(want) {
+				return exprType{}, argError("second argument must be %s, got %s", exprType{kind: want}, bodyType)
+			}
+		}
+
+		if n.name == "count" || n.name == "sum" {
+			return typeNumber, nil
+		}
+		return typeBool, nil
+
+	case "contains", "starts_with", "lower":
+		want := 2
+		if n.name == "lower" {
+			want = 1
+		}
+		if len(n.args) != want {
+			return exprType{}, argError("wrong number of arguments")
+		}
+		for _, arg := range n.args {
+			typ, err := arg.check(scope)
+			if err != nil {
+				return exprType{}, err
+			}
+			if !typ.is(kindString) {
+				return exprType{}, argError("arguments must be string, got %s", typ)
+			}
+		}
+		if n.name == "lower" {
+			return typeString, nil
+		}
+		return typeBool, nil
+	}
+
+	return exprType{}, fmt.Errorf("unknown function %q at position %d", n.name, n.pos)
+}
+
+func (n *callNode) eval(env *evalScope) (interface{}, error) {
+	switch n.name {
+	case "count", "exists", "all", "sum":
+		value, err := n.args[0].eval(env)
+		if err != nil {
+			return nil, err
+		}
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: first argument must be list at position %d", n.name, n.pos)
+		}
+		if len(n.args) == 1 {
+			return float64(len(items)), nil
+		}
+
+		var count, sum float64
+		for _, item := range items {
+			result, err := n.args[1].eval(env.with(macroVar, item))
+			if err != nil {
+				return nil, err
+			}
+
+			if n.name == "sum" {
+				f, ok := result.(float64)
+				if !ok {
+					return nil, fmt.Errorf("sum: expression must be number at position %d", n.pos)
+				}
+				sum += f
+				continue
+			}
+
+			matched, ok := result.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%s: predicate must be bool at position %d", n.name, n.pos)
+			}
+			switch {
+			case matched && n.name == "exists":
+				return true, nil
+			case !matched && n.name == "all":
+				return false, nil
+			case matched:
+				count++
+			}
+		}
+
+		switch n.name {
+		case "count":
+			return count, nil
+		case "sum":
+			return sum, nil
+		case "exists":
+			return false, nil
+		default:
+			return true, nil
+		}
+
+	default:
+		args := make([]string, len(n.args))
+		for i, arg := range n.args {
+			value, err := arg.eval(env)
+			if err != nil {
+				return nil, err
+			}
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: arguments must be string at position %d", n.name, n.pos)
+			}
+			args[i] = s
+		}
+
+		switch n.name {
+		case "contains":
+			return strings.Contains(args[0], args[1]), nil
+		case "starts_with":
+			return strings.HasPrefix(args[0], args[1]), nil
+		default:
+			return strings.ToLower(args[0]), nil
+		}
+	}
+}
+
+// normalizeDyn 将扩展字段值转换为表达式支持的类型
+func normalizeDyn(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, string, float64:
+		return v
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = normalizeDyn(item)
+		}
+		return items
+	case map[string]interface{}:
+		return v
+	default:
+		return extraValueString(v)
+	}
+}
@@ -2,39 +2,69 @@ package txndedup
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
-	"math"
+	"math/big"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 // FingerprintGenerator 指纹生成器
 type FingerprintGenerator struct {
-	config FingerprintConfig
+	config         FingerprintConfig
+	canonicalizers []AccountCanonicalizer
+	extraFields    []*extraFieldNormalizer
 }
 
 // NewFingerprintGenerator 创建指纹生成器
+// 账户规范化规则与扩展字段的正则需预先通过 Config.Validate 校验，无效的规则将被忽略
 func NewFingerprintGenerator(config FingerprintConfig) *FingerprintGenerator {
+	var canonicalizers []AccountCanonicalizer
+	for _, name := range config.AccountCanonicalizers {
+		if canonicalizer, err := lookupAccountCanonicalizer(name); err == nil {
+			canonicalizers = append(canonicalizers, canonicalizer)
+		}
+	}
+
+	extraFields := make([]*extraFieldNormalizer, 0, len(config.ExtraFields))
+	for _, field := range config.ExtraFields {
+		normalizer, _ := newExtraFieldNormalizer(field)
+		extraFields = append(extraFields, normalizer)
+	}
+
 	return &FingerprintGenerator{
-		config: config,
+		config:         config,
+		canonicalizers: canonicalizers,
+		extraFields:    extraFields,
 	}
 }
 
-// Generate 生成交易指纹
+// Generate 生成交易指纹，启用金额分桶时返回第一个桶的指纹
 func (fg *FingerprintGenerator) Generate(request *TransactionRequest) string {
+	return fg.generate(request, fg.amountBucket(request.Amount))
+}
+
+// generate 生成交易指纹，bucket 为金额所在的桶
+func (fg *FingerprintGenerator) generate(request *TransactionRequest, bucket *big.Int) string {
 	var components []string
 
 	if fg.config.IncludeFromAccount {
-		components = append(components, "from:"+request.FromAccount)
+		components = append(components, "from:"+fg.canonicalizeAccount(request.FromAccount))
 	}
 
 	if fg.config.IncludeToAccount {
-		components = append(components, "to:"+request.ToAccount)
+		components = append(components, "to:"+fg.canonicalizeAccount(request.ToAccount))
 	}
 
 	if fg.config.IncludeAmount {
-		amount := fg.normalizeAmount(request.Amount)
-		components = append(components, fmt.Sprintf("amount:%.2f", amount))
+		if fg.config.AmountBucket.IsZero() {
+			components = append(components, "amount:"+fg.normalizeAmount(request.Amount, request.Currency))
+		} else {
+			components = append(components, "amount_bucket:"+bucket.String())
+		}
 	}
 
 	if fg.config.IncludeCurrency {
@@ -49,6 +79,10 @@ func (fg *FingerprintGenerator) Generate(request *TransactionRequest) string {
 		components = append(components, "channel:"+request.Channel)
 	}
 
+	for _, field := range fg.extraFields {
+		components = append(components, "extra."+field.key+":"+field.normalize(request.Extra[field.key]))
+	}
+
 	// 排序保证一致性
 	sort.Strings(components)
 
@@ -59,26 +93,200 @@ func (fg *FingerprintGenerator) Generate(request *TransactionRequest) string {
 	return fmt.Sprintf("%x", hash)
 }
 
-// normalizeAmount 标准化金额
-func (fg *FingerprintGenerator) normalizeAmount(amount float64) float64 {
-	if fg.config.AmountPrecision <= 0 {
-		return amount
+// canonicalizeAccount 规范化账户
+func (fg *FingerprintGenerator) canonicalizeAccount(account string) string {
+	for _, canonicalizer := range fg.canonicalizers {
+		account = canonicalizer(account)
+	}
+	return account
+}
+
+// normalizeAmount 标准化金额，按精度四舍五入后格式化；AmountPrecisionCurrency 使用货币的小数位数，精确匹配时只去除尾随零
+func (fg *FingerprintGenerator) normalizeAmount(amount Money, currency string) string {
+	precision := fg.config.AmountPrecision
+	switch precision {
+	case AmountPrecisionCurrency:
+		precision = CurrencyExponent(currency)
+	case AmountPrecisionExact:
+		return amount.Normalize().String()
 	}
 
-	multiplier := math.Pow(10, float64(fg.config.AmountPrecision))
-	return math.Round(amount*multiplier) / multiplier
+	rounded, err := amount.Rescale(precision)
+	if err != nil {
+		// 只有扩大精度会溢出，溢出与否只取决于数值本身，相等的金额仍得到相同的表示
+		return amount.Normalize().String()
+	}
+	return rounded.String()
+}
+
+// Fingerprints 实现 Fingerprinter 接口，启用金额分桶时返回相邻两个桶的指纹
+func (fg *FingerprintGenerator) Fingerprints(request *TransactionRequest) []string {
+	if !fg.config.IncludeAmount || fg.config.AmountBucket.IsZero() {
+		return []string{fg.Generate(request)}
+	}
+
+	bucket := fg.amountBucket(request.Amount)
+	next := new(big.Int).Add(bucket, big.NewInt(1))
+	return []string{fg.generate(request, bucket), fg.generate(request, next)}
+}
+
+// amountBucket 计算金额所在的桶 floor(amount/size - 1/2)，按有理数计算，金额与桶宽的小数位数相差较大时不会溢出
+// 金额 x 落入桶 k 和 k+1，任意两笔差额小于桶宽的金额至少共享一个桶
+func (fg *FingerprintGenerator) amountBucket(amount Money) *big.Int {
+	size := new(big.Rat).Abs(fg.config.AmountBucket.rat())
+	if size.Sign() == 0 {
+		return new(big.Int)
+	}
+
+	q := new(big.Rat).Quo(amount.rat(), size)
+	q.Sub(q, big.NewRat(1, 2))
+	// 分母为正，欧几里得除法即向下取整
+	return new(big.Int).Div(q.Num(), q.Denom())
 }
 
 // GenerateFromRecord 从记录生成指纹
 func (fg *FingerprintGenerator) GenerateFromRecord(record *TransactionRecord) string {
-	request := &TransactionRequest{
+	return fg.Generate(requestFromRecord(record))
+}
+
+// requestFromRecord 从记录还原交易请求
+func requestFromRecord(record *TransactionRecord) *TransactionRequest {
+	return &TransactionRequest{
 		FromAccount:  record.FromAccount,
 		ToAccount:    record.ToAccount,
 		Amount:       record.Amount,
 		Currency:     record.Currency,
 		BusinessType: record.BusinessType,
 		Channel:      record.Channel,
+		UserIP:       record.UserIP,
+		DeviceID:     record.DeviceID,
+		UserAgent:    record.UserAgent,
+		Extra:        record.Extra,
+	}
+}
+
+// payloadHash 计算请求内容摘要，与指纹配置无关，用于判断同一幂等键的请求内容是否一致
+// 覆盖除幂等键与提示语言外的全部字段，扩展字段按键排序编码
+func payloadHash(request *TransactionRequest) string {
+	components := []string{
+		"from:" + request.FromAccount,
+		"to:" + request.ToAccount,
+		"amount:" + request.Amount.Normalize().String(),
+		"currency:" + strings.ToUpper(request.Currency),
+		"type:" + request.BusinessType,
+		"channel:" + request.Channel,
+		"ip:" + request.UserIP,
+		"device:" + request.DeviceID,
+		"ua:" + request.UserAgent,
 	}
 
-	return fg.Generate(request)
+	keys := make([]string, 0, len(request.Extra))
+	for key := range request.Extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		components = append(components, "extra."+strconv.Quote(key)+":"+canonicalValue(request.Extra[key]))
+	}
+
+	hash := sha256.Sum256([]byte(strings.Join(components, "|")))
+	return fmt.Sprintf("%x", hash)
+}
+
+// canonicalValue 将扩展字段的值编码为与类型无关的规范形式，嵌套对象按键排序
+func canonicalValue(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%#v", value)
+	}
+	return string(data)
+}
+
+// extraFieldNormalizer 扩展字段标准化器
+type extraFieldNormalizer struct {
+	key         string
+	normalizers []FieldNormalizer
+	pattern     *regexp.Regexp
+}
+
+// newExtraFieldNormalizer 创建扩展字段标准化器
+func newExtraFieldNormalizer(field ExtraField) (*extraFieldNormalizer, error) {
+	normalizer := &extraFieldNormalizer{
+		key:         field.Key,
+		normalizers: field.Normalizers,
+	}
+
+	if field.Key == "" {
+		return normalizer, fmt.Errorf("extra field key is empty")
+	}
+
+	for _, name := range field.Normalizers {
+		switch name {
+		case NormalizeTrim, NormalizeLowercase, NormalizeDigits:
+		case NormalizeRegex:
+			pattern, err := regexp.Compile(field.Pattern)
+			if err != nil {
+				return normalizer, fmt.Errorf("extra field %q: invalid pattern: %w", field.Key, err)
+			}
+			normalizer.pattern = pattern
+		default:
+			return normalizer, fmt.Errorf("extra field %q: unknown normalizer %q", field.Key, name)
+		}
+	}
+
+	return normalizer, nil
+}
+
+// normalize 标准化字段值
+func (n *extraFieldNormalizer) normalize(value interface{}) string {
+	result := extraValueString(value)
+
+	for _, name := range n.normalizers {
+		switch name {
+		case NormalizeTrim:
+			result = strings.TrimSpace(result)
+		case NormalizeLowercase:
+			result = strings.ToLower(result)
+		case NormalizeDigits:
+			result = strings.Map(func(r rune) rune {
+				if r >= '0' && r <= '9' {
+					return r
+				}
+				return -1
+			}, result)
+		case NormalizeRegex:
+			if n.pattern == nil {
+				continue
+			}
+			// 有捕获组时取第一个捕获组，否则取整个匹配，未匹配时为空
+			match := n.pattern.FindStringSubmatch(result)
+			switch {
+			case len(match) > 1:
+				result = match[1]
+			case len(match) == 1:
+				result = match[0]
+			default:
+				result = ""
+			}
+		}
+	}
+
+	return result
+}
+
+// extraValueString 将扩展字段值转换为字符串
+// 数值统一按十进制格式化，保证请求中的整数与经JSON反序列化后的float64得到相同结果
+func extraValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	default:
+		return fmt.Sprint(v)
+	}
 }
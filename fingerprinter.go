@@ -0,0 +1,83 @@
+package txndedup
+
+import (
+	"crypto/md5"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fingerprinter 指纹生成策略
+// Fingerprints 返回请求的全部指纹，第一个为主指纹；返回空表示该请求无法生成指纹
+type Fingerprinter interface {
+	Fingerprints(request *TransactionRequest) []string
+}
+
+// ExtraFingerprinter 基于扩展字段生成指纹
+type ExtraFingerprinter struct {
+	keys []string
+}
+
+// NewExtraFingerprinter 创建扩展字段指纹生成器，keys 为参与指纹计算的 Extra 字段
+func NewExtraFingerprinter(keys ...string) *ExtraFingerprinter {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+
+	return &ExtraFingerprinter{
+		keys: sorted,
+	}
+}
+
+// Fingerprints 生成指纹，任一字段缺失时不生成指纹
+// 字段名与值均加引号转义，值中包含分隔符时不会与其他字段组合混淆
+func (ef *ExtraFingerprinter) Fingerprints(request *TransactionRequest) []string {
+	if len(ef.keys) == 0 {
+		return nil
+	}
+
+	components := make([]string, 0, len(ef.keys))
+	for _, key := range ef.keys {
+		value, exists := request.Extra[key]
+		if !exists || value == nil {
+			return nil
+		}
+		components = append(components, "extra."+strconv.Quote(key)+":"+strconv.Quote(extraValueString(value)))
+	}
+
+	data := strings.Join(components, "|")
+	hash := md5.Sum([]byte(data))
+
+	return []string{fmt.Sprintf("%x", hash)}
+}
+
+// CompositeFingerprinter 组合多个指纹策略，实现多粒度匹配
+// 请求的指纹为各策略指纹的并集，主指纹取自第一个生成了指纹的策略
+type CompositeFingerprinter struct {
+	fingerprinters []Fingerprinter
+}
+
+// NewCompositeFingerprinter 创建组合指纹生成器
+func NewCompositeFingerprinter(fingerprinters ...Fingerprinter) *CompositeFingerprinter {
+	return &CompositeFingerprinter{
+		fingerprinters: fingerprinters,
+	}
+}
+
+// Fingerprints 生成指纹
+func (cf *CompositeFingerprinter) Fingerprints(request *TransactionRequest) []string {
+	var fingerprints []string
+	seen := make(map[string]bool)
+
+	for _, fingerprinter := range cf.fingerprinters {
+		for _, fingerprint := range fingerprinter.Fingerprints(request) {
+			if seen[fingerprint] {
+				continue
+			}
+			seen[fingerprint] = true
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+
+	return fingerprints
+}
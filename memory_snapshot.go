@@ -0,0 +1,306 @@
+package txndedup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// 快照格式：魔数 | 版本(uint16) | 生成时间(int64纳秒) | 记录数(uint64) | 记录... | CRC32C(uint32)
+// 每条记录为 长度(uint32) + JSON，多指纹共享的记录只写入一次并列出所在的全部指纹；校验和覆盖之前的全部字节
+const (
+	snapshotMagic   = "TXDM"
+	snapshotVersion = 1
+)
+
+// snapshotTable 快照校验和使用的 CRC32C 表
+var snapshotTable = crc32.MakeTable(crc32.Castagnoli)
+
+// snapshotEntry 快照中的一条记录
+type snapshotEntry struct {
+	Fingerprints []string           `json:"fingerprints"` // 记录所在的全部指纹
+	Record       *TransactionRecord `json:"record"`
+}
+
+// Snapshot 将全部记录写入 w，逐个分片加读锁复制，不阻塞其他分片的写入
+func (ms *MemoryStorage) Snapshot(w io.Writer) error {
+	var entries []*snapshotEntry
+	seen := make(map[*TransactionRecord]*snapshotEntry)
+
+	for _, shard := range ms.shards {
+		shard.mu.RLock()
+		for fingerprint, ring := range shard.records {
+			for i := 0; i < ring.size; i++ {
+				record := ring.at(i).record
+				if entry, exists := seen[record]; exists {
+					entry.Fingerprints = append(entry.Fingerprints, fingerprint)
+					continue
+				}
+
+				// 复制记录，写出时不再持有分片锁
+				copied := *record
+				entry := &snapshotEntry{Fingerprints: []string{fingerprint}, Record: &copied}
+				seen[record] = entry
+				entries = append(entries, entry)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	hash := crc32.New(snapshotTable)
+	out := io.MultiWriter(w, hash)
+
+	header := make([]byte, 0, len(snapshotMagic)+2+8+8)
+	header = append(header, snapshotMagic...)
+	header = binary.BigEndian.AppendUint16(header, snapshotVersion)
+	header = binary.BigEndian.AppendUint64(header, uint64(time.Now().UnixNano()))
+	header = binary.BigEndian.AppendUint64(header, uint64(len(entries)))
+	if _, err := out.Write(header); err != nil {
+		return fmt.Errorf("write snapshot failed: %w", err)
+	}
+
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("marshal snapshot entry failed: %w", err)
+		}
+		if _, err := out.Write(binary.BigEndian.AppendUint32(nil, uint32(len(data)))); err != nil {
+			return fmt.Errorf("write snapshot failed: %w", err)
+		}
+		if _, err := out.Write(data); err != nil {
+			return fmt.Errorf("write snapshot failed: %w", err)
+		}
+	}
+
+	if _, err := w.Write(binary.BigEndian.AppendUint32(nil, hash.Sum32())); err != nil {
+		return fmt.Errorf("write snapshot failed: %w", err)
+	}
+	return nil
+}
+
+// Restore 校验快照后将记录写入存储，丢弃已超出保留时长的记录，跳过交易ID已存在的记录
+// 校验失败时返回 ErrInvalidSnapshot，存储内容不变；启用预写日志时恢复的记录同样写入日志，全部写入后刷盘一次
+func (ms *MemoryStorage) Restore(r io.Reader) error {
+	entries, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+
+	// 按创建时间写入，各指纹下的记录保持时间顺序
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Record.CreatedAt.Before(entries[j].Record.CreatedAt)
+	})
+
+	cutoffTime := time.Now().Add(-ms.config.Retention())
+	evictions := ms.evictions.Load()
+	restored, dropped, rejected := 0, 0, 0
+	var seq uint64
+	for _, entry := range entries {
+		if !entry.Record.CreatedAt.After(cutoffTime) {
+			dropped++
+			continue
+		}
+		ok, last, err := ms.restore(entry)
+		switch {
+		case errors.Is(err, ErrStorageFull):
+			rejected++
+		case err != nil:
+			return err
+		case ok:
+			restored++
+			seq = last
+		}
+	}
+	if err := ms.commit(seq); err != nil {
+		return err
+	}
+
+	// 容量上限小于快照中的记录数时，reject 策略下拒绝写入，其他策略下淘汰已恢复的记录
+	logger := ms.config.Logger.WithFields(map[string]interface{}{
+		"restored": restored,
+		"expired":  dropped,
+		"rejected": rejected,
+		"evicted":  ms.evictions.Load() - evictions,
+	})
+	if rejected > 0 || ms.evictions.Load() > evictions {
+		logger.Warn("memory snapshot restored partially, storage capacity exceeded")
+	} else {
+		logger.Info("memory snapshot restored")
+	}
+
+	return nil
+}
+
+// restore 写入快照中的一条记录并追加日志，返回日志帧序号；交易ID已存在时跳过并返回false，超出容量上限时返回 ErrStorageFull
+func (ms *MemoryStorage) restore(entry *snapshotEntry) (bool, uint64, error) {
+	record := entry.Record
+	if _, exists := ms.lookupTransaction(record.TransactionID); exists {
+		return false, 0, nil
+	}
+
+	unlock := ms.lockShards(entry.Fingerprints)
+	defer unlock()
+
+	usages := make(map[*memoryShard]*memoryUsage)
+	for _, fingerprint := range entry.Fingerprints {
+		shard := ms.shard(fingerprint)
+		usage := ms.usage(shard, fingerprint, record)
+		if total, exists := usages[shard]; exists {
+			total.records += usage.records
+			total.bytes += usage.bytes
+		} else {
+			usages[shard] = usage
+		}
+	}
+	if err := ms.admit(usages); err != nil {
+		return false, 0, err
+	}
+	seq, err := ms.log(&walEntry{Op: walOpStore, Fingerprints: entry.Fingerprints, Record: record})
+	if err != nil {
+		return false, 0, err
+	}
+
+	for _, fingerprint := range entry.Fingerprints {
+		ms.store(ms.shard(fingerprint), fingerprint, record)
+	}
+	return true, seq, nil
+}
+
+// readSnapshot 读取并校验快照
+func readSnapshot(r io.Reader) ([]*snapshotEntry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot failed: %w", err)
+	}
+
+	headerSize := len(snapshotMagic) + 2 + 8 + 8
+	if len(data) < headerSize+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, fmt.Errorf("%w: bad header", ErrInvalidSnapshot)
+	}
+
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, snapshotTable) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidSnapshot)
+	}
+
+	if version := binary.BigEndian.Uint16(body[len(snapshotMagic):]); version != snapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, version)
+	}
+	count := binary.BigEndian.Uint64(body[headerSize-8:])
+
+	reader := bytes.NewReader(body[headerSize:])
+	var entries []*snapshotEntry
+	for i := uint64(0); i < count; i++ {
+		var size uint32
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return nil, fmt.Errorf("%w: truncated entry %d", ErrInvalidSnapshot, i)
+		}
+		raw := make([]byte, size)
+		if _, err := io.ReadFull(reader, raw); err != nil {
+			return nil, fmt.Errorf("%w: truncated entry %d", ErrInvalidSnapshot, i)
+		}
+
+		var entry snapshotEntry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("%w: entry %d: %v", ErrInvalidSnapshot, i, err)
+		}
+		if entry.Record == nil || len(entry.Fingerprints) == 0 {
+			return nil, fmt.Errorf("%w: entry %d is empty", ErrInvalidSnapshot, i)
+		}
+		entries = append(entries, &entry)
+	}
+	if reader.Len() != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidSnapshot, reader.Len())
+	}
+
+	return entries, nil
+}
+
+// SnapshotToFile 将快照原子地写入文件：先写入同目录的临时文件并刷盘，再重命名覆盖
+// 启用预写日志时先切换到新段，快照写入成功后删除之前的段；并发调用依次执行
+func (ms *MemoryStorage) SnapshotToFile(path string) error {
+	ms.snapshotMu.Lock()
+	defer ms.snapshotMu.Unlock()
+
+	var segment uint64
+	if ms.wal != nil {
+		var err error
+		if segment, err = ms.wal.rotate(); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create snapshot file failed: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := ms.Snapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync snapshot file failed: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close snapshot file failed: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename snapshot file failed: %w", err)
+	}
+
+	// 刷新目录项，保证重命名在掉电后仍然有效
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	if ms.wal != nil {
+		return ms.wal.removeBefore(segment)
+	}
+	return nil
+}
+
+// RestoreFromFile 从快照文件恢复，文件不存在时不做任何操作
+func (ms *MemoryStorage) RestoreFromFile(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open snapshot file failed: %w", err)
+	}
+	defer file.Close()
+
+	return ms.Restore(file)
+}
+
+// startSnapshot 按间隔将快照写入文件
+func (ms *MemoryStorage) startSnapshot(path string, interval time.Duration) {
+	defer ms.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ms.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := ms.SnapshotToFile(path); err != nil {
+			ms.config.Logger.WithError(err).WithField("path", path).Error("memory snapshot failed")
+		}
+	}
+}
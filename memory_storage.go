@@ -2,111 +2,1019 @@ package txndedup
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// defaultMemoryShards 内存存储默认分片数
+	defaultMemoryShards = 64
+	// defaultExpiryBucket 过期桶的默认宽度
+	defaultExpiryBucket = 10 * time.Second
+	// memoryCleanupBatch 清理时每次持有分片锁处理的指纹数，避免长时间阻塞写入
+	memoryCleanupBatch = 1024
+	// memoryEvictionSamples 淘汰时从分片中随机取样的指纹数
+	memoryEvictionSamples = 5
+	// memoryEntryOverhead 每条记录在指纹下的估算固定开销（环形缓冲区槽位、过期桶与索引条目）
+	memoryEntryOverhead = 64
+	// memoryRecordOverhead 记录结构体本身的估算固定开销，不含变长字段
+	memoryRecordOverhead = 320
+	// memoryExtraEntrySize 扩展字段每个值的估算大小
+	memoryExtraEntrySize = 32
+)
+
+// MemoryEvictionPolicy 内存存储超出容量上限时的处理策略
+type MemoryEvictionPolicy string
+
+const (
+	EvictLRU    MemoryEvictionPolicy = "lru"    // 淘汰最久未读写的指纹下最旧的记录
+	EvictOldest MemoryEvictionPolicy = "oldest" // 淘汰创建时间最早的记录
+	EvictReject MemoryEvictionPolicy = "reject" // 拒绝写入并返回 ErrStorageFull，检测请求失败而不是放行
+)
+
 // MemoryStorage 内存存储实现
+// 指纹按哈希分布到多个分片，每个分片独立加锁；每个指纹的记录保存在环形缓冲区中，
+// 并按创建时间登记到过期桶，清理时只处理已过期桶内的指纹
 type MemoryStorage struct {
-	records map[string][]*TransactionRecord
+	shards       []*memoryShard
+	indexes      []*memoryIndex // 交易ID、幂等键索引，按键的哈希分片
+	mask         uint64
+	expiryBucket int64 // 过期桶宽度（纳秒）
+	config       *Config
+
+	// 容量上限按分片均分，0表示不限制
+	shardMaxRecords int64
+	shardMaxBytes   int64
+	eviction        MemoryEvictionPolicy
+
+	evictions  atomic.Int64
+	rejections atomic.Int64
+
+	// 后台清理协程，Shutdown 时取消并等待退出
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// 快照文件，配置后关闭时写入最终快照；snapshotMu 串行化写入快照文件，
+	// 避免较早的快照覆盖较新的快照后，较新的快照已删除较早快照仍依赖的日志段
+	snapshotPath string
+	snapshotMu   sync.Mutex
+	closeOnce    sync.Once
+	closeErr     error
+
+	// 预写日志，为nil时不记录；重放期间不按容量淘汰
+	wal       *memoryWAL
+	replaying bool
+	// 配置了预写日志但重放或打开失败时的错误，非nil时拒绝全部写入
+	walErr error
+}
+
+// MemoryStats 内存存储统计
+type MemoryStats struct {
+	Fingerprints int64 `json:"fingerprints"` // 指纹数
+	Records      int64 `json:"records"`      // 记录数，多指纹记录在每个指纹下分别计数
+	Bytes        int64 `json:"bytes"`        // 估算占用的字节数
+	Evictions    int64 `json:"evictions"`    // 因超出容量上限淘汰的记录数，不含 MaxRecordsPerKey 的裁剪
+	Rejections   int64 `json:"rejections"`   // 因超出容量上限拒绝的写入数
+}
+
+// memoryShard 内存存储分片
+type memoryShard struct {
 	mu      sync.RWMutex
-	config  *Config
+	records map[string]*recordRing
+	expiry  map[int64]map[string]struct{} // 过期桶 -> 桶内写入过记录的指纹
+	count   int64                         // 分片内的记录数
+	bytes   int64                         // 分片内记录的估算字节数
+
+	// 指纹级别的互斥锁，用于串行化同一指纹上的检查与预留
+	fpLocks   map[string]*fingerprintLock
+	fpLocksMu sync.Mutex
+}
+
+// memoryIndex 索引分片
+type memoryIndex struct {
+	mu       sync.RWMutex
+	txIndex  map[string]string // transactionID -> fingerprint
+	keyIndex map[string]string // idempotencyKey -> transactionID
+}
+
+// fingerprintLock 带引用计数的指纹锁
+type fingerprintLock struct {
+	mu   sync.Mutex
+	refs int
 }
 
-// NewMemoryStorage 创建内存存储
+// NewMemoryStorage 创建内存存储；配置了预写日志但重放或打开失败时记录日志，之后的写入均返回该错误，
+// 不会在没有预写日志的情况下继续接受写入。需要在创建时处理错误请使用 OpenMemoryStorage
 func NewMemoryStorage(config *Config) *MemoryStorage {
+	storage, err := newMemoryStorage(config)
+	if err != nil {
+		config.Logger.WithError(err).Error("open memory storage failed")
+		storage.walErr = err
+	}
+	return storage
+}
+
+// OpenMemoryStorage 创建内存存储，重放或打开预写日志失败时返回错误
+func OpenMemoryStorage(config *Config) (*MemoryStorage, error) {
+	storage, err := newMemoryStorage(config)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return storage, nil
+}
+
+// newMemoryStorage 创建内存存储并启动后台协程
+// 重放或打开预写日志失败时返回错误且不启动后台协程，也不写入快照，保留已有的快照与日志
+func newMemoryStorage(config *Config) (*MemoryStorage, error) {
+	shards := defaultMemoryShards
+	expiryBucket := defaultExpiryBucket
+	memoryConfig := config.MemoryConfig
+	if memoryConfig == nil {
+		memoryConfig = &MemoryConfig{}
+	}
+	if memoryConfig.Shards > 0 {
+		shards = memoryConfig.Shards
+	}
+	if memoryConfig.ExpiryBucket > 0 {
+		expiryBucket = memoryConfig.ExpiryBucket
+	}
+
+	// 分片数向上取整为2的幂，按位与定位分片
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+
 	storage := &MemoryStorage{
-		records: make(map[string][]*TransactionRecord),
-		config:  config,
+		shards:       make([]*memoryShard, n),
+		indexes:      make([]*memoryIndex, n),
+		mask:         uint64(n - 1),
+		expiryBucket: int64(expiryBucket),
+		config:       config,
+		eviction:     memoryConfig.EvictionPolicy,
+	}
+	storage.ctx, storage.cancel = context.WithCancel(context.Background())
+	if storage.eviction == "" {
+		storage.eviction = EvictLRU
+	}
+	if memoryConfig.MaxRecords > 0 {
+		storage.shardMaxRecords = int64((memoryConfig.MaxRecords + n - 1) / n)
+	}
+	if memoryConfig.MaxBytes > 0 {
+		storage.shardMaxBytes = (memoryConfig.MaxBytes + int64(n) - 1) / int64(n)
+	}
+	for i := 0; i < n; i++ {
+		storage.shards[i] = &memoryShard{
+			records: make(map[string]*recordRing),
+			expiry:  make(map[int64]map[string]struct{}),
+			fpLocks: make(map[string]*fingerprintLock),
+		}
+		storage.indexes[i] = &memoryIndex{
+			txIndex:  make(map[string]string),
+			keyIndex: make(map[string]string),
+		}
+	}
+
+	// 从快照文件恢复重启前的记录，快照损坏时记录日志并以空存储启动
+	if memoryConfig.SnapshotPath != "" {
+		storage.snapshotPath = memoryConfig.SnapshotPath
+		if err := storage.RestoreFromFile(memoryConfig.SnapshotPath); err != nil {
+			config.Logger.WithError(err).WithField("path", memoryConfig.SnapshotPath).Error("restore memory snapshot failed")
+		}
+	}
+
+	// 重放快照之后的预写日志，再在新的段中继续记录
+	if memoryConfig.WALDir != "" {
+		if err := storage.openWAL(memoryConfig); err != nil {
+			storage.snapshotPath = ""
+			return storage, err
+		}
+	}
+
+	if memoryConfig.SnapshotPath != "" && memoryConfig.SnapshotInterval > 0 {
+		storage.wg.Add(1)
+		go storage.startSnapshot(memoryConfig.SnapshotPath, memoryConfig.SnapshotInterval)
 	}
 
 	// 启动清理协程
+	storage.wg.Add(1)
 	go storage.startCleanup()
 
-	return storage
+	return storage, nil
+}
+
+// openWAL 重放并打开预写日志，interval 策略下启动刷盘协程
+func (ms *MemoryStorage) openWAL(memoryConfig *MemoryConfig) error {
+	ms.replaying = true
+	err := ms.replayWAL(memoryConfig.WALDir)
+	ms.replaying = false
+	if err != nil {
+		return fmt.Errorf("replay wal failed: %w", err)
+	}
+
+	wal, err := openMemoryWAL(memoryConfig)
+	if err != nil {
+		return err
+	}
+	ms.wal = wal
+
+	if wal.policy == FsyncInterval {
+		interval := memoryConfig.WALFsyncInterval
+		if interval <= 0 {
+			interval = defaultFsyncInterval
+		}
+		ms.wg.Add(1)
+		go ms.startWALSync(interval)
+	}
+	return nil
 }
 
 // Store 存储交易记录
+// 启用预写日志时在分片锁内追加日志并写入内存，释放分片锁后等待刷盘；刷盘失败时返回错误，记录已在内存中生效
 func (ms *MemoryStorage) Store(ctx context.Context, fingerprint string, record *TransactionRecord) error {
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
+	seq, err := ms.insert(fingerprint, record)
+	if err != nil {
+		return err
+	}
+	return ms.commit(seq)
+}
+
+// insert 在分片锁内检查容量、追加日志并写入记录，返回日志帧序号
+func (ms *MemoryStorage) insert(fingerprint string, record *TransactionRecord) (uint64, error) {
+	shard := ms.shard(fingerprint)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := ms.admit(map[*memoryShard]*memoryUsage{shard: ms.usage(shard, fingerprint, record)}); err != nil {
+		return 0, err
+	}
+	seq, err := ms.log(&walEntry{Op: walOpStore, Fingerprints: []string{fingerprint}, Record: record})
+	if err != nil {
+		return 0, err
+	}
+
+	ms.store(shard, fingerprint, record)
+	return seq, nil
+}
+
+// store 存储交易记录，超出容量上限时按淘汰策略腾出空间，调用方需持有分片写锁
+func (ms *MemoryStorage) store(shard *memoryShard, fingerprint string, record *TransactionRecord) {
+	ring, exists := shard.records[fingerprint]
+	if !exists {
+		ring = &recordRing{}
+		shard.records[fingerprint] = ring
+	}
+
+	// 限制每个指纹的记录数量，超出时覆盖最旧的记录
+	entry := ringEntry{record: record, size: recordSize(fingerprint, record)}
+	if evicted, ok := ring.push(entry, ms.config.MaxRecordsPerKey); ok {
+		shard.release(evicted)
+		ms.removeIndex(fingerprint, evicted.record)
+	}
+	shard.count++
+	shard.bytes += entry.size
+	ring.touch()
+
+	// 多指纹记录共享同一对象，索引只指向主指纹
+	if record.Fingerprint == "" || record.Fingerprint == fingerprint {
+		index := ms.index(record.TransactionID)
+		index.mu.Lock()
+		index.txIndex[record.TransactionID] = fingerprint
+		index.mu.Unlock()
+
+		if record.IdempotencyKey != "" {
+			index = ms.index(record.IdempotencyKey)
+			index.mu.Lock()
+			index.keyIndex[record.IdempotencyKey] = record.TransactionID
+			index.mu.Unlock()
+		}
+	}
 
-	if _, exists := ms.records[fingerprint]; !exists {
-		ms.records[fingerprint] = make([]*TransactionRecord, 0)
+	bucket := record.CreatedAt.UnixNano() / ms.expiryBucket
+	fingerprints, exists := shard.expiry[bucket]
+	if !exists {
+		fingerprints = make(map[string]struct{})
+		shard.expiry[bucket] = fingerprints
 	}
+	fingerprints[fingerprint] = struct{}{}
 
-	ms.records[fingerprint] = append(ms.records[fingerprint], record)
+	ms.evict(shard, record)
+}
 
-	// 限制每个指纹的记录数量
-	if len(ms.records[fingerprint]) > ms.config.MaxRecordsPerKey {
-		// 保留最新的记录
-		ms.records[fingerprint] = ms.records[fingerprint][1:]
+// memoryUsage 一次写入在分片上新增的记录数与字节数
+type memoryUsage struct {
+	records int64
+	bytes   int64
+}
+
+// usage 估算记录写入指纹后分片新增的用量，指纹记录数已达上限时覆盖最旧的记录，记录数不变
+func (ms *MemoryStorage) usage(shard *memoryShard, fingerprint string, record *TransactionRecord) *memoryUsage {
+	usage := &memoryUsage{records: 1, bytes: recordSize(fingerprint, record)}
+	if ring, exists := shard.records[fingerprint]; exists && ring.size >= ms.config.MaxRecordsPerKey {
+		usage.records = 0
+		usage.bytes -= ring.at(0).size
 	}
+	return usage
+}
 
+// admit reject 策略下检查写入后各分片是否超出容量上限，调用方需持有分片写锁
+func (ms *MemoryStorage) admit(usages map[*memoryShard]*memoryUsage) error {
+	if ms.eviction != EvictReject {
+		return nil
+	}
+	for shard, usage := range usages {
+		if ms.exceeds(shard.count+usage.records, shard.bytes+usage.bytes) {
+			ms.rejections.Add(1)
+			return ErrStorageFull
+		}
+	}
 	return nil
 }
 
+// exceeds 判断分片用量是否超出容量上限
+func (ms *MemoryStorage) exceeds(records, bytes int64) bool {
+	return (ms.shardMaxRecords > 0 && records > ms.shardMaxRecords) ||
+		(ms.shardMaxBytes > 0 && bytes > ms.shardMaxBytes)
+}
+
+// evict 分片超出容量上限时按淘汰策略删除记录，刚写入的记录不会被淘汰，调用方需持有分片写锁
+func (ms *MemoryStorage) evict(shard *memoryShard, written *TransactionRecord) {
+	for !ms.replaying && ms.exceeds(shard.count, shard.bytes) {
+		// 与 Redis 相同的近似算法：随机取样若干指纹，淘汰其中最久未访问或最旧的记录
+		var (
+			victim      string
+			victimRing  *recordRing
+			victimScore int64
+			sampled     int
+		)
+		for fingerprint, ring := range shard.records {
+			if sampled == memoryEvictionSamples {
+				break
+			}
+			sampled++
+
+			oldest := ring.at(0).record
+			if oldest == written {
+				continue
+			}
+			score := oldest.CreatedAt.UnixNano()
+			if ms.eviction == EvictLRU {
+				score = ring.lastAccess.Load()
+			}
+			if victimRing == nil || score < victimScore {
+				victim, victimRing, victimScore = fingerprint, ring, score
+			}
+		}
+		if victimRing == nil {
+			return
+		}
+
+		// 淘汰不影响正确性，日志写入失败时只记录错误，重放时多出的记录由后续淘汰或清理删除
+		entry := victimRing.pop()
+		if _, err := ms.log(&walEntry{Op: walOpEvict, Fingerprints: []string{victim}, TransactionID: entry.record.TransactionID}); err != nil {
+			ms.config.Logger.WithError(err).Error("log eviction failed")
+		}
+		shard.release(entry)
+		ms.removeIndex(victim, entry.record)
+		if victimRing.size == 0 {
+			delete(shard.records, victim)
+		}
+		ms.evictions.Add(1)
+	}
+}
+
 // GetSimilar 获取相似交易
 func (ms *MemoryStorage) GetSimilar(ctx context.Context, fingerprint string, timeWindow time.Duration) ([]*TransactionRecord, error) {
-	ms.mu.RLock()
-	defer ms.mu.RUnlock()
+	shard := ms.shard(fingerprint)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
 
-	records, exists := ms.records[fingerprint]
+	ring, exists := shard.records[fingerprint]
 	if !exists {
 		return nil, nil
 	}
 
+	ring.touch()
+
 	cutoffTime := time.Now().Add(-timeWindow)
 	var similarTx []*TransactionRecord
 
-	for _, record := range records {
-		if record.CreatedAt.After(cutoffTime) {
-			similarTx = append(similarTx, record)
+	// 返回副本，调用方在分片锁外读取时不与更新竞争
+	for i := 0; i < ring.size; i++ {
+		if record := ring.at(i).record; record.CreatedAt.After(cutoffTime) {
+			copied := *record
+			similarTx = append(similarTx, &copied)
 		}
 	}
 
 	return similarTx, nil
 }
 
-// Cleanup 清理过期记录
-func (ms *MemoryStorage) Cleanup(ctx context.Context, timeWindow time.Duration) error {
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
+// Reserve 原子地检查并预留
+func (ms *MemoryStorage) Reserve(ctx context.Context, fingerprints []string, timeWindow time.Duration, decide ReserveFunc) error {
+	// 按固定顺序加锁，避免多指纹请求间死锁
+	sorted := append([]string(nil), fingerprints...)
+	sort.Strings(sorted)
+	for i, fingerprint := range sorted {
+		if i > 0 && fingerprint == sorted[i-1] {
+			continue
+		}
+		unlock := ms.lockFingerprint(fingerprint)
+		defer unlock()
+	}
 
-	cutoffTime := time.Now().Add(-timeWindow)
+	lists := make([][]*TransactionRecord, 0, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		similarTx, err := ms.GetSimilar(ctx, fingerprint, timeWindow)
+		if err != nil {
+			return err
+		}
+		lists = append(lists, similarTx)
+	}
+
+	record, err := decide(mergeRecords(lists...))
+	if err != nil || record == nil {
+		return err
+	}
+
+	seq, err := ms.reserve(fingerprints, record)
+	if err != nil {
+		return err
+	}
+	return ms.commit(seq)
+}
+
+// reserve 在全部分片锁内检查容量、占用幂等键、追加日志并写入记录，返回日志帧序号
+func (ms *MemoryStorage) reserve(fingerprints []string, record *TransactionRecord) (uint64, error) {
+	unlock := ms.lockShards(fingerprints)
+	defer unlock()
+
+	usages := make(map[*memoryShard]*memoryUsage)
+	for _, fingerprint := range fingerprints {
+		shard := ms.shard(fingerprint)
+		usage := ms.usage(shard, fingerprint, record)
+		if total, exists := usages[shard]; exists {
+			total.records += usage.records
+			total.bytes += usage.bytes
+		} else {
+			usages[shard] = usage
+		}
+	}
+	if err := ms.admit(usages); err != nil {
+		return 0, err
+	}
+
+	// 幂等键可能已被其他分片上的请求占用，检查与占用需在同一把索引锁内完成
+	if record.IdempotencyKey != "" {
+		index := ms.index(record.IdempotencyKey)
+		index.mu.Lock()
+		_, exists := index.keyIndex[record.IdempotencyKey]
+		if !exists {
+			index.keyIndex[record.IdempotencyKey] = record.TransactionID
+		}
+		index.mu.Unlock()
+		if exists {
+			return 0, ErrIdempotencyKeyExists
+		}
+	}
+
+	seq, err := ms.log(&walEntry{Op: walOpStore, Fingerprints: fingerprints, Record: record})
+	if err != nil {
+		if record.IdempotencyKey != "" {
+			ms.removeIndex("", record)
+		}
+		return 0, err
+	}
+
+	for _, fingerprint := range fingerprints {
+		ms.store(ms.shard(fingerprint), fingerprint, record)
+	}
+	return seq, nil
+}
+
+// Get 按交易ID获取记录
+func (ms *MemoryStorage) Get(ctx context.Context, transactionID string) (*TransactionRecord, error) {
+	fingerprint, exists := ms.lookupTransaction(transactionID)
+	if !exists {
+		return nil, ErrTransactionNotFound
+	}
+
+	shard := ms.shard(fingerprint)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	entry, err := shard.find(fingerprint, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	record := *entry.record
+	return &record, nil
+}
+
+// GetByIdempotencyKey 按幂等键获取记录
+func (ms *MemoryStorage) GetByIdempotencyKey(ctx context.Context, idempotencyKey string) (*TransactionRecord, error) {
+	index := ms.index(idempotencyKey)
+	index.mu.RLock()
+	transactionID, exists := index.keyIndex[idempotencyKey]
+	index.mu.RUnlock()
+	if !exists {
+		return nil, ErrTransactionNotFound
+	}
+
+	return ms.Get(ctx, transactionID)
+}
+
+// Update 按交易ID更新记录，释放分片锁后等待日志刷盘
+func (ms *MemoryStorage) Update(ctx context.Context, transactionID string, update RecordUpdateFunc) (*TransactionRecord, error) {
+	record, seq, err := ms.update(transactionID, update)
+	if err != nil {
+		return nil, err
+	}
+	if err := ms.commit(seq); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// update 在记录所在的全部分片锁内修改记录并追加日志，返回更新后记录的副本与日志帧序号
+func (ms *MemoryStorage) update(transactionID string, update RecordUpdateFunc) (*TransactionRecord, uint64, error) {
+	fingerprint, exists := ms.lookupTransaction(transactionID)
+	if !exists {
+		return nil, 0, ErrTransactionNotFound
+	}
+
+	shard := ms.shard(fingerprint)
+	shard.mu.RLock()
+	entry, err := shard.find(fingerprint, transactionID)
+	shard.mu.RUnlock()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// 多指纹记录在各分片间共享，需锁住全部所在分片后再修改
+	unlock := ms.lockShards(append([]string{fingerprint}, entry.record.Fingerprints...))
+	defer unlock()
 
-	for fingerprint, records := range ms.records {
-		var validRecords []*TransactionRecord
+	// 加锁前记录可能已被清理或裁剪
+	entry, err = shard.find(fingerprint, transactionID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// 写时复制：在副本上修改，写入日志后替换各指纹下的记录指针，已返回的记录不再被修改
+	updated := *entry.record
+	update(&updated)
+	updated.UpdatedAt = time.Now()
+	seq, err := ms.log(&walEntry{Op: walOpUpdate, Record: &updated})
+	if err != nil {
+		return nil, 0, err
+	}
+	ms.replace(append([]string{fingerprint}, entry.record.Fingerprints...), entry.record, &updated)
+
+	record := updated
+	return &record, seq, nil
+}
 
-		for _, record := range records {
-			if record.CreatedAt.After(cutoffTime) {
-				validRecords = append(validRecords, record)
+// replace 将各指纹下的旧记录替换为新记录并更新用量，调用方需持有全部所在分片的写锁
+func (ms *MemoryStorage) replace(fingerprints []string, old, updated *TransactionRecord) {
+	for _, fingerprint := range fingerprints {
+		shard := ms.shard(fingerprint)
+		ring, exists := shard.records[fingerprint]
+		if !exists {
+			continue
+		}
+		for i := 0; i < ring.size; i++ {
+			entry := ring.at(i)
+			if entry.record != old {
+				continue
 			}
+			// 保存响应等修改会改变记录大小
+			size := recordSize(fingerprint, updated)
+			shard.bytes += size - entry.size
+			entry.record, entry.size = updated, size
 		}
+	}
+}
 
-		if len(validRecords) == 0 {
-			delete(ms.records, fingerprint)
-		} else {
-			ms.records[fingerprint] = validRecords
+// Cleanup 清理过期记录，逐个分片处理已过期的桶，每次持锁最多处理 memoryCleanupBatch 个指纹
+// 没有已过期的桶时直接返回，不写入日志
+func (ms *MemoryStorage) Cleanup(ctx context.Context, timeWindow time.Duration) error {
+	cutoffTime := time.Now().Add(-timeWindow)
+
+	due := false
+	for _, shard := range ms.shards {
+		if len(ms.dueBuckets(shard, cutoffTime)) > 0 {
+			due = true
+			break
+		}
+	}
+	if !due {
+		return nil
+	}
+
+	seq, err := ms.log(&walEntry{Op: walOpCleanup, Cutoff: cutoffTime})
+	if err != nil {
+		return err
+	}
+	if err := ms.commit(seq); err != nil {
+		return err
+	}
+	return ms.cleanupBefore(ctx, cutoffTime)
+}
+
+// cleanupBefore 清理创建时间不晚于截止时间的记录
+func (ms *MemoryStorage) cleanupBefore(ctx context.Context, cutoffTime time.Time) error {
+	for _, shard := range ms.shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		for _, bucket := range ms.dueBuckets(shard, cutoffTime) {
+			for !ms.cleanupBucket(shard, bucket, cutoffTime) {
+			}
 		}
 	}
 
 	return nil
 }
 
+// dueBuckets 返回分片中已过期的桶，截止时间所在的桶仍可能包含有效记录，留到下次清理
+func (ms *MemoryStorage) dueBuckets(shard *memoryShard, cutoffTime time.Time) []int64 {
+	lastBucket := cutoffTime.UnixNano() / ms.expiryBucket
+
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	var due []int64
+	for bucket := range shard.expiry {
+		if bucket < lastBucket {
+			due = append(due, bucket)
+		}
+	}
+	return due
+}
+
+// cleanupBucket 清理过期桶内的一批指纹，桶处理完毕时返回true
+func (ms *MemoryStorage) cleanupBucket(shard *memoryShard, bucket int64, cutoffTime time.Time) bool {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	fingerprints := shard.expiry[bucket]
+	processed := 0
+	for fingerprint := range fingerprints {
+		if processed == memoryCleanupBatch {
+			return false
+		}
+		processed++
+		delete(fingerprints, fingerprint)
+
+		ms.remove(shard, fingerprint, func(record *TransactionRecord) bool {
+			return !record.CreatedAt.After(cutoffTime)
+		})
+	}
+
+	delete(shard.expiry, bucket)
+	return true
+}
+
+// Stats 返回存储统计
+func (ms *MemoryStorage) Stats() MemoryStats {
+	stats := MemoryStats{
+		Evictions:  ms.evictions.Load(),
+		Rejections: ms.rejections.Load(),
+	}
+	for _, shard := range ms.shards {
+		shard.mu.RLock()
+		stats.Fingerprints += int64(len(shard.records))
+		stats.Records += shard.count
+		stats.Bytes += shard.bytes
+		shard.mu.RUnlock()
+	}
+	return stats
+}
+
+// Shutdown 停止后台协程并等待进行中的清理退出，配置了快照文件时写入最终快照，之后关闭预写日志，可重复调用
+func (ms *MemoryStorage) Shutdown(ctx context.Context) error {
+	ms.cancel()
+	if err := waitContext(ctx, &ms.wg); err != nil {
+		return err
+	}
+
+	ms.closeOnce.Do(func() {
+		if ms.snapshotPath != "" {
+			ms.closeErr = ms.SnapshotToFile(ms.snapshotPath)
+		}
+		if ms.wal != nil {
+			if err := ms.wal.close(); err != nil && ms.closeErr == nil {
+				ms.closeErr = err
+			}
+		}
+	})
+	return ms.closeErr
+}
+
+// log 追加预写日志并返回帧序号，未启用时不做任何操作；预写日志打开失败时返回该错误
+func (ms *MemoryStorage) log(entry *walEntry) (uint64, error) {
+	if ms.walErr != nil {
+		return 0, ms.walErr
+	}
+	if ms.wal == nil {
+		return 0, nil
+	}
+	return ms.wal.append(entry)
+}
+
+// commit 等待日志刷盘直到序号 seq，调用方不可持有分片锁，避免同一分片的写入排队等待磁盘
+func (ms *MemoryStorage) commit(seq uint64) error {
+	if ms.wal == nil {
+		return nil
+	}
+	return ms.wal.commit(seq)
+}
+
+// remove 删除指纹下满足条件的记录，调用方需持有分片写锁
+func (ms *MemoryStorage) remove(shard *memoryShard, fingerprint string, match func(record *TransactionRecord) bool) {
+	ring, exists := shard.records[fingerprint]
+	if !exists {
+		return
+	}
+	for _, entry := range ring.removeIf(match) {
+		shard.release(entry)
+		ms.removeIndex(fingerprint, entry.record)
+	}
+	if ring.size == 0 {
+		delete(shard.records, fingerprint)
+	}
+}
+
 // Close 关闭存储
 func (ms *MemoryStorage) Close() error {
-	return nil
+	return ms.Shutdown(context.Background())
+}
+
+// shard 返回指纹所在的分片
+func (ms *MemoryStorage) shard(fingerprint string) *memoryShard {
+	return ms.shards[ms.shardIndex(fingerprint)]
+}
+
+// shardIndex 返回指纹所在分片的下标
+func (ms *MemoryStorage) shardIndex(fingerprint string) int {
+	return int(fnv64a(fingerprint) & ms.mask)
+}
+
+// index 返回交易ID或幂等键所在的索引分片
+func (ms *MemoryStorage) index(key string) *memoryIndex {
+	return ms.indexes[fnv64a(key)&ms.mask]
+}
+
+// lookupTransaction 查找交易ID对应的主指纹
+func (ms *MemoryStorage) lookupTransaction(transactionID string) (string, bool) {
+	index := ms.index(transactionID)
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	fingerprint, exists := index.txIndex[transactionID]
+	return fingerprint, exists
+}
+
+// lockShards 按分片下标顺序对指纹所在的全部分片加写锁，返回解锁函数
+// 持有分片锁时可以获取索引锁，反之不可
+func (ms *MemoryStorage) lockShards(fingerprints []string) func() {
+	indices := make([]int, 0, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		indices = append(indices, ms.shardIndex(fingerprint))
+	}
+	sort.Ints(indices)
+
+	locked := make([]*memoryShard, 0, len(indices))
+	for i, idx := range indices {
+		if i > 0 && idx == indices[i-1] {
+			continue
+		}
+		shard := ms.shards[idx]
+		shard.mu.Lock()
+		locked = append(locked, shard)
+	}
+
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			locked[i].mu.Unlock()
+		}
+	}
 }
 
-// startCleanup 启动清理协程
+// lockFingerprint 获取指纹锁，返回解锁函数
+func (ms *MemoryStorage) lockFingerprint(fingerprint string) func() {
+	shard := ms.shard(fingerprint)
+
+	shard.fpLocksMu.Lock()
+	lock, exists := shard.fpLocks[fingerprint]
+	if !exists {
+		lock = &fingerprintLock{}
+		shard.fpLocks[fingerprint] = lock
+	}
+	lock.refs++
+	shard.fpLocksMu.Unlock()
+
+	lock.mu.Lock()
+
+	return func() {
+		lock.mu.Unlock()
+
+		shard.fpLocksMu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(shard.fpLocks, fingerprint)
+		}
+		shard.fpLocksMu.Unlock()
+	}
+}
+
+// removeIndex 删除记录的交易ID索引，调用方需持有记录所在分片的写锁
+func (ms *MemoryStorage) removeIndex(fingerprint string, record *TransactionRecord) {
+	// 同一交易ID可能被后续记录覆盖，只删除仍指向该指纹的索引
+	index := ms.index(record.TransactionID)
+	index.mu.Lock()
+	if indexed, exists := index.txIndex[record.TransactionID]; exists && indexed == fingerprint {
+		delete(index.txIndex, record.TransactionID)
+	}
+	index.mu.Unlock()
+
+	if record.IdempotencyKey != "" {
+		index = ms.index(record.IdempotencyKey)
+		index.mu.Lock()
+		if index.keyIndex[record.IdempotencyKey] == record.TransactionID {
+			delete(index.keyIndex, record.IdempotencyKey)
+		}
+		index.mu.Unlock()
+	}
+}
+
+// startCleanup 启动清理协程，关闭时进行中的清理在处理完当前分片后退出
 func (ms *MemoryStorage) startCleanup() {
+	defer ms.wg.Done()
+
 	ticker := time.NewTicker(ms.config.CleanupInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		if err := ms.Cleanup(context.Background(), ms.config.TimeWindow); err != nil {
+	for {
+		select {
+		case <-ms.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := ms.Cleanup(ms.ctx, ms.config.Retention()); err != nil && ms.ctx.Err() == nil {
 			ms.config.Logger.Errorf("cleanup failed: %v", err)
 		}
 	}
 }
+
+// find 在指纹的记录中查找交易，调用方需持有分片锁
+func (s *memoryShard) find(fingerprint, transactionID string) (*ringEntry, error) {
+	ring, exists := s.records[fingerprint]
+	if !exists {
+		return nil, ErrTransactionNotFound
+	}
+
+	for i := 0; i < ring.size; i++ {
+		if entry := ring.at(i); entry.record.TransactionID == transactionID {
+			return entry, nil
+		}
+	}
+
+	return nil, ErrTransactionNotFound
+}
+
+// release 扣减被删除记录的用量，调用方需持有分片写锁
+func (s *memoryShard) release(entry ringEntry) {
+	s.count--
+	s.bytes -= entry.size
+}
+
+// recordRing 单个指纹的记录环形缓冲区，按写入顺序保存，容量按需增长至 MaxRecordsPerKey
+type recordRing struct {
+	buf  []ringEntry
+	head int
+	size int
+
+	lastAccess atomic.Int64 // 最近一次读写的时间（纳秒），读取时只持有分片读锁
+}
+
+// ringEntry 环形缓冲区中的记录及其估算大小
+type ringEntry struct {
+	record *TransactionRecord
+	size   int64
+}
+
+// push 追加记录，已达上限时覆盖并返回最旧的记录
+func (r *recordRing) push(entry ringEntry, limit int) (ringEntry, bool) {
+	if r.size == len(r.buf) && len(r.buf) < limit {
+		r.resize(min(max(2*len(r.buf), 4), limit))
+	}
+
+	if r.size == len(r.buf) {
+		evicted := r.buf[r.head]
+		r.buf[r.head] = entry
+		r.head = (r.head + 1) % len(r.buf)
+		return evicted, true
+	}
+
+	r.buf[(r.head+r.size)%len(r.buf)] = entry
+	r.size++
+	return ringEntry{}, false
+}
+
+// pop 删除并返回最旧的记录
+func (r *recordRing) pop() ringEntry {
+	entry := r.buf[r.head]
+	r.buf[r.head] = ringEntry{}
+	r.head = (r.head + 1) % len(r.buf)
+	r.size--
+	return entry
+}
+
+// at 返回第i条记录（0为最旧）
+func (r *recordRing) at(i int) *ringEntry {
+	return &r.buf[(r.head+i)%len(r.buf)]
+}
+
+// touch 更新最近访问时间
+func (r *recordRing) touch() {
+	r.lastAccess.Store(time.Now().UnixNano())
+}
+
+// removeIf 删除满足条件的记录并返回，记录数明显少于容量时收缩缓冲区
+func (r *recordRing) removeIf(match func(record *TransactionRecord) bool) []ringEntry {
+	var removed []ringEntry
+	kept := 0
+	for i := 0; i < r.size; i++ {
+		entry := *r.at(i)
+		if match(entry.record) {
+			removed = append(removed, entry)
+		} else {
+			*r.at(kept) = entry
+			kept++
+		}
+	}
+	// 释放被删除记录的引用
+	for i := kept; i < r.size; i++ {
+		*r.at(i) = ringEntry{}
+	}
+	r.size = kept
+
+	if r.size > 0 && r.size <= len(r.buf)/4 {
+		r.resize(len(r.buf) / 2)
+	}
+	return removed
+}
+
+// resize 按写入顺序将记录复制到新的缓冲区
+func (r *recordRing) resize(capacity int) {
+	buf := make([]ringEntry, capacity)
+	for i := 0; i < r.size; i++ {
+		buf[i] = *r.at(i)
+	}
+	r.buf = buf
+	r.head = 0
+}
+
+// recordSize 估算记录在指纹下占用的字节数：主指纹下计入记录本身，其他指纹下只计入引用
+func recordSize(fingerprint string, record *TransactionRecord) int64 {
+	size := int64(memoryEntryOverhead + len(fingerprint))
+	if record.Fingerprint != "" && record.Fingerprint != fingerprint {
+		return size
+	}
+
+	size += memoryRecordOverhead
+	for _, field := range []string{
+		record.TransactionID, record.Fingerprint, record.FromAccount, record.ToAccount,
+		record.Currency, record.BusinessType, record.Channel, record.UserIP, record.DeviceID,
+		record.UserAgent, record.IdempotencyKey, record.PayloadHash,
+	} {
+		size += int64(len(field))
+	}
+	for _, fp := range record.Fingerprints {
+		size += int64(len(fp))
+	}
+	for key := range record.Extra {
+		size += int64(len(key) + memoryExtraEntrySize)
+	}
+	size += int64(len(record.Response))
+	return size
+}
+
+// fnv64a 计算字符串的 FNV-1a 哈希，不产生内存分配
+func fnv64a(s string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint64(s[i])
+		hash *= 1099511628211
+	}
+	return hash
+}
@@ -0,0 +1,470 @@
+package txndedup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 预写日志格式：每个段文件以 魔数 | 版本(uint16) 开头，之后为若干帧
+// 帧为 长度(uint32) | CRC32C(uint32) | JSON；进程崩溃时最后一个段末尾可能残留不完整的帧，重放时截断
+const (
+	walMagic   = "TXDW"
+	walVersion = 1
+	// walHeaderSize 段文件头长度
+	walHeaderSize = len(walMagic) + 2
+	// walSuffix 段文件扩展名，文件名为20位段号
+	walSuffix = ".wal"
+	// defaultWALSegmentSize 默认段大小，超过后切换到新段
+	defaultWALSegmentSize = 64 << 20
+	// walMaxFrameSize 单帧长度上限，超过时视为损坏
+	walMaxFrameSize = 16 << 20
+)
+
+// 日志操作类型
+const (
+	walOpStore   = "store"   // 记录写入一个或多个指纹
+	walOpUpdate  = "update"  // 记录更新后的完整内容
+	walOpCleanup = "cleanup" // 清理截止时间之前的记录
+	walOpEvict   = "evict"   // 超出容量上限时淘汰指纹下的记录
+)
+
+// walEntry 日志中的一次操作
+type walEntry struct {
+	Op            string             `json:"op"`
+	Fingerprints  []string           `json:"fingerprints,omitempty"`
+	Record        *TransactionRecord `json:"record,omitempty"`
+	TransactionID string             `json:"transaction_id,omitempty"`
+	Cutoff        time.Time          `json:"cutoff,omitempty"`
+}
+
+// memoryWAL 内存存储的预写日志
+// always 策略下采用组提交：并发写入在分片锁内追加到缓冲区，释放分片锁后等待刷盘，由先到的写入一次刷盘覆盖此前的全部写入
+type memoryWAL struct {
+	dir         string
+	policy      FsyncPolicy
+	segmentSize int64
+
+	mu      sync.Mutex // 保护以下字段
+	file    *os.File
+	writer  *bufio.Writer
+	segment uint64 // 当前段号
+	size    int64  // 当前段已写入的字节数
+	seq     uint64 // 最后追加的帧序号
+
+	syncMu sync.Mutex    // 串行化刷盘
+	synced atomic.Uint64 // 已刷盘的最大帧序号
+}
+
+// openMemoryWAL 在目录中创建新的段用于追加，已有的段保留到快照后删除
+func openMemoryWAL(config *MemoryConfig) (*memoryWAL, error) {
+	if err := os.MkdirAll(config.WALDir, 0700); err != nil {
+		return nil, fmt.Errorf("create wal dir failed: %w", err)
+	}
+
+	wal := &memoryWAL{
+		dir:         config.WALDir,
+		policy:      config.WALFsyncPolicy,
+		segmentSize: config.WALSegmentSize,
+	}
+	if wal.policy == "" {
+		wal.policy = FsyncAlways
+	}
+	if wal.segmentSize <= 0 {
+		wal.segmentSize = defaultWALSegmentSize
+	}
+
+	segments, err := walSegments(wal.dir)
+	if err != nil {
+		return nil, err
+	}
+	next := uint64(1)
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if err := wal.openSegment(next); err != nil {
+		return nil, err
+	}
+	return wal, nil
+}
+
+// append 追加一次操作并返回帧序号，不等待刷盘；always 策略下调用方需随后调用 commit
+func (w *memoryWAL) append(entry *walEntry) (uint64, error) {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return 0, fmt.Errorf("marshal wal entry failed: %w", err)
+	}
+
+	frame := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(payload, snapshotTable))
+	frame = append(frame, payload...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.writer.Write(frame); err != nil {
+		return 0, fmt.Errorf("write wal failed: %w", err)
+	}
+	w.size += int64(len(frame))
+	w.seq++
+
+	// 非 always 策略下写入操作系统缓存，进程崩溃不丢数据
+	if w.policy != FsyncAlways {
+		if err := w.writer.Flush(); err != nil {
+			return 0, fmt.Errorf("write wal failed: %w", err)
+		}
+	}
+	if w.size >= w.segmentSize {
+		if err := w.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return w.seq, nil
+}
+
+// commit always 策略下刷盘直到序号 seq，其他策略下直接返回
+func (w *memoryWAL) commit(seq uint64) error {
+	if w.policy != FsyncAlways {
+		return nil
+	}
+	return w.sync(seq)
+}
+
+// sync 刷盘直到序号 seq，已被其他写入的刷盘覆盖时直接返回
+func (w *memoryWAL) sync(seq uint64) error {
+	if w.synced.Load() >= seq {
+		return nil
+	}
+
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	if w.synced.Load() >= seq {
+		return nil
+	}
+
+	w.mu.Lock()
+	if err := w.writer.Flush(); err != nil {
+		w.mu.Unlock()
+		return fmt.Errorf("write wal failed: %w", err)
+	}
+	file, target := w.file, w.seq
+	w.mu.Unlock()
+
+	// 刷盘期间切换段时旧段已在关闭前刷盘
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return fmt.Errorf("sync wal failed: %w", err)
+	}
+	w.synced.Store(target)
+	return nil
+}
+
+// syncAll 刷盘全部已追加的帧
+func (w *memoryWAL) syncAll() error {
+	w.mu.Lock()
+	seq := w.seq
+	w.mu.Unlock()
+	return w.sync(seq)
+}
+
+// rotate 切换到新段并返回新段号，此前的帧全部位于更小的段中
+func (w *memoryWAL) rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.rotateLocked(); err != nil {
+		return 0, err
+	}
+	return w.segment, nil
+}
+
+// rotateLocked 刷盘并关闭当前段后打开新段，调用方需持有 mu
+func (w *memoryWAL) rotateLocked() error {
+	if err := w.closeSegment(); err != nil {
+		return err
+	}
+	return w.openSegment(w.segment + 1)
+}
+
+// removeBefore 删除段号小于 segment 的段，在这些段已被快照覆盖后调用
+func (w *memoryWAL) removeBefore(segment uint64) error {
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s >= segment {
+			break
+		}
+		if err := os.Remove(walSegmentPath(w.dir, s)); err != nil {
+			return fmt.Errorf("remove wal segment failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// close 刷盘并关闭当前段
+func (w *memoryWAL) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeSegment()
+}
+
+// openSegment 创建段文件并写入文件头，调用方需持有 mu
+func (w *memoryWAL) openSegment(segment uint64) error {
+	file, err := os.OpenFile(walSegmentPath(w.dir, segment), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("create wal segment failed: %w", err)
+	}
+
+	header := binary.BigEndian.AppendUint16([]byte(walMagic), walVersion)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return fmt.Errorf("write wal failed: %w", err)
+	}
+
+	w.file = file
+	w.writer = bufio.NewWriter(file)
+	w.segment = segment
+	w.size = int64(len(header))
+	return nil
+}
+
+// closeSegment 刷盘并关闭当前段，调用方需持有 mu
+func (w *memoryWAL) closeSegment() error {
+	if w.file == nil {
+		return nil
+	}
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("write wal failed: %w", err)
+	}
+	if w.policy != FsyncNever {
+		if err := w.file.Sync(); err != nil {
+			return fmt.Errorf("sync wal failed: %w", err)
+		}
+	}
+	w.synced.Store(w.seq)
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// startWALSync interval 策略下按间隔刷盘
+func (ms *MemoryStorage) startWALSync(interval time.Duration) {
+	defer ms.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ms.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := ms.wal.syncAll(); err != nil {
+			ms.config.Logger.WithError(err).Error("wal sync failed")
+		}
+	}
+}
+
+// replayWAL 按顺序重放目录中的全部段，最后一个段末尾不完整的帧被截断；
+// 重放是幂等的，快照之后仍保留的段中已包含在快照内的操作会被跳过
+func (ms *MemoryStorage) replayWAL(dir string) error {
+	segments, err := walSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	cutoffTime := time.Now().Add(-ms.config.Retention())
+	replayed := 0
+	for i, segment := range segments {
+		n, err := ms.replaySegment(walSegmentPath(dir, segment), i == len(segments)-1, cutoffTime)
+		replayed += n
+		if err != nil {
+			return err
+		}
+	}
+
+	ms.config.Logger.WithFields(map[string]interface{}{
+		"segments": len(segments),
+		"entries":  replayed,
+	}).Info("memory wal replayed")
+
+	return nil
+}
+
+// replaySegment 重放一个段，返回重放的帧数
+func (ms *MemoryStorage) replaySegment(path string, last bool, cutoffTime time.Time) (int, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("open wal segment failed: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil || string(header[:len(walMagic)]) != walMagic {
+		switch {
+		case last:
+			// 创建段时崩溃，文件头不完整：删除该段，新段沿用其段号，避免留下不在末尾的损坏段
+			file.Close()
+			if err := os.Remove(path); err != nil {
+				return 0, fmt.Errorf("remove wal segment failed: %w", err)
+			}
+			return 0, nil
+		case err == io.EOF:
+			// 空段不包含任何帧，可位于任意位置
+			return 0, nil
+		}
+		return 0, fmt.Errorf("%w: %s: bad header", ErrInvalidWAL, filepath.Base(path))
+	}
+	if version := binary.BigEndian.Uint16(header[len(walMagic):]); version != walVersion {
+		return 0, fmt.Errorf("%w: %s: unsupported version %d", ErrInvalidWAL, filepath.Base(path), version)
+	}
+
+	offset := int64(walHeaderSize)
+	replayed := 0
+	for {
+		entry, size, err := readWALFrame(reader)
+		if err == io.EOF {
+			return replayed, nil
+		}
+		if err != nil {
+			if !last {
+				return replayed, fmt.Errorf("%w: %s at offset %d: %v", ErrInvalidWAL, filepath.Base(path), offset, err)
+			}
+			// 进程崩溃时写到一半的帧，截断后继续追加到新段
+			ms.config.Logger.WithError(err).WithField("segment", filepath.Base(path)).Warn("truncating torn wal tail")
+			return replayed, file.Truncate(offset)
+		}
+
+		ms.apply(entry, cutoffTime)
+		offset += size
+		replayed++
+	}
+}
+
+// readWALFrame 读取一帧，返回帧的总长度；文件正好结束时返回 io.EOF
+func readWALFrame(reader *bufio.Reader) (*walEntry, int64, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, fmt.Errorf("truncated frame header")
+	}
+
+	size := binary.BigEndian.Uint32(head)
+	if size > walMaxFrameSize {
+		return nil, 0, fmt.Errorf("frame size %d exceeds limit", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, fmt.Errorf("truncated frame")
+	}
+	if crc32.Checksum(payload, snapshotTable) != binary.BigEndian.Uint32(head[4:]) {
+		return nil, 0, fmt.Errorf("checksum mismatch")
+	}
+
+	var entry walEntry
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		return nil, 0, err
+	}
+	return &entry, int64(len(head) + len(payload)), nil
+}
+
+// apply 重放一次操作，重放期间不写日志也不按容量淘汰，淘汰以日志为准
+func (ms *MemoryStorage) apply(entry *walEntry, cutoffTime time.Time) {
+	switch entry.Op {
+	case walOpStore:
+		if entry.Record == nil || !entry.Record.CreatedAt.After(cutoffTime) {
+			return
+		}
+		unlock := ms.lockShards(entry.Fingerprints)
+		defer unlock()
+		// 跳过已包含在快照中的指纹
+		for _, fingerprint := range entry.Fingerprints {
+			shard := ms.shard(fingerprint)
+			if _, err := shard.find(fingerprint, entry.Record.TransactionID); err != nil {
+				ms.store(shard, fingerprint, entry.Record)
+			}
+		}
+
+	case walOpUpdate:
+		if entry.Record == nil {
+			return
+		}
+		fingerprint, exists := ms.lookupTransaction(entry.Record.TransactionID)
+		if !exists {
+			return
+		}
+		fingerprints := append([]string{fingerprint}, entry.Record.Fingerprints...)
+		unlock := ms.lockShards(fingerprints)
+		defer unlock()
+		if found, err := ms.shard(fingerprint).find(fingerprint, entry.Record.TransactionID); err == nil {
+			ms.replace(fingerprints, found.record, entry.Record)
+		}
+
+	case walOpCleanup:
+		ms.cleanupBefore(ms.ctx, entry.Cutoff)
+
+	case walOpEvict:
+		if len(entry.Fingerprints) == 0 {
+			return
+		}
+		fingerprint := entry.Fingerprints[0]
+		shard := ms.shard(fingerprint)
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		ms.remove(shard, fingerprint, func(record *TransactionRecord) bool {
+			return record.TransactionID == entry.TransactionID
+		})
+	}
+}
+
+// walSegments 返回目录中的段号，升序排列
+func walSegments(dir string) ([]uint64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read wal dir failed: %w", err)
+	}
+
+	var segments []uint64
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+		segment, err := strconv.ParseUint(strings.TrimSuffix(name, walSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// walSegmentPath 返回段文件路径
+func walSegmentPath(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", segment, walSuffix))
+}
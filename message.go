@@ -0,0 +1,197 @@
+package txndedup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// 内置消息键，规则消息以规则名称为键
+const (
+	MessageKeySimilar           = "similar_transaction" // 规则未配置消息时的通用提示
+	MessageKeyIdempotentReplay  = "idempotent_replay"   // 幂等重放，原交易已完成
+	MessageKeyIdempotentPending = "idempotent_pending"  // 幂等重放，原交易处理中
+)
+
+// DefaultLocale 默认语言
+const DefaultLocale = "zh"
+
+// MessageCatalog 消息目录，按语言和消息键查找消息模板
+type MessageCatalog interface {
+	Lookup(locale, key string) (string, bool)
+}
+
+// MapCatalog 基于map的消息目录，结构为 语言 -> 消息键 -> 模板，语言使用小写标签如 "en"、"zh-tw"
+type MapCatalog map[string]map[string]string
+
+// Lookup 查找消息模板
+func (c MapCatalog) Lookup(locale, key string) (string, bool) {
+	message, exists := c[locale][key]
+	return message, exists
+}
+
+// builtinMessages 内置中文、英文、日文消息
+var builtinMessages = MapCatalog{
+	"zh": {
+		"pending_duplicate":         "检测到您有一笔相同的交易正在处理中，请勿重复提交",
+		"rapid_duplicate":           "检测到您在{{seconds .SinceLast}}秒前刚完成了一笔相同的交易，请确认是否要继续",
+		"frequent_duplicate":        "检测到您最近有多笔相似交易，请确认交易信息",
+		"recent_duplicate":          "温馨提示：您在{{minutes .SinceLast}}分钟前有类似交易记录",
+		MessageKeySimilar:           "检测到相似交易",
+		MessageKeyIdempotentReplay:  "重复请求，已返回原交易结果",
+		MessageKeyIdempotentPending: "相同请求正在处理中，请勿重复提交",
+	},
+	"en": {
+		"pending_duplicate":         "An identical transaction is already being processed. Please do not submit it again.",
+		"rapid_duplicate":           "You completed an identical transaction {{seconds .SinceLast}} seconds ago. Please confirm you want to continue.",
+		"frequent_duplicate":        "You have made several similar transactions recently. Please check the transaction details.",
+		"recent_duplicate":          "Note: you made a similar transaction {{minutes .SinceLast}} minutes ago.",
+		MessageKeySimilar:           "Similar transaction detected.",
+		MessageKeyIdempotentReplay:  "Duplicate request, returning the original transaction result.",
+		MessageKeyIdempotentPending: "An identical request is being processed. Please do not submit it again.",
+	},
+	"ja": {
+		"pending_duplicate":         "同じ取引が処理中です。重複して送信しないでください。",
+		"rapid_duplicate":           "{{seconds .SinceLast}}秒前に同じ取引が完了しています。続行してよろしいですか。",
+		"frequent_duplicate":        "最近、類似の取引が複数あります。取引内容をご確認ください。",
+		"recent_duplicate":          "ご注意：{{minutes .SinceLast}}分前に類似の取引があります。",
+		MessageKeySimilar:           "類似の取引が検出されました。",
+		MessageKeyIdempotentReplay:  "重複したリクエストです。元の取引結果を返します。",
+		MessageKeyIdempotentPending: "同じリクエストが処理中です。重複して送信しないでください。",
+	},
+}
+
+// BuiltinMessageCatalog 返回内置消息目录
+func BuiltinMessageCatalog() MessageCatalog {
+	return builtinMessages
+}
+
+// MessageData 消息模板的数据
+type MessageData struct {
+	Rule      string               // 命中的规则名称
+	Request   *TransactionRequest  // 当前请求
+	Matched   []*TransactionRecord // 通过规则过滤的相似交易，按创建时间升序
+	Similar   []*TransactionRecord // 全部相似交易
+	SinceLast time.Duration        // 距最近一笔匹配交易的时间
+}
+
+// messageFuncs 消息模板可用的函数
+var messageFuncs = template.FuncMap{
+	"seconds": func(d time.Duration) string { return fmt.Sprintf("%.0f", d.Seconds()) },
+	"minutes": func(d time.Duration) string { return fmt.Sprintf("%.0f", d.Minutes()) },
+}
+
+// parseMessageTemplate 解析消息模板
+func parseMessageTemplate(text string) (*template.Template, error) {
+	return template.New("message").Funcs(messageFuncs).Option("missingkey=zero").Parse(text)
+}
+
+type localeContextKey struct{}
+
+// WithLocale 在上下文中设置语言，请求未指定 Locale 时使用
+func WithLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, localeContextKey{}, locale)
+}
+
+// LocaleFromContext 返回上下文中的语言
+func LocaleFromContext(ctx context.Context) string {
+	locale, _ := ctx.Value(localeContextKey{}).(string)
+	return locale
+}
+
+// messageRenderer 按语言查找并渲染消息模板
+// 查找顺序：请求语言、其基础语言（如 "zh-tw" -> "zh"）、默认语言；同一语言下自定义目录优先于内置目录
+type messageRenderer struct {
+	catalogs      []MessageCatalog
+	defaultLocale string
+	templates     sync.Map // 模板文本 -> *template.Template
+}
+
+// newMessageRenderer 创建消息渲染器，catalog 为nil时仅使用内置目录
+func newMessageRenderer(catalog MessageCatalog, defaultLocale string) *messageRenderer {
+	catalogs := []MessageCatalog{builtinMessages}
+	if catalog != nil {
+		catalogs = []MessageCatalog{catalog, builtinMessages}
+	}
+	if defaultLocale == "" {
+		defaultLocale = DefaultLocale
+	}
+
+	return &messageRenderer{
+		catalogs:      catalogs,
+		defaultLocale: normalizeLocale(defaultLocale),
+	}
+}
+
+// lookup 按语言回退链查找消息模板
+func (mr *messageRenderer) lookup(locale, key string) (string, bool) {
+	for _, candidate := range mr.localeChain(locale) {
+		for _, catalog := range mr.catalogs {
+			if message, exists := catalog.Lookup(candidate, key); exists {
+				return message, true
+			}
+		}
+	}
+	return "", false
+}
+
+// localeChain 返回语言回退链
+func (mr *messageRenderer) localeChain(locale string) []string {
+	var chain []string
+	for _, tag := range []string{normalizeLocale(locale), mr.defaultLocale} {
+		for tag != "" {
+			chain = append(chain, tag)
+			i := strings.LastIndexByte(tag, '-')
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+	return chain
+}
+
+// render 渲染消息模板，渲染失败时返回错误
+func (mr *messageRenderer) render(text string, data interface{}) (string, error) {
+	var tmpl *template.Template
+	if cached, exists := mr.templates.Load(text); exists {
+		tmpl = cached.(*template.Template)
+	} else {
+		parsed, err := parseMessageTemplate(text)
+		if err != nil {
+			return "", err
+		}
+		mr.templates.Store(text, parsed)
+		tmpl = parsed
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// message 渲染指定消息键的消息，未找到或渲染失败时返回通用提示
+func (mr *messageRenderer) message(locale, key string, data interface{}) string {
+	if text, exists := mr.lookup(locale, key); exists {
+		if message, err := mr.render(text, data); err == nil {
+			return message
+		}
+	}
+
+	text, _ := mr.lookup(locale, MessageKeySimilar)
+	if message, err := mr.render(text, data); err == nil {
+		return message
+	}
+	return text
+}
+
+// normalizeLocale 将语言标签转为小写并以连字符分隔，如 "zh_CN" -> "zh-cn"
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
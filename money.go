@@ -0,0 +1,320 @@
+package txndedup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Money 精确金额，以整数 Units 和小数位数 Scale 表示 Units × 10^-Scale
+// 例如 Money{Units: 10050, Scale: 2} 表示 100.50
+type Money struct {
+	Units int64
+	Scale int
+}
+
+// currencyExponents ISO-4217 货币小数位数，未列出的货币默认为2位
+var currencyExponents = map[string]int{
+	// 0位小数
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	// 3位小数
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	// 4位小数
+	"CLF": 4, "UYW": 4,
+	// 常见数字货币
+	"BTC": 8, "USDT": 6, "USDC": 6,
+}
+
+var currencyExponentsMu sync.RWMutex
+
+// defaultCurrencyExponent 未知货币的默认小数位数
+const defaultCurrencyExponent = 2
+
+// maxPow10 int64 可表示的最大10的幂次
+const maxPow10 = 18
+
+// RegisterCurrencyExponent 注册或覆盖货币的小数位数
+func RegisterCurrencyExponent(currency string, exponent int) {
+	currencyExponentsMu.Lock()
+	defer currencyExponentsMu.Unlock()
+
+	currencyExponents[strings.ToUpper(currency)] = exponent
+}
+
+// CurrencyExponent 返回货币的小数位数
+func CurrencyExponent(currency string) int {
+	currencyExponentsMu.RLock()
+	defer currencyExponentsMu.RUnlock()
+
+	if exponent, exists := currencyExponents[strings.ToUpper(currency)]; exists {
+		return exponent
+	}
+	return defaultCurrencyExponent
+}
+
+// NewMoney 按货币的最小单位创建金额，如 NewMoney(10050, "USD") 表示 100.50 USD
+func NewMoney(minorUnits int64, currency string) Money {
+	return Money{Units: minorUnits, Scale: CurrencyExponent(currency)}
+}
+
+// MoneyFromFloat 由 float64 创建金额，按货币小数位数四舍五入，用于兼容旧接口
+// NaN、无穷大或超出 int64 范围时返回错误
+func MoneyFromFloat(amount float64, currency string) (Money, error) {
+	// 先按十进制格式化再解析，避免 amount*10^scale 的二进制舍入误差
+	money, err := ParseMoney(strconv.FormatFloat(amount, 'f', -1, 64))
+	if err != nil {
+		return Money{}, err
+	}
+	return money.Rescale(CurrencyExponent(currency))
+}
+
+// ParseMoney 解析十进制金额字符串，如 "100.50"、"-3"、"0.001"
+// 去除小数部分的尾随零后仍超出 int64 范围时返回 ErrAmountOverflow
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+
+	negative := false
+	switch s[0] {
+	case '-':
+		negative = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	if intPart == "" && fracPart == "" {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	if intPart == "" {
+		intPart = "0"
+	}
+
+	if strings.ContainsAny(intPart+fracPart, "+-") {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	units, err := strconv.ParseInt(intPart+fracPart, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		// 尾随零不影响数值，去除后重试
+		fracPart = strings.TrimRight(fracPart, "0")
+		units, err = strconv.ParseInt(intPart+fracPart, 10, 64)
+		if errors.Is(err, strconv.ErrRange) {
+			return Money{}, fmt.Errorf("%w: %q", ErrAmountOverflow, s)
+		}
+	}
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	if negative {
+		units = -units
+	}
+
+	return Money{Units: units, Scale: len(fracPart)}, nil
+}
+
+// Rescale 调整小数位数，缩小精度时四舍五入（远离零），扩大精度超出 int64 范围时返回 ErrAmountOverflow
+func (m Money) Rescale(scale int) (Money, error) {
+	switch {
+	case scale == m.Scale:
+		return m, nil
+	case scale > m.Scale:
+		factor, ok := pow10(scale - m.Scale)
+		if !ok || m.Units > math.MaxInt64/factor || m.Units < -math.MaxInt64/factor {
+			return Money{}, fmt.Errorf("%w: %s at scale %d", ErrAmountOverflow, m, scale)
+		}
+		return Money{Units: m.Units * factor, Scale: scale}, nil
+	default:
+		divisor, ok := pow10(m.Scale - scale)
+		if !ok {
+			// |Units| < 10^19，缩小超过18位时商为0，只有缩小恰好19位时可能进位为 ±1
+			var units int64
+			if m.Scale-scale == maxPow10+1 {
+				if m.Units >= 5e18 {
+					units = 1
+				} else if m.Units <= -5e18 {
+					units = -1
+				}
+			}
+			return Money{Units: units, Scale: scale}, nil
+		}
+		units := m.Units / divisor
+		remainder := m.Units % divisor
+		if remainder*2 >= divisor {
+			units++
+		} else if remainder*2 <= -divisor {
+			units--
+		}
+		return Money{Units: units, Scale: scale}, nil
+	}
+}
+
+// Normalize 去除多余的尾随零，相等的金额得到相同的表示
+func (m Money) Normalize() Money {
+	for m.Scale > 0 && m.Units%10 == 0 {
+		m.Units /= 10
+		m.Scale--
+	}
+	return m
+}
+
+// Cmp 比较金额，返回 -1、0、1
+func (m Money) Cmp(other Money) int {
+	a, b, err := alignScale(m, other)
+	if err != nil {
+		// 小数位数相差过大无法对齐时按有理数比较
+		return m.rat().Cmp(other.rat())
+	}
+	switch {
+	case a.Units < b.Units:
+		return -1
+	case a.Units > b.Units:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Sub 返回 m - other，对齐小数位数或相减超出 int64 范围时返回 ErrAmountOverflow
+func (m Money) Sub(other Money) (Money, error) {
+	a, b, err := alignScale(m, other)
+	if err != nil {
+		return Money{}, err
+	}
+	units := a.Units - b.Units
+	if (b.Units > 0 && units > a.Units) || (b.Units < 0 && units < a.Units) || units == math.MinInt64 {
+		return Money{}, fmt.Errorf("%w: %s - %s", ErrAmountOverflow, m, other)
+	}
+	return Money{Units: units, Scale: a.Scale}, nil
+}
+
+// Abs 返回绝对值，Units 为 math.MinInt64 时绝对值超出 int64 范围，返回 ErrAmountOverflow
+func (m Money) Abs() (Money, error) {
+	if m.Units == math.MinInt64 {
+		return Money{}, fmt.Errorf("%w: abs(%s)", ErrAmountOverflow, m)
+	}
+	if m.Units < 0 {
+		m.Units = -m.Units
+	}
+	return m, nil
+}
+
+// IsZero 是否为零
+func (m Money) IsZero() bool {
+	return m.Units == 0
+}
+
+// Float64 返回近似的 float64 值，仅用于展示或兼容
+func (m Money) Float64() float64 {
+	return float64(m.Units) / math.Pow10(m.Scale)
+}
+
+// rat 返回金额的精确有理数表示
+func (m Money) rat() *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(m.Scale))), nil)
+	if m.Scale < 0 {
+		return new(big.Rat).SetInt(scale.Mul(scale, big.NewInt(m.Units)))
+	}
+	return new(big.Rat).SetFrac(big.NewInt(m.Units), scale)
+}
+
+// String 按 Scale 格式化为十进制字符串
+func (m Money) String() string {
+	// 按无符号数取绝对值，math.MinInt64 取反不会溢出
+	units := uint64(m.Units)
+	sign := ""
+	if m.Units < 0 {
+		sign = "-"
+		units = -units
+	}
+
+	digits := strconv.FormatUint(units, 10)
+	if m.Scale <= 0 {
+		return sign + digits + strings.Repeat("0", -m.Scale)
+	}
+	if len(digits) <= m.Scale {
+		digits = strings.Repeat("0", m.Scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-m.Scale] + "." + digits[len(digits)-m.Scale:]
+}
+
+// MarshalJSON 序列化为JSON数字，保留精确的十进制表示
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON 支持JSON数字和字符串，兼容旧版本以 float64 序列化的记录
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		*m = Money{}
+		return nil
+	}
+
+	var text string
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+	} else {
+		text = string(data)
+	}
+
+	// 兼容科学计数法表示的旧数据
+	if strings.ContainsAny(text, "eE") {
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return fmt.Errorf("invalid amount %q", text)
+		}
+		text = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	money, err := ParseMoney(text)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
+
+// alignScale 将两个金额调整到相同的小数位数
+func alignScale(a, b Money) (Money, Money, error) {
+	if a.Scale > b.Scale {
+		b, err := b.Rescale(a.Scale)
+		return a, b, err
+	}
+	a, err := a.Rescale(b.Scale)
+	return a, b, err
+}
+
+// pow10 返回 10^n，n 超出 [0, maxPow10] 时返回false
+func pow10(n int) (int64, bool) {
+	if n < 0 || n > maxPow10 {
+		return 0, false
+	}
+	result := int64(1)
+	for i := 0; i < n; i++ {
+		result *= 10
+	}
+	return result, true
+}
+
+// abs 返回整数的绝对值
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -2,44 +2,268 @@ package txndedup
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
 )
 
-// RedisStorage Redis存储实现
+const (
+	// defaultRecordTTL 未配置 RecordTTL 且未通过 StorageFactory 创建时记录及索引的过期时间
+	defaultRecordTTL = 30 * time.Minute
+	// legacyScoreLimit 旧版本以秒为单位的score上限，小于该值的score视为秒级时间戳
+	legacyScoreLimit = 1e11
+	// maxUpdateRetries 乐观锁冲突时的最大重试次数
+	maxUpdateRetries = 3
+	// cleanupBatchSize 每批清理的指纹数
+	cleanupBatchSize = 256
+	// defaultRedisCleanupInterval 未通过 StorageFactory 创建时后台清理的间隔
+	defaultRedisCleanupInterval = time.Minute
+)
+
+// touchFunction 将指纹在过期索引中的最后写入时间更新为较新的时间，写入较早的记录时不回退，
+// 避免清理时将仍有未过期记录的指纹移出索引；与 ZADD GT 等价，兼容 Redis 6.2 之前的版本
+const touchFunction = `
+local function touch(key, score, member)
+	local current = redis.call('ZSCORE', key, member)
+	if not current or tonumber(current) < tonumber(score) then
+		redis.call('ZADD', key, score, member)
+	end
+end
+`
+
+// storeScript 写入记录，删除早于过期时间的记录并裁剪到最大记录数，刷新过期时间，递增版本号使进行中的预留重新检查；
+// 传入过期索引key时同时更新指纹的最后写入时间
+// KEYS: 记录key, 版本key, 交易ID索引key, 幂等键索引key, 过期索引key（可选）
+// ARGV: score, 记录, 过期毫秒数, 最大记录数, 指纹, 交易ID, 是否写入交易ID索引, 是否写入幂等键索引
+var storeScript = redis.NewScript(touchFunction + `
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. (tonumber(ARGV[1]) - tonumber(ARGV[3])))
+local limit = tonumber(ARGV[4])
+if limit > 0 then
+	redis.call('ZREMRANGEBYRANK', KEYS[1], 0, -limit - 1)
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+redis.call('INCR', KEYS[2])
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+if ARGV[7] == '1' then
+	redis.call('SET', KEYS[3], ARGV[5], 'PX', ARGV[3])
+end
+if ARGV[8] == '1' then
+	redis.call('SET', KEYS[4], ARGV[6], 'PX', ARGV[3])
+end
+if KEYS[5] then
+	touch(KEYS[5], ARGV[1], ARGV[5])
+end
+return 1
+`)
+
+// reserveScript 各指纹版本号均未变化时将预留记录写入全部指纹，否则返回0由调用方重新检查；
+// 幂等键已被占用时返回-1
+// KEYS: 交易ID索引key, 幂等键索引key, 过期索引key, 之后依次为每个指纹的记录key与版本key
+// ARGV: score, 记录, 过期毫秒数, 主指纹, 交易ID, 是否占用幂等键, 最大记录数, 之后依次为每个指纹的期望版本号, 再之后依次为每个指纹
+var reserveScript = redis.NewScript(touchFunction + `
+if ARGV[6] == '1' and redis.call('EXISTS', KEYS[2]) == 1 then
+	return -1
+end
+local n = (#KEYS - 3) / 2
+for i = 1, n do
+	local version = redis.call('GET', KEYS[3 + 2 * i]) or '0'
+	if version ~= ARGV[7 + i] then
+		return 0
+	end
+end
+local limit = tonumber(ARGV[7])
+for i = 1, n do
+	redis.call('ZADD', KEYS[2 + 2 * i], ARGV[1], ARGV[2])
+	redis.call('ZREMRANGEBYSCORE', KEYS[2 + 2 * i], '-inf', '(' .. (tonumber(ARGV[1]) - tonumber(ARGV[3])))
+	if limit > 0 then
+		redis.call('ZREMRANGEBYRANK', KEYS[2 + 2 * i], 0, -limit - 1)
+	end
+	redis.call('PEXPIRE', KEYS[2 + 2 * i], ARGV[3])
+	redis.call('INCR', KEYS[3 + 2 * i])
+	redis.call('PEXPIRE', KEYS[3 + 2 * i], ARGV[3])
+	touch(KEYS[3], ARGV[1], ARGV[7 + n + i])
+end
+redis.call('SET', KEYS[1], ARGV[4], 'PX', ARGV[3])
+if ARGV[6] == '1' then
+	redis.call('SET', KEYS[2], ARGV[5], 'PX', ARGV[3])
+end
+return 1
+`)
+
+// reserveSlotScript 集群模式下在单个指纹上预留：版本号未变化时写入记录并返回1，否则返回0
+// 记录key与版本key通过哈希标签位于同一slot
+// KEYS: 记录key, 版本key
+// ARGV: score, 记录, 过期毫秒数, 最大记录数, 期望版本号
+var reserveSlotScript = redis.NewScript(`
+local version = redis.call('GET', KEYS[2]) or '0'
+if version ~= ARGV[5] then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. (tonumber(ARGV[1]) - tonumber(ARGV[3])))
+local limit = tonumber(ARGV[4])
+if limit > 0 then
+	redis.call('ZREMRANGEBYRANK', KEYS[1], 0, -limit - 1)
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+redis.call('INCR', KEYS[2])
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+return 1
+`)
+
+// touchScript 更新各指纹在过期索引中的最后写入时间，集群模式下过期索引与记录位于不同slot时单独调用
+// KEYS: 过期索引key
+// ARGV: 毫秒时间戳, 之后依次为各指纹
+var touchScript = redis.NewScript(touchFunction + `
+for i = 2, #ARGV do
+	touch(KEYS[1], ARGV[1], ARGV[i])
+end
+return 1
+`)
+
+// untrackScript 从过期索引中移除最后写入时间不晚于截止时间的指纹，跳过清理期间重新写入的指纹
+// KEYS: 过期索引key
+// ARGV: 截止毫秒时间戳, 之后依次为各指纹
+var untrackScript = redis.NewScript(`
+local cutoff = tonumber(ARGV[1])
+local removed = 0
+for i = 2, #ARGV do
+	local score = redis.call('ZSCORE', KEYS[1], ARGV[i])
+	if score and tonumber(score) <= cutoff then
+		removed = removed + redis.call('ZREM', KEYS[1], ARGV[i])
+	end
+end
+return removed
+`)
+
+// migrateScoresScript 将旧版本秒级score的成员改写为毫秒级score，返回改写的成员数
+// KEYS: 记录key
+// ARGV: 秒级score上限
+var migrateScoresScript = redis.NewScript(`
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1], 'WITHSCORES')
+for i = 1, #members, 2 do
+	redis.call('ZADD', KEYS[1], tonumber(members[i + 1]) * 1000, members[i])
+end
+return #members / 2
+`)
+
+// replaceScript 在各指纹下将旧记录替换为新记录，跳过已不包含旧记录的指纹
+// KEYS: 各指纹的记录key
+// ARGV: 旧记录, 新记录, score
+var replaceScript = redis.NewScript(`
+for i = 1, #KEYS do
+	if redis.call('ZREM', KEYS[i], ARGV[1]) == 1 then
+		redis.call('ZADD', KEYS[i], ARGV[3], ARGV[2])
+	end
+end
+return 1
+`)
+
+// RedisStorage Redis存储实现，支持单节点、Sentinel 与 Cluster 部署
 type RedisStorage struct {
-	client    *redis.Client
-	keyPrefix string
+	client           redis.UniversalClient
+	cluster          bool // 集群模式：指纹相关key使用哈希标签，脚本只访问同一slot的key
+	keyPrefix        string
+	recordTTL        time.Duration // 记录及索引的过期时间
+	maxRecordsPerKey int           // 每个指纹保留的最大记录数，0表示不限制
+	cleanupInterval  time.Duration // Start 启动的后台清理间隔
+	logger           logrus.FieldLogger
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	startOnce sync.Once
+	stopOnce  sync.Once
 }
 
 // NewRedisStorage 创建Redis存储
+// 配置 ClusterAddresses 时连接集群，配置 MasterName 时通过 Sentinel 连接主节点，否则连接 Address 单节点
 func NewRedisStorage(config *RedisConfig) (*RedisStorage, error) {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:         config.Address,
-		Password:     config.Password,
-		DB:           config.DB,
-		PoolSize:     config.PoolSize,
-		MinIdleConns: config.MinIdleConns,
-		DialTimeout:  config.DialTimeout,
-		ReadTimeout:  config.ReadTimeout,
-		WriteTimeout: config.WriteTimeout,
-		IdleTimeout:  config.IdleTimeout,
-	})
+	tlsConfig, err := newTLSConfig(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	var rdb redis.UniversalClient
+	switch {
+	case len(config.ClusterAddresses) > 0:
+		rdb = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        config.ClusterAddresses,
+			Username:     config.Username,
+			Password:     config.Password,
+			PoolSize:     config.PoolSize,
+			MinIdleConns: config.MinIdleConns,
+			DialTimeout:  config.DialTimeout,
+			ReadTimeout:  config.ReadTimeout,
+			WriteTimeout: config.WriteTimeout,
+			IdleTimeout:  config.IdleTimeout,
+			TLSConfig:    tlsConfig,
+		})
+	case config.MasterName != "":
+		rdb = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       config.MasterName,
+			SentinelAddrs:    config.SentinelAddresses,
+			SentinelPassword: config.SentinelPassword,
+			Username:         config.Username,
+			Password:         config.Password,
+			DB:               config.DB,
+			PoolSize:         config.PoolSize,
+			MinIdleConns:     config.MinIdleConns,
+			DialTimeout:      config.DialTimeout,
+			ReadTimeout:      config.ReadTimeout,
+			WriteTimeout:     config.WriteTimeout,
+			IdleTimeout:      config.IdleTimeout,
+			TLSConfig:        tlsConfig,
+		})
+	default:
+		rdb = redis.NewClient(&redis.Options{
+			Addr:         config.Address,
+			Username:     config.Username,
+			Password:     config.Password,
+			DB:           config.DB,
+			PoolSize:     config.PoolSize,
+			MinIdleConns: config.MinIdleConns,
+			DialTimeout:  config.DialTimeout,
+			ReadTimeout:  config.ReadTimeout,
+			WriteTimeout: config.WriteTimeout,
+			IdleTimeout:  config.IdleTimeout,
+			TLSConfig:    tlsConfig,
+		})
+	}
 
 	// 测试连接
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
 		return nil, fmt.Errorf("redis connection failed: %w", err)
 	}
 
+	recordTTL := config.RecordTTL
+	if recordTTL <= 0 {
+		recordTTL = defaultRecordTTL
+	}
+
 	return &RedisStorage{
-		client:    rdb,
-		keyPrefix: config.KeyPrefix,
+		client:           rdb,
+		cluster:          len(config.ClusterAddresses) > 0,
+		keyPrefix:        config.KeyPrefix,
+		recordTTL:        recordTTL,
+		maxRecordsPerKey: defaultMaxRecordsPerKey,
+		cleanupInterval:  defaultRedisCleanupInterval,
+		logger:           logrus.StandardLogger(),
+		done:             make(chan struct{}),
 	}, nil
 }
 
@@ -53,19 +277,43 @@ func (rs *RedisStorage) Store(ctx context.Context, fingerprint string, record *T
 		return fmt.Errorf("marshal record failed: %w", err)
 	}
 
-	// 使用有序集合存储，score为时间戳
-	score := float64(record.CreatedAt.Unix())
+	// 使用有序集合存储，score为毫秒时间戳
+	indexed, claimKey := "0", "0"
+	if record.Fingerprint == "" || record.Fingerprint == fingerprint {
+		// 交易ID索引，多指纹记录只索引主指纹
+		indexed = "1"
+		if record.IdempotencyKey != "" {
+			claimKey = "1"
+		}
+	}
 
-	pipe := rs.client.Pipeline()
-	pipe.ZAdd(ctx, key, &redis.Z{
-		Score:  score,
-		Member: data,
-	})
+	if rs.cluster {
+		return rs.storeCluster(ctx, fingerprint, record, data, indexed == "1")
+	}
+
+	keys := []string{key, rs.buildVersionKey(fingerprint), rs.buildIndexKey(record.TransactionID), rs.buildIdempotencyKey(record.IdempotencyKey), rs.buildExpiryIndexKey()}
+	args := []interface{}{record.CreatedAt.UnixMilli(), data, rs.recordTTL.Milliseconds(), rs.maxRecordsPerKey, fingerprint, record.TransactionID, indexed, claimKey}
+	if err := storeScript.Run(ctx, rs.client, keys, args...).Err(); err != nil {
+		return fmt.Errorf("store record failed: %w", err)
+	}
 
-	// 设置过期时间
-	pipe.Expire(ctx, key, 30*time.Minute)
+	return nil
+}
 
-	_, err = pipe.Exec(ctx)
+// storeCluster 集群模式下存储记录：脚本只写入同一slot的记录key与版本key，索引key与过期索引在同一管道中单独写入
+func (rs *RedisStorage) storeCluster(ctx context.Context, fingerprint string, record *TransactionRecord, data []byte, indexed bool) error {
+	_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		keys := []string{rs.buildKey(fingerprint), rs.buildVersionKey(fingerprint)}
+		storeScript.Eval(ctx, pipe, keys, record.CreatedAt.UnixMilli(), data, rs.recordTTL.Milliseconds(), rs.maxRecordsPerKey, fingerprint, record.TransactionID, "0", "0")
+		touchScript.Eval(ctx, pipe, []string{rs.buildExpiryIndexKey()}, record.CreatedAt.UnixMilli(), fingerprint)
+		if indexed {
+			pipe.Set(ctx, rs.buildIndexKey(record.TransactionID), fingerprint, rs.recordTTL)
+			if record.IdempotencyKey != "" {
+				pipe.Set(ctx, rs.buildIdempotencyKey(record.IdempotencyKey), record.TransactionID, rs.recordTTL)
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return fmt.Errorf("store record failed: %w", err)
 	}
@@ -80,7 +328,7 @@ func (rs *RedisStorage) GetSimilar(ctx context.Context, fingerprint string, time
 
 	// 从有序集合中获取指定时间范围内的记录
 	result, err := rs.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{
-		Min: fmt.Sprintf("%d", cutoffTime.Unix()),
+		Min: fmt.Sprintf("%d", cutoffTime.UnixMilli()),
 		Max: "+inf",
 	}).Result()
 
@@ -88,41 +336,560 @@ func (rs *RedisStorage) GetSimilar(ctx context.Context, fingerprint string, time
 		return nil, fmt.Errorf("get similar records failed: %w", err)
 	}
 
-	var records []*TransactionRecord
-	for _, data := range result {
-		var record TransactionRecord
-		if err := json.Unmarshal([]byte(data), &record); err != nil {
-			continue // 跳过无法解析的记录
+	return decodeRecords(result), nil
+}
+
+// Reserve 原子地检查并预留
+// 先读取相似交易及版本号，再由脚本在版本号未变化时写入，冲突时重新检查
+// 集群模式下各指纹位于不同slot，改为逐个指纹比较版本号并写入，任一指纹冲突时撤回已写入的记录后重新检查
+func (rs *RedisStorage) Reserve(ctx context.Context, fingerprints []string, timeWindow time.Duration, decide ReserveFunc) error {
+	for i := 0; i < maxUpdateRetries; i++ {
+		cutoffTime := time.Now().Add(-timeWindow)
+
+		versionCmds := make([]*redis.StringCmd, len(fingerprints))
+		rangeCmds := make([]*redis.StringSliceCmd, len(fingerprints))
+		cmds, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, fingerprint := range fingerprints {
+				versionCmds[i] = pipe.Get(ctx, rs.buildVersionKey(fingerprint))
+				rangeCmds[i] = pipe.ZRangeByScore(ctx, rs.buildKey(fingerprint), &redis.ZRangeBy{
+					Min: fmt.Sprintf("%d", cutoffTime.UnixMilli()),
+					Max: "+inf",
+				})
+			}
+			return nil
+		})
+		// Pipelined 只返回第一个错误，版本key不存在时的 redis.Nil 会掩盖之后的错误，需逐个检查
+		for _, cmd := range cmds {
+			if err := cmd.Err(); err != nil && err != redis.Nil {
+				return fmt.Errorf("get similar records failed: %w", err)
+			}
 		}
-		records = append(records, &record)
+		if err != nil && err != redis.Nil {
+			return fmt.Errorf("get similar records failed: %w", err)
+		}
+
+		lists := make([][]*TransactionRecord, len(fingerprints))
+		for i, cmd := range rangeCmds {
+			lists[i] = decodeRecords(cmd.Val())
+		}
+
+		record, err := decide(mergeRecords(lists...))
+		if err != nil || record == nil {
+			return err
+		}
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("marshal record failed: %w", err)
+		}
+
+		if rs.cluster {
+			reserved, err := rs.reserveCluster(ctx, fingerprints, versionCmds, record, data)
+			if err != nil || reserved {
+				return err
+			}
+			continue
+		}
+
+		claimKey := "0"
+		if record.IdempotencyKey != "" {
+			claimKey = "1"
+		}
+
+		keys := []string{rs.buildIndexKey(record.TransactionID), rs.buildIdempotencyKey(record.IdempotencyKey), rs.buildExpiryIndexKey()}
+		args := []interface{}{record.CreatedAt.UnixMilli(), data, rs.recordTTL.Milliseconds(), fingerprints[0], record.TransactionID, claimKey, rs.maxRecordsPerKey}
+		for i, fingerprint := range fingerprints {
+			keys = append(keys, rs.buildKey(fingerprint), rs.buildVersionKey(fingerprint))
+
+			version := versionCmds[i].Val()
+			if version == "" {
+				version = "0"
+			}
+			args = append(args, version)
+		}
+		for _, fingerprint := range fingerprints {
+			args = append(args, fingerprint)
+		}
+
+		reserved, err := reserveScript.Run(ctx, rs.client, keys, args...).Int()
+		if err != nil {
+			return fmt.Errorf("reserve record failed: %w", err)
+		}
+		switch reserved {
+		case 1:
+			return nil
+		case -1:
+			return ErrIdempotencyKeyExists
+		}
+	}
+
+	return ErrReservationConflict
+}
+
+// reserveCluster 集群模式下预留记录，返回false表示版本号已变化需要重新检查
+// 按指纹排序后逐个写入，存在共同指纹的并发预留在该指纹上至多一个成功，因此不会同时通过检测
+func (rs *RedisStorage) reserveCluster(ctx context.Context, fingerprints []string, versionCmds []*redis.StringCmd, record *TransactionRecord, data []byte) (bool, error) {
+	idempotencyKey := rs.buildIdempotencyKey(record.IdempotencyKey)
+	if record.IdempotencyKey != "" {
+		exists, err := rs.client.Exists(ctx, idempotencyKey).Result()
+		if err != nil {
+			return false, fmt.Errorf("check idempotency key failed: %w", err)
+		}
+		if exists > 0 {
+			return false, ErrIdempotencyKeyExists
+		}
+	}
+
+	versions := make(map[string]string, len(fingerprints))
+	for i, fingerprint := range fingerprints {
+		version := versionCmds[i].Val()
+		if version == "" {
+			version = "0"
+		}
+		versions[fingerprint] = version
+	}
+
+	ordered := append([]string(nil), fingerprints...)
+	sort.Strings(ordered)
+
+	for i, fingerprint := range ordered {
+		keys := []string{rs.buildKey(fingerprint), rs.buildVersionKey(fingerprint)}
+		reserved, err := reserveSlotScript.Run(ctx, rs.client, keys,
+			record.CreatedAt.UnixMilli(), data, rs.recordTTL.Milliseconds(), rs.maxRecordsPerKey, versions[fingerprint]).Int()
+		if err == nil && reserved == 1 {
+			continue
+		}
+
+		rs.rollback(ctx, ordered[:i], data)
+		if err != nil {
+			return false, fmt.Errorf("reserve record failed: %w", err)
+		}
+		return false, nil
+	}
+
+	// 记录写入后再占用幂等键，被并发请求抢先占用时撤回记录
+	if record.IdempotencyKey != "" {
+		claimed, err := rs.client.SetNX(ctx, idempotencyKey, record.TransactionID, rs.recordTTL).Result()
+		if err != nil || !claimed {
+			rs.rollback(ctx, ordered, data)
+			if err != nil {
+				return false, fmt.Errorf("claim idempotency key failed: %w", err)
+			}
+			return false, ErrIdempotencyKeyExists
+		}
+	}
+
+	_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, rs.buildIndexKey(record.TransactionID), fingerprints[0], rs.recordTTL)
+		args := []interface{}{record.CreatedAt.UnixMilli()}
+		for _, fingerprint := range fingerprints {
+			args = append(args, fingerprint)
+		}
+		touchScript.Eval(ctx, pipe, []string{rs.buildExpiryIndexKey()}, args...)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("store index failed: %w", err)
+	}
+
+	return true, nil
+}
+
+// rollback 从各指纹下撤回预留记录
+func (rs *RedisStorage) rollback(ctx context.Context, fingerprints []string, data []byte) {
+	for _, fingerprint := range fingerprints {
+		rs.client.ZRem(ctx, rs.buildKey(fingerprint), data)
+	}
+}
+
+// Get 按交易ID获取记录
+func (rs *RedisStorage) Get(ctx context.Context, transactionID string) (*TransactionRecord, error) {
+	fingerprint, err := rs.lookupIndex(ctx, rs.buildIndexKey(transactionID))
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := rs.client.ZRange(ctx, rs.buildKey(fingerprint), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get records failed: %w", err)
+	}
+
+	for _, record := range decodeRecords(members) {
+		if record.TransactionID == transactionID {
+			return record, nil
+		}
+	}
+
+	return nil, ErrTransactionNotFound
+}
+
+// GetByIdempotencyKey 按幂等键获取记录
+func (rs *RedisStorage) GetByIdempotencyKey(ctx context.Context, idempotencyKey string) (*TransactionRecord, error) {
+	transactionID, err := rs.lookupIndex(ctx, rs.buildIdempotencyKey(idempotencyKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return rs.Get(ctx, transactionID)
+}
+
+// Update 按交易ID更新记录
+func (rs *RedisStorage) Update(ctx context.Context, transactionID string, update RecordUpdateFunc) (*TransactionRecord, error) {
+	fingerprint, err := rs.lookupIndex(ctx, rs.buildIndexKey(transactionID))
+	if err != nil {
+		return nil, err
+	}
+
+	key := rs.buildKey(fingerprint)
+	var (
+		updated          *TransactionRecord
+		oldData, newData string
+		score            float64
+	)
+
+	// 有序集合成员为序列化后的记录，需要整体替换；使用WATCH保证并发更新安全
+	txf := func(tx *redis.Tx) error {
+		members, err := tx.ZRangeWithScores(ctx, key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			data, ok := member.Member.(string)
+			if !ok {
+				continue
+			}
+
+			var record TransactionRecord
+			if err := json.Unmarshal([]byte(data), &record); err != nil {
+				continue
+			}
+			if record.TransactionID != transactionID {
+				continue
+			}
+
+			update(&record)
+			record.UpdatedAt = time.Now()
+			replaced, err := json.Marshal(&record)
+			if err != nil {
+				return fmt.Errorf("marshal record failed: %w", err)
+			}
+
+			keys := []string{key}
+			if !rs.cluster {
+				for _, fp := range record.Fingerprints {
+					if fp != fingerprint {
+						keys = append(keys, rs.buildKey(fp))
+					}
+				}
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				replaceScript.Eval(ctx, pipe, keys, data, replaced, member.Score)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			updated = &record
+			oldData, newData, score = data, string(replaced), member.Score
+			return nil
+		}
+
+		return ErrTransactionNotFound
 	}
 
-	return records, nil
+	for i := 0; i < maxUpdateRetries; i++ {
+		err = rs.client.Watch(ctx, txf, key)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+
+	if err == ErrTransactionNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("update record failed: %w", err)
+	}
+
+	// 集群模式下其余指纹位于不同slot，主指纹替换成功后逐个替换
+	if rs.cluster {
+		for _, fp := range updated.Fingerprints {
+			if fp == fingerprint {
+				continue
+			}
+			if err := replaceScript.Run(ctx, rs.client, []string{rs.buildKey(fp)}, oldData, newData, score).Err(); err != nil {
+				return nil, fmt.Errorf("update record failed: %w", err)
+			}
+		}
+	}
+
+	return updated, nil
+}
+
+// lookupIndex 读取索引key的值，不存在时返回 ErrTransactionNotFound
+func (rs *RedisStorage) lookupIndex(ctx context.Context, indexKey string) (string, error) {
+	value, err := rs.client.Get(ctx, indexKey).Result()
+	if err == redis.Nil {
+		return "", ErrTransactionNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("get index failed: %w", err)
+	}
+	return value, nil
 }
 
 // Cleanup 清理过期记录
+// 过期索引记录各指纹的最后写入时间，只访问最后写入时间早于截止时间的指纹，每批 cleanupBatchSize 个并通过管道批量删除；
+// 仍有写入的指纹在写入时删除早于过期时间的记录
 func (rs *RedisStorage) Cleanup(ctx context.Context, timeWindow time.Duration) error {
-	// Redis会自动过期，这里可以做额外的清理
-	cutoffTime := time.Now().Add(-timeWindow)
+	cutoff := time.Now().Add(-timeWindow).UnixMilli()
+	cutoffScore := fmt.Sprintf("%d", cutoff)
+	indexKey := rs.buildExpiryIndexKey()
 
-	// 扫描所有相关的key
-	iter := rs.client.Scan(ctx, 0, rs.keyPrefix+"*", 100).Iterator()
-	for iter.Next(ctx) {
-		key := iter.Val()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-		// 删除过期的记录
-		rs.client.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprintf("%d", cutoffTime.Unix()))
+		fingerprints, err := rs.client.ZRangeByScore(ctx, indexKey, &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   cutoffScore,
+			Count: cleanupBatchSize,
+		}).Result()
+		if err != nil {
+			return fmt.Errorf("read expiry index failed: %w", err)
+		}
+		if len(fingerprints) == 0 {
+			return nil
+		}
+
+		// 只删除截止时间之前的记录，清理期间写入的新记录不受影响
+		cmds, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, fingerprint := range fingerprints {
+				pipe.ZRemRangeByScore(ctx, rs.buildKey(fingerprint), "-inf", cutoffScore)
+			}
+			return nil
+		})
+		if err != nil {
+			for i, cmd := range cmds {
+				if cmd.Err() != nil {
+					return fmt.Errorf("cleanup fingerprint %s failed: %w", fingerprints[i], cmd.Err())
+				}
+			}
+			return fmt.Errorf("cleanup failed: %w", err)
+		}
+
+		args := []interface{}{cutoff}
+		for _, fingerprint := range fingerprints {
+			args = append(args, fingerprint)
+		}
+		if err := untrackScript.Run(ctx, rs.client, []string{indexKey}, args...).Err(); err != nil {
+			return fmt.Errorf("update expiry index failed: %w", err)
+		}
+
+		if len(fingerprints) < cleanupBatchSize {
+			return nil
+		}
+	}
+}
+
+// MigrateScores 将旧版本写入的秒级score改写为毫秒级score，返回改写的记录数；同时将已有指纹补录到过期索引
+// 升级后、旧版本实例全部下线时执行一次；未迁移的记录在毫秒级查询中不可见。可重复执行
+func (rs *RedisStorage) MigrateScores(ctx context.Context) (int, error) {
+	var migrated int64
+
+	err := rs.scanKeys(ctx, rs.keyPrefix+"tx:*", func(key string) error {
+		n, err := migrateScoresScript.Run(ctx, rs.client, []string{key}, int64(legacyScoreLimit)).Int64()
+		if err != nil {
+			return fmt.Errorf("migrate scores of %s failed: %w", key, err)
+		}
+		atomic.AddInt64(&migrated, n)
+
+		// 以最新记录的score作为最后写入时间补录过期索引
+		latest, err := rs.client.ZRangeWithScores(ctx, key, -1, -1).Result()
+		if err != nil {
+			return fmt.Errorf("read latest record of %s failed: %w", key, err)
+		}
+		if len(latest) > 0 {
+			fingerprint := rs.fingerprintOf(key)
+			if err := touchScript.Run(ctx, rs.client, []string{rs.buildExpiryIndexKey()}, int64(latest[0].Score), fingerprint).Err(); err != nil {
+				return fmt.Errorf("update expiry index failed: %w", err)
+			}
+		}
+		return nil
+	})
+
+	return int(migrated), err
+}
+
+// scanKeys 遍历匹配的key，集群模式下在各主节点上并发遍历
+func (rs *RedisStorage) scanKeys(ctx context.Context, pattern string, fn func(key string) error) error {
+	scan := func(ctx context.Context, client redis.Cmdable) error {
+		iter := client.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			if err := fn(iter.Val()); err != nil {
+				return err
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return fmt.Errorf("scan keys failed: %w", err)
+		}
+		return nil
+	}
+
+	if cluster, ok := rs.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			return scan(ctx, master)
+		})
 	}
+	return scan(ctx, rs.client)
+}
+
+// Start 启动后台清理，按清理间隔清理过期索引，Shutdown、Close 或 ctx 取消后停止；重复调用无效
+func (rs *RedisStorage) Start(ctx context.Context) error {
+	rs.startOnce.Do(func() {
+		rs.wg.Add(1)
+		go rs.startCleanup(ctx)
+	})
+	return nil
+}
 
-	return iter.Err()
+// Shutdown 停止后台清理并关闭连接；ctx 先结束时连接保持打开，可再次调用
+func (rs *RedisStorage) Shutdown(ctx context.Context) error {
+	rs.stopOnce.Do(func() { close(rs.done) })
+	if err := waitContext(ctx, &rs.wg); err != nil {
+		return err
+	}
+	if err := rs.client.Close(); err != nil && err != redis.ErrClosed {
+		return err
+	}
+	return nil
 }
 
 // Close 关闭存储
 func (rs *RedisStorage) Close() error {
-	return rs.client.Close()
+	return rs.Shutdown(context.Background())
+}
+
+// startCleanup 按清理间隔清理过期记录，关闭时取消进行中的清理
+func (rs *RedisStorage) startCleanup(ctx context.Context) {
+	defer rs.wg.Done()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-rs.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(rs.cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := rs.Cleanup(ctx, rs.recordTTL); err != nil && ctx.Err() == nil {
+			rs.logger.WithError(err).Error("redis cleanup failed")
+		}
+	}
+}
+
+// hashTag 集群模式下为指纹加上哈希标签，使同一指纹的记录key与版本key位于同一slot
+func (rs *RedisStorage) hashTag(fingerprint string) string {
+	if rs.cluster {
+		return "{" + fingerprint + "}"
+	}
+	return fingerprint
 }
 
 // buildKey 构建Redis key
 func (rs *RedisStorage) buildKey(fingerprint string) string {
-	return rs.keyPrefix + "tx:" + fingerprint
+	return rs.keyPrefix + "tx:" + rs.hashTag(fingerprint)
+}
+
+// fingerprintOf 从记录key解析指纹
+func (rs *RedisStorage) fingerprintOf(key string) string {
+	fingerprint := strings.TrimPrefix(key, rs.keyPrefix+"tx:")
+	if rs.cluster {
+		fingerprint = strings.TrimSuffix(strings.TrimPrefix(fingerprint, "{"), "}")
+	}
+	return fingerprint
+}
+
+// buildIndexKey 构建交易ID索引key
+func (rs *RedisStorage) buildIndexKey(transactionID string) string {
+	return rs.keyPrefix + "txid:" + transactionID
+}
+
+// buildIdempotencyKey 构建幂等键索引key
+func (rs *RedisStorage) buildIdempotencyKey(idempotencyKey string) string {
+	return rs.keyPrefix + "idem:" + idempotencyKey
+}
+
+// buildVersionKey 构建指纹版本号key
+func (rs *RedisStorage) buildVersionKey(fingerprint string) string {
+	return rs.keyPrefix + "ver:" + rs.hashTag(fingerprint)
+}
+
+// buildExpiryIndexKey 构建过期索引key，有序集合成员为指纹，score为最后写入的毫秒时间戳
+func (rs *RedisStorage) buildExpiryIndexKey() string {
+	return rs.keyPrefix + "expiry"
+}
+
+// decodeRecords 解析序列化的记录
+func decodeRecords(members []string) []*TransactionRecord {
+	var records []*TransactionRecord
+	for _, data := range members {
+		var record TransactionRecord
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			continue // 跳过无法解析的记录
+		}
+		records = append(records, &record)
+	}
+	return records
+}
+
+// newTLSConfig 根据配置创建TLS配置，未启用时返回nil
+func newTLSConfig(config *RedisTLSConfig) (*tls.Config, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CAFile != "" {
+		ca, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read redis ca file failed: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in redis ca file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load redis client certificate failed: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
@@ -2,98 +2,389 @@ package txndedup
 
 import (
 	"fmt"
+	"math"
+	"strings"
 	"time"
 )
 
 // RiskAssessor 风险评估器
 type RiskAssessor struct {
-	rules []RiskRule
+	rules      []RiskRule
+	conditions []*Expression // 与 rules 一一对应，无条件时为nil
+	scoring    ScoringConfig
+
+	catalog       MessageCatalog
+	defaultLocale string
+	messages      *messageRenderer
+}
+
+// RiskAssessorOption 风险评估器选项
+type RiskAssessorOption func(ra *RiskAssessor)
+
+// WithScoring 设置评分配置，启用后按命中规则的权重累计评分，而非取第一条命中的规则
+func WithScoring(scoring ScoringConfig) RiskAssessorOption {
+	return func(ra *RiskAssessor) {
+		ra.scoring = scoring
+	}
+}
+
+// WithMessageCatalog 设置自定义消息目录，同一语言下优先于内置目录
+func WithMessageCatalog(catalog MessageCatalog) RiskAssessorOption {
+	return func(ra *RiskAssessor) {
+		ra.catalog = catalog
+	}
+}
+
+// WithDefaultLocale 设置默认语言，请求语言缺少对应消息时回退到该语言
+func WithDefaultLocale(locale string) RiskAssessorOption {
+	return func(ra *RiskAssessor) {
+		ra.defaultLocale = locale
+	}
+}
+
+// Assessment 风险评估结果
+type Assessment struct {
+	RiskLevel    RiskLevel
+	Action       SuggestionAction
+	Message      string
+	Score        float64            // 评分模式下的总分
+	MatchedRules []RuleContribution // 命中的规则，首条命中模式下至多一条
+	Explanation  *Explanation       // 评估过程，仅由 Explain 填充
 }
 
 // NewRiskAssessor 创建风险评估器
-func NewRiskAssessor(rules []RiskRule) *RiskAssessor {
-	return &RiskAssessor{
-		rules: rules,
+// 规则条件需预先通过 Config.Validate 校验，无法编译的条件使对应规则永不命中
+func NewRiskAssessor(rules []RiskRule, opts ...RiskAssessorOption) *RiskAssessor {
+	conditions := make([]*Expression, len(rules))
+	for i, rule := range rules {
+		if rule.Condition == "" {
+			continue
+		}
+		condition, err := CompileExpression(rule.Condition)
+		if err != nil {
+			condition = neverExpression
+		}
+		conditions[i] = condition
+	}
+
+	ra := &RiskAssessor{
+		rules:      rules,
+		conditions: conditions,
+	}
+	for _, opt := range opts {
+		opt(ra)
 	}
+	ra.messages = newMessageRenderer(ra.catalog, ra.defaultLocale)
+
+	return ra
 }
 
 // Assess 评估风险
 func (ra *RiskAssessor) Assess(request *TransactionRequest, similarTx []*TransactionRecord) (RiskLevel, SuggestionAction, string) {
-	if len(similarTx) == 0 {
-		return RiskLevelLow, ActionAllow, ""
+	assessment := ra.Evaluate(request, similarTx)
+	return assessment.RiskLevel, assessment.Action, assessment.Message
+}
+
+// Evaluate 评估风险并返回命中规则的详情
+func (ra *RiskAssessor) Evaluate(request *TransactionRequest, similarTx []*TransactionRecord) *Assessment {
+	return ra.evaluate(request, similarTx, false, request.Locale)
+}
+
+// Explain 评估风险，并在 Assessment.Explanation 中记录每条规则的评估过程
+func (ra *RiskAssessor) Explain(request *TransactionRequest, similarTx []*TransactionRecord) *Assessment {
+	return ra.evaluate(request, similarTx, true, request.Locale)
+}
+
+// evaluate 评估全部规则，提示消息使用 locale 对应的语言
+// 首条命中模式取第一条命中的规则；评分模式累计全部命中规则的权重，按阈值确定风险级别和建议操作
+func (ra *RiskAssessor) evaluate(request *TransactionRequest, similarTx []*TransactionRecord, explain bool, locale string) *Assessment {
+	assessment := &Assessment{
+		RiskLevel: RiskLevelLow,
+		Action:    ActionAllow,
+	}
+	if explain {
+		mode := ExplainModeFirstMatch
+		if ra.scoring.Enabled {
+			mode = ExplainModeScoring
+		}
+		assessment.Explanation = &Explanation{Mode: mode, Candidates: len(similarTx)}
+	}
+
+	// 首条命中模式下为第一条命中的规则，评分模式下为权重最高的命中规则，提示消息取自该规则
+	var applied *RiskRule
+	var appliedTx []*TransactionRecord
+
+	for i := range ra.rules {
+		rule := &ra.rules[i]
+		decided := !ra.scoring.Enabled && applied != nil
+		if decided && !explain {
+			break
+		}
+
+		var trace *RuleTrace
+		if explain {
+			trace = &RuleTrace{Rule: rule.Name, MaxCount: rule.MaxCount}
+		}
+
+		matchingTx, matched := ra.matchRule(*rule, ra.conditions[i], request, similarTx, trace)
+		switch {
+		case matched && decided:
+			trace.setReason("matched, but rule %q was applied first", applied.Name)
+		case matched:
+			// 首条命中模式不计分，贡献的分值保持为0
+			var score float64
+			if ra.scoring.Enabled {
+				score = rule.Weight
+				assessment.Score += score
+			}
+			assessment.MatchedRules = append(assessment.MatchedRules, RuleContribution{Name: rule.Name, Score: score})
+			if applied == nil || rule.Weight > applied.Weight {
+				applied = rule
+				appliedTx = matchingTx
+			}
+			if trace != nil {
+				trace.Applied = true
+				trace.Score = score
+			}
+		}
+
+		if trace != nil {
+			assessment.Explanation.Rules = append(assessment.Explanation.Rules, *trace)
+		}
+	}
+
+	if assessment.Explanation != nil {
+		assessment.Explanation.Score = assessment.Score
 	}
 
-	// 按规则优先级评估
-	for _, rule := range ra.rules {
-		if ra.matchRule(rule, request, similarTx) {
-			message := ra.generateMessage(rule, request, similarTx)
-			return rule.RiskLevel, rule.Action, message
+	if applied == nil {
+		return assessment
+	}
+
+	if ra.scoring.Enabled {
+		// 取满足条件的最高阈值
+		var threshold *ScoreThreshold
+		for i := range ra.scoring.Thresholds {
+			candidate := &ra.scoring.Thresholds[i]
+			if assessment.Score >= candidate.MinScore && (threshold == nil || candidate.MinScore > threshold.MinScore) {
+				threshold = candidate
+			}
 		}
+
+		if threshold != nil {
+			assessment.RiskLevel = threshold.RiskLevel
+			assessment.Action = threshold.Action
+			if assessment.Explanation != nil {
+				crossed := *threshold
+				assessment.Explanation.Threshold = &crossed
+			}
+		}
+	} else {
+		assessment.RiskLevel = applied.RiskLevel
+		assessment.Action = applied.Action
 	}
+	assessment.Message = ra.generateMessage(*applied, request, appliedTx, similarTx, locale)
+
+	return assessment
+}
+
+// 规则过滤条件名称，用于 RuleTrace.Filters
+const (
+	FilterWindow          = "window"
+	FilterStatus          = "status"
+	FilterSameIP          = "same_ip"
+	FilterSameDevice      = "same_device"
+	FilterAmountTolerance = "amount_tolerance"
+	FilterPayeeSimilarity = "payee_similarity"
+)
 
-	return RiskLevelLow, ActionAllow, ""
+// ruleFilter 规则对相似交易的过滤条件
+type ruleFilter struct {
+	name  string
+	match func(tx *TransactionRecord) bool
 }
 
-// matchRule 匹配规则
-func (ra *RiskAssessor) matchRule(rule RiskRule, request *TransactionRequest, similarTx []*TransactionRecord) bool {
+// ruleFilters 按应用顺序返回规则启用的过滤条件
+func (ra *RiskAssessor) ruleFilters(rule RiskRule, request *TransactionRequest) []ruleFilter {
 	// 过滤时间窗口内的交易
 	cutoffTime := time.Now().Add(-rule.TimeWindow)
-	var matchingTx []*TransactionRecord
+	filters := []ruleFilter{{
+		name:  FilterWindow,
+		match: func(tx *TransactionRecord) bool { return tx.CreatedAt.After(cutoffTime) },
+	}}
 
-	for _, tx := range similarTx {
-		if tx.CreatedAt.After(cutoffTime) {
-			// 检查状态
-			if len(rule.CheckStatus) > 0 {
-				statusMatch := false
+	// 检查状态
+	if len(rule.CheckStatus) > 0 {
+		filters = append(filters, ruleFilter{
+			name: FilterStatus,
+			match: func(tx *TransactionRecord) bool {
 				for _, status := range rule.CheckStatus {
 					if tx.Status == status {
-						statusMatch = true
-						break
+						return true
 					}
 				}
-				if !statusMatch {
-					continue
-				}
-			}
+				return false
+			},
+		})
+	}
 
-			// 检查IP
-			if rule.CheckSameIP && tx.UserIP != request.UserIP {
-				continue
-			}
+	// 检查IP
+	if rule.CheckSameIP {
+		filters = append(filters, ruleFilter{
+			name:  FilterSameIP,
+			match: func(tx *TransactionRecord) bool { return tx.UserIP == request.UserIP },
+		})
+	}
 
-			// 检查设备
-			if rule.CheckSameDevice && tx.DeviceID != request.DeviceID {
-				continue
-			}
+	// 检查设备
+	if rule.CheckSameDevice {
+		filters = append(filters, ruleFilter{
+			name:  FilterSameDevice,
+			match: func(tx *TransactionRecord) bool { return tx.DeviceID == request.DeviceID },
+		})
+	}
+
+	// 检查金额容差
+	if !rule.AmountTolerance.IsZero() || rule.AmountTolerancePercent > 0 {
+		filters = append(filters, ruleFilter{
+			name:  FilterAmountTolerance,
+			match: func(tx *TransactionRecord) bool { return ra.withinAmountTolerance(rule, request, tx) },
+		})
+	}
 
+	// 检查收款账户相似度
+	if rule.PayeeSimilarity > 0 {
+		filters = append(filters, ruleFilter{
+			name: FilterPayeeSimilarity,
+			match: func(tx *TransactionRecord) bool {
+				return AccountSimilarity(rule.SimilarityAlgorithm, tx.ToAccount, request.ToAccount) >= rule.PayeeSimilarity
+			},
+		})
+	}
+
+	return filters
+}
+
+// matchRule 匹配规则，返回通过规则过滤的交易及是否命中；trace 非nil时记录评估过程
+func (ra *RiskAssessor) matchRule(rule RiskRule, condition *Expression, request *TransactionRequest, similarTx []*TransactionRecord, trace *RuleTrace) ([]*TransactionRecord, bool) {
+	if len(similarTx) == 0 {
+		trace.setReason("no similar transactions")
+		return nil, false
+	}
+
+	filters := ra.ruleFilters(rule, request)
+	remaining := make([]int, len(filters))
+	var matchingTx []*TransactionRecord
+
+	for _, tx := range similarTx {
+		passed := true
+		for i, filter := range filters {
+			if !filter.match(tx) {
+				passed = false
+				break
+			}
+			remaining[i]++
+		}
+		if passed {
 			matchingTx = append(matchingTx, tx)
 		}
 	}
 
-	return len(matchingTx) > rule.MaxCount
+	if trace != nil {
+		for i, filter := range filters {
+			trace.Filters = append(trace.Filters, FilterCount{Filter: filter.name, Remaining: remaining[i]})
+		}
+		for _, tx := range matchingTx {
+			trace.MatchedTransactionIDs = append(trace.MatchedTransactionIDs, tx.TransactionID)
+		}
+	}
+
+	if len(matchingTx) <= rule.MaxCount {
+		trace.setReason("%d transactions after filters, not more than max count %d", len(matchingTx), rule.MaxCount)
+		return matchingTx, false
+	}
+
+	// 自定义条件，求值出错视为不命中
+	if condition != nil {
+		matched, err := condition.Eval(request, matchingTx)
+		if err != nil {
+			trace.setReason("condition evaluation failed: %v", err)
+			return matchingTx, false
+		}
+		if !matched {
+			trace.setReason("condition %q not satisfied", condition.source)
+			return matchingTx, false
+		}
+	}
+
+	if trace != nil {
+		trace.Matched = true
+	}
+	trace.setReason("%d transactions after filters exceed max count %d", len(matchingTx), rule.MaxCount)
+	return matchingTx, true
 }
 
-// generateMessage 生成提示消息
-func (ra *RiskAssessor) generateMessage(rule RiskRule, request *TransactionRequest, similarTx []*TransactionRecord) string {
-	switch rule.Name {
-	case "pending_duplicate":
-		return "检测到您有一笔相同的交易正在处理中，请勿重复提交"
+// setReason 记录规则命中或未命中的原因，trace 为nil时忽略
+func (t *RuleTrace) setReason(format string, args ...interface{}) {
+	if t != nil {
+		t.Reason = fmt.Sprintf(format, args...)
+	}
+}
+
+// neverExpression 无法编译的规则条件，恒为false
+var neverExpression = &Expression{source: "false", root: &literalNode{value: false}}
+
+// withinAmountTolerance 检查金额差是否在规则容差内，未配置容差时不限制
+func (ra *RiskAssessor) withinAmountTolerance(rule RiskRule, request *TransactionRequest, tx *TransactionRecord) bool {
+	if rule.AmountTolerance.IsZero() && rule.AmountTolerancePercent <= 0 {
+		return true
+	}
 
-	case "rapid_duplicate":
-		if len(similarTx) > 0 {
-			timeDiff := time.Since(similarTx[len(similarTx)-1].CreatedAt)
-			return fmt.Sprintf("检测到您在%.0f秒前刚完成了一笔相同的交易，请确认是否要继续", timeDiff.Seconds())
+	if !strings.EqualFold(tx.Currency, request.Currency) {
+		return false
+	}
+
+	diff, err := tx.Amount.Sub(request.Amount)
+	if err == nil {
+		diff, err = diff.Abs()
+	}
+	if err != nil {
+		// 金额差超出可表示范围，必然超出容差
+		return false
+	}
+
+	if tolerance, err := rule.AmountTolerance.Abs(); err == nil && !tolerance.IsZero() && diff.Cmp(tolerance) <= 0 {
+		return true
+	}
+
+	if rule.AmountTolerancePercent > 0 {
+		tolerance := math.Abs(request.Amount.Float64()) * rule.AmountTolerancePercent / 100
+		if diff.Float64() <= tolerance {
+			return true
 		}
+	}
+
+	return false
+}
 
-	case "frequent_duplicate":
-		return "检测到您最近有多笔相似交易，请确认交易信息"
+// generateMessage 生成提示消息
+// 规则配置了 Message 模板时优先使用，否则按语言从消息目录中查找以规则名称为键的消息
+func (ra *RiskAssessor) generateMessage(rule RiskRule, request *TransactionRequest, matchingTx, similarTx []*TransactionRecord, locale string) string {
+	data := &MessageData{
+		Rule:    rule.Name,
+		Request: request,
+		Matched: matchingTx,
+		Similar: similarTx,
+	}
+	if len(matchingTx) > 0 {
+		data.SinceLast = time.Since(matchingTx[len(matchingTx)-1].CreatedAt)
+	}
 
-	case "recent_duplicate":
-		if len(similarTx) > 0 {
-			timeDiff := time.Since(similarTx[len(similarTx)-1].CreatedAt)
-			return fmt.Sprintf("温馨提示：您在%.0f分钟前有类似交易记录", timeDiff.Minutes())
+	if rule.Message != "" {
+		if message, err := ra.messages.render(rule.Message, data); err == nil {
+			return message
 		}
 	}
 
-	return "检测到相似交易"
+	return ra.messages.message(locale, rule.Name, data)
 }
@@ -0,0 +1,230 @@
+package txndedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// RuleSet 可热更新的风险规则与指纹配置
+type RuleSet struct {
+	Version           string            `json:"version,omitempty"` // 为空时按内容生成
+	RiskRules         []RiskRule        `json:"risk_rules"`
+	Scoring           ScoringConfig     `json:"scoring"`
+	FingerprintConfig FingerprintConfig `json:"fingerprint_config"`
+}
+
+// ParseRuleSet 解析JSON格式的规则集
+func ParseRuleSet(data []byte) (*RuleSet, error) {
+	var ruleSet RuleSet
+	if err := decodeJSON(data, &ruleSet); err != nil {
+		return nil, fmt.Errorf("parse rule set failed: %w", err)
+	}
+	return &ruleSet, nil
+}
+
+// LoadRuleSet 从JSON或YAML文件加载规则集
+func LoadRuleSet(path string) (*RuleSet, error) {
+	var ruleSet RuleSet
+	if err := decodeFile(path, &ruleSet); err != nil {
+		return nil, err
+	}
+	return &ruleSet, nil
+}
+
+// clone 深拷贝规则集，避免调用方修改正在使用的规则
+func (rs *RuleSet) clone() *RuleSet {
+	cloned := *rs
+
+	cloned.RiskRules = make([]RiskRule, len(rs.RiskRules))
+	for i, rule := range rs.RiskRules {
+		rule.CheckStatus = append([]TransactionStatus(nil), rule.CheckStatus...)
+		cloned.RiskRules[i] = rule
+	}
+	cloned.Scoring.Thresholds = append([]ScoreThreshold(nil), rs.Scoring.Thresholds...)
+
+	cloned.FingerprintConfig.AccountCanonicalizers = append([]string(nil), rs.FingerprintConfig.AccountCanonicalizers...)
+	cloned.FingerprintConfig.ExtraFields = make([]ExtraField, len(rs.FingerprintConfig.ExtraFields))
+	for i, field := range rs.FingerprintConfig.ExtraFields {
+		field.Normalizers = append([]FieldNormalizer(nil), field.Normalizers...)
+		cloned.FingerprintConfig.ExtraFields[i] = field
+	}
+
+	return &cloned
+}
+
+// ruleSetVersion 按规则集内容生成版本号
+func ruleSetVersion(ruleSet *RuleSet) string {
+	content := *ruleSet
+	content.Version = ""
+	data, err := json.Marshal(&content)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(data)
+	return fmt.Sprintf("%x", hash[:6])
+}
+
+// activeRules 检测器当前使用的规则，热更新时整体替换
+// 每次检测只读取一次，正在进行的检测不受更新影响
+type activeRules struct {
+	ruleSet       *RuleSet
+	horizon       time.Duration // 查询相似交易的时间范围，为各规则时间窗口的最大值
+	fingerprinter Fingerprinter
+	riskAssessor  *RiskAssessor
+}
+
+// newActiveRules 根据规则集创建指纹生成器和风险评估器，规则集需已通过校验
+func newActiveRules(config *Config, ruleSet *RuleSet) *activeRules {
+	// 创建指纹生成器
+	fingerprinter := config.Fingerprinter
+	if fingerprinter == nil {
+		fingerprinter = NewFingerprintGenerator(ruleSet.FingerprintConfig)
+	}
+
+	// 创建风险评估器
+	riskAssessor := NewRiskAssessor(ruleSet.RiskRules,
+		WithScoring(ruleSet.Scoring),
+		WithMessageCatalog(config.MessageCatalog),
+		WithDefaultLocale(config.DefaultLocale),
+	)
+
+	// 查询范围覆盖最长的规则时间窗口，无规则时使用全局时间窗口
+	horizon := time.Duration(0)
+	for _, rule := range ruleSet.RiskRules {
+		horizon = max(horizon, rule.TimeWindow)
+	}
+	if horizon == 0 {
+		horizon = config.TimeWindow
+	}
+
+	return &activeRules{
+		ruleSet:       ruleSet,
+		horizon:       horizon,
+		fingerprinter: fingerprinter,
+		riskAssessor:  riskAssessor,
+	}
+}
+
+// RuleSet 返回当前使用的规则集
+func (d *Detector) RuleSet() *RuleSet {
+	return d.rules.Load().ruleSet.clone()
+}
+
+// UpdateRules 校验并原子替换风险规则与指纹配置，校验失败时保留原规则
+// 规则集未指定指纹配置（零值，如规则文件中省略 fingerprint_config）时沿用当前配置
+// 修改指纹配置后，新请求的指纹与已存储记录的指纹可能不同，时间窗口内的历史记录将无法匹配
+// 配置了自定义 Fingerprinter 时指纹配置不参与热更新，指定了不同的配置时返回 ErrInvalidFingerprintConfig
+func (d *Detector) UpdateRules(ruleSet *RuleSet) error {
+	updated := ruleSet.clone()
+	current := d.rules.Load().ruleSet.FingerprintConfig
+	switch {
+	case sameFingerprintConfig(updated.FingerprintConfig, FingerprintConfig{}):
+		updated.FingerprintConfig = current
+	case d.config.Fingerprinter != nil && !sameFingerprintConfig(updated.FingerprintConfig, current):
+		return fmt.Errorf("invalid rule set: %w: fingerprint config cannot be changed when a custom fingerprinter is set", ErrInvalidFingerprintConfig)
+	}
+
+	candidate := *d.config
+	candidate.RiskRules = updated.RiskRules
+	candidate.Scoring = updated.Scoring
+	candidate.FingerprintConfig = updated.FingerprintConfig
+	if err := candidate.Validate(); err != nil {
+		return fmt.Errorf("invalid rule set: %w", err)
+	}
+
+	if updated.Version == "" {
+		updated.Version = ruleSetVersion(updated)
+	}
+
+	previous := d.rules.Swap(newActiveRules(d.config, updated))
+
+	d.config.Logger.WithFields(map[string]interface{}{
+		"previous_version": previous.ruleSet.Version,
+		"version":          updated.Version,
+		"rule_count":       len(updated.RiskRules),
+	}).Info("rules updated")
+
+	return nil
+}
+
+// sameFingerprintConfig 比较两个指纹配置的内容，空切片与nil视为相同
+func sameFingerprintConfig(a, b FingerprintConfig) bool {
+	left, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	right, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(left) == string(right)
+}
+
+// WatchRuleFile 加载规则文件并定期检查变更，文件修改后自动热更新规则
+// 首次加载失败时返回错误；后续加载或校验失败时记录日志并保留原规则。ctx 取消或检测器关闭后停止检查
+func (d *Detector) WatchRuleFile(ctx context.Context, path string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid watch interval %v", interval)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat rule file failed: %w", err)
+	}
+	ruleSet, err := LoadRuleSet(path)
+	if err != nil {
+		return err
+	}
+	if err := d.UpdateRules(ruleSet); err != nil {
+		return err
+	}
+
+	d.lifecycleMu.Lock()
+	defer d.lifecycleMu.Unlock()
+	if d.closed {
+		return ErrDetectorClosed
+	}
+
+	d.workers.Add(1)
+	go func() {
+		defer d.workers.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		modTime, size := info.ModTime(), info.Size()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-d.done:
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				d.config.Logger.WithError(err).WithField("path", path).Warn("stat rule file failed")
+				continue
+			}
+			if info.ModTime().Equal(modTime) && info.Size() == size {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+
+			ruleSet, err := LoadRuleSet(path)
+			if err == nil {
+				err = d.UpdateRules(ruleSet)
+			}
+			if err != nil {
+				d.config.Logger.WithError(err).WithField("path", path).Error("reload rule file failed")
+			}
+		}
+	}()
+
+	return nil
+}
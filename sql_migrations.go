@@ -0,0 +1,215 @@
+package txndedup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLDialect SQL方言
+type SQLDialect string
+
+const (
+	SQLDialectPostgres SQLDialect = "postgres"
+	SQLDialectMySQL    SQLDialect = "mysql"
+	SQLDialectSQLite   SQLDialect = "sqlite"
+)
+
+// dialectForDriver 按 database/sql 驱动名推断方言
+func dialectForDriver(driver string) SQLDialect {
+	switch driver {
+	case "postgres", "pgx", "pgx/v5":
+		return SQLDialectPostgres
+	case "mysql":
+		return SQLDialectMySQL
+	case "sqlite", "sqlite3":
+		return SQLDialectSQLite
+	}
+	return ""
+}
+
+// rebind 将 ? 占位符转换为方言的占位符，PostgreSQL 使用 $1、$2...
+func (d SQLDialect) rebind(query string) string {
+	if d != SQLDialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// insertIgnore 构建主键或唯一键冲突时跳过的插入语句
+func (d SQLDialect) insertIgnore(table string, columns ...string) string {
+	values := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	if d == SQLDialectMySQL {
+		return fmt.Sprintf("INSERT IGNORE INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), values)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING", table, strings.Join(columns, ", "), values)
+}
+
+// upsert 构建冲突时更新指定列的插入语句
+func (d SQLDialect) upsert(table, conflict string, columns []string, updates []string) string {
+	values := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	assignments := make([]string, len(updates))
+	for i, column := range updates {
+		if d == SQLDialectMySQL {
+			assignments[i] = fmt.Sprintf("%s = VALUES(%s)", column, column)
+		} else {
+			assignments[i] = fmt.Sprintf("%s = excluded.%s", column, column)
+		}
+	}
+
+	if d == SQLDialectMySQL {
+		return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON DUPLICATE KEY UPDATE %s",
+			table, strings.Join(columns, ", "), values, strings.Join(assignments, ", "))
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s",
+		table, strings.Join(columns, ", "), values, conflict, strings.Join(assignments, ", "))
+}
+
+// textType 记录内容的列类型，MySQL 的 TEXT 上限为64KB
+func (d SQLDialect) textType() string {
+	if d == SQLDialectMySQL {
+		return "MEDIUMTEXT"
+	}
+	return "TEXT"
+}
+
+// tableSuffix 建表语句的后缀
+func (d SQLDialect) tableSuffix() string {
+	if d == SQLDialectMySQL {
+		return " ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+	}
+	return ""
+}
+
+// sqlMigration 数据库结构迁移，版本号递增，已执行的迁移不可修改
+type sqlMigration struct {
+	version    int
+	statements func(d SQLDialect, t sqlTables) []string
+}
+
+// sqlTables 加上前缀后的表名
+type sqlTables struct {
+	records         string // 交易记录，每个指纹一行
+	fingerprints    string // 指纹版本号，用于预留时的乐观锁
+	idempotencyKeys string // 幂等键索引
+	migrations      string // 已执行的迁移
+}
+
+func newSQLTables(prefix string) sqlTables {
+	return sqlTables{
+		records:         prefix + "records",
+		fingerprints:    prefix + "fingerprints",
+		idempotencyKeys: prefix + "idempotency_keys",
+		migrations:      prefix + "schema_migrations",
+	}
+}
+
+// sqlMigrations 全部迁移，时间字段均为毫秒时间戳
+var sqlMigrations = []sqlMigration{
+	{
+		version: 1,
+		statements: func(d SQLDialect, t sqlTables) []string {
+			return []string{
+				fmt.Sprintf(`CREATE TABLE %s (
+	fingerprint VARCHAR(128) NOT NULL,
+	transaction_id VARCHAR(64) NOT NULL,
+	status VARCHAR(16) NOT NULL,
+	created_at BIGINT NOT NULL,
+	updated_at BIGINT NOT NULL,
+	revision BIGINT NOT NULL,
+	data %s NOT NULL,
+	PRIMARY KEY (fingerprint, transaction_id)
+)%s`, t.records, d.textType(), d.tableSuffix()),
+				fmt.Sprintf("CREATE INDEX %s_fp_created ON %s (fingerprint, created_at)", t.records, t.records),
+				fmt.Sprintf("CREATE INDEX %s_txid ON %s (transaction_id)", t.records, t.records),
+				fmt.Sprintf("CREATE INDEX %s_created ON %s (created_at)", t.records, t.records),
+				fmt.Sprintf(`CREATE TABLE %s (
+	fingerprint VARCHAR(128) NOT NULL PRIMARY KEY,
+	version BIGINT NOT NULL,
+	touched_at BIGINT NOT NULL
+)%s`, t.fingerprints, d.tableSuffix()),
+				fmt.Sprintf("CREATE INDEX %s_touched ON %s (touched_at)", t.fingerprints, t.fingerprints),
+				fmt.Sprintf(`CREATE TABLE %s (
+	idempotency_key VARCHAR(255) NOT NULL PRIMARY KEY,
+	transaction_id VARCHAR(64) NOT NULL,
+	created_at BIGINT NOT NULL
+)%s`, t.idempotencyKeys, d.tableSuffix()),
+				fmt.Sprintf("CREATE INDEX %s_created ON %s (created_at)", t.idempotencyKeys, t.idempotencyKeys),
+			}
+		},
+	},
+}
+
+// Migrate 创建或升级数据库结构，已执行的迁移会被跳过
+// 多实例部署时建议只在一个实例或发布流程中执行，其余实例配置 SkipMigrate
+func (ss *SQLStorage) Migrate(ctx context.Context) error {
+	_, err := ss.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	version INTEGER NOT NULL PRIMARY KEY,
+	applied_at BIGINT NOT NULL
+)%s`, ss.tables.migrations, ss.dialect.tableSuffix()))
+	if err != nil {
+		return fmt.Errorf("create migrations table failed: %w", err)
+	}
+
+	var current int
+	row := ss.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s", ss.tables.migrations))
+	if err := row.Scan(&current); err != nil {
+		return fmt.Errorf("read schema version failed: %w", err)
+	}
+
+	for _, migration := range sqlMigrations {
+		if migration.version <= current {
+			continue
+		}
+		if err := ss.applyMigration(ctx, migration); err != nil {
+			return fmt.Errorf("apply migration %d failed: %w", migration.version, err)
+		}
+	}
+
+	return nil
+}
+
+// applyMigration 在事务中执行单个迁移；MySQL 的DDL会隐式提交，失败时需人工检查
+func (ss *SQLStorage) applyMigration(ctx context.Context, migration sqlMigration) error {
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range migration.statements(ss.dialect, ss.tables) {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	query := ss.dialect.rebind(fmt.Sprintf("INSERT INTO %s (version, applied_at) VALUES (?, ?)", ss.tables.migrations))
+	if _, err := tx.ExecContext(ctx, query, migration.version, time.Now().UnixMilli()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rowsAffected 返回受影响的行数
+func rowsAffected(result sql.Result, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
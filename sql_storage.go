@@ -0,0 +1,458 @@
+package txndedup
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultSQLTablePrefix 默认表名前缀
+	defaultSQLTablePrefix = "txndedup_"
+	// defaultSQLCleanupBatchSize 每批删除的默认行数
+	defaultSQLCleanupBatchSize = 1000
+)
+
+// SQLStorage 基于 database/sql 的存储实现，支持 PostgreSQL、MySQL 和 SQLite
+// 每个指纹一行记录，预留时通过指纹版本号实现乐观锁；调用方需自行导入数据库驱动
+type SQLStorage struct {
+	db               *sql.DB
+	dialect          SQLDialect
+	tables           sqlTables
+	cleanupBatchSize int
+}
+
+// NewSQLStorage 创建SQL存储，未配置 SkipMigrate 时自动执行迁移
+func NewSQLStorage(config *SQLConfig) (*SQLStorage, error) {
+	dialect := config.Dialect
+	if dialect == "" {
+		dialect = dialectForDriver(config.Driver)
+	}
+	prefix := config.TablePrefix
+	if prefix == "" {
+		prefix = defaultSQLTablePrefix
+	}
+	batchSize := config.CleanupBatch
+	if batchSize <= 0 {
+		batchSize = defaultSQLCleanupBatchSize
+	}
+
+	db, err := sql.Open(config.Driver, config.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("open database failed: %w", err)
+	}
+
+	// SQLite 同一时间只允许一个写事务，未配置时使用单连接避免锁冲突
+	maxOpenConns := config.MaxOpenConns
+	if maxOpenConns <= 0 && dialect == SQLDialectSQLite {
+		maxOpenConns = 1
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+
+	// 测试连接
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("database connection failed: %w", err)
+	}
+
+	storage := &SQLStorage{
+		db:               db,
+		dialect:          dialect,
+		tables:           newSQLTables(prefix),
+		cleanupBatchSize: batchSize,
+	}
+
+	if !config.SkipMigrate {
+		if err := storage.Migrate(ctx); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return storage, nil
+}
+
+// Store 存储交易记录
+func (ss *SQLStorage) Store(ctx context.Context, fingerprint string, record *TransactionRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal record failed: %w", err)
+	}
+
+	err = ss.withTx(ctx, func(tx *sql.Tx) error {
+		// 递增版本号，使进行中的预留重新检查
+		if err := ss.touchFingerprint(ctx, tx, fingerprint); err != nil {
+			return err
+		}
+
+		if err := ss.insertRecord(ctx, tx, fingerprint, record, data); err != nil {
+			return err
+		}
+
+		// 多指纹记录只在主指纹上写入幂等键
+		if record.IdempotencyKey != "" && (record.Fingerprint == "" || record.Fingerprint == fingerprint) {
+			query := ss.dialect.upsert(ss.tables.idempotencyKeys, "idempotency_key",
+				[]string{"idempotency_key", "transaction_id", "created_at"}, []string{"transaction_id", "created_at"})
+			if _, err := tx.ExecContext(ctx, ss.dialect.rebind(query), record.IdempotencyKey, record.TransactionID, record.CreatedAt.UnixMilli()); err != nil {
+				return fmt.Errorf("store idempotency key failed: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("store record failed: %w", err)
+	}
+
+	return nil
+}
+
+// GetSimilar 获取相似交易
+func (ss *SQLStorage) GetSimilar(ctx context.Context, fingerprint string, timeWindow time.Duration) ([]*TransactionRecord, error) {
+	records, err := ss.querySimilar(ctx, fingerprint, time.Now().Add(-timeWindow))
+	if err != nil {
+		return nil, fmt.Errorf("get similar records failed: %w", err)
+	}
+	return records, nil
+}
+
+// querySimilar 按 (fingerprint, created_at) 索引查询截止时间之后的记录
+func (ss *SQLStorage) querySimilar(ctx context.Context, fingerprint string, cutoffTime time.Time) ([]*TransactionRecord, error) {
+	query := ss.dialect.rebind(fmt.Sprintf(
+		"SELECT data FROM %s WHERE fingerprint = ? AND created_at >= ? ORDER BY created_at", ss.tables.records))
+
+	rows, err := ss.db.QueryContext(ctx, query, fingerprint, cutoffTime.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []string
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		members = append(members, data)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return decodeRecords(members), nil
+}
+
+// Reserve 原子地检查并预留
+// 先读取相似交易及指纹版本号，再在事务中按指纹顺序比较并递增版本号、写入记录；版本号变化时重新检查
+func (ss *SQLStorage) Reserve(ctx context.Context, fingerprints []string, timeWindow time.Duration, decide ReserveFunc) error {
+	// 按固定顺序递增版本号，避免多指纹事务间死锁
+	var ordered []string
+	for _, fingerprint := range fingerprints {
+		if !slices.Contains(ordered, fingerprint) {
+			ordered = append(ordered, fingerprint)
+		}
+	}
+	sort.Strings(ordered)
+
+	for i := 0; i < maxUpdateRetries; i++ {
+		cutoffTime := time.Now().Add(-timeWindow)
+
+		versions := make(map[string]int64, len(fingerprints))
+		lists := make([][]*TransactionRecord, len(fingerprints))
+		for i, fingerprint := range fingerprints {
+			version, err := ss.fingerprintVersion(ctx, fingerprint)
+			if err != nil {
+				return fmt.Errorf("get fingerprint version failed: %w", err)
+			}
+			versions[fingerprint] = version
+
+			if lists[i], err = ss.querySimilar(ctx, fingerprint, cutoffTime); err != nil {
+				return fmt.Errorf("get similar records failed: %w", err)
+			}
+		}
+
+		record, err := decide(mergeRecords(lists...))
+		if err != nil || record == nil {
+			return err
+		}
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("marshal record failed: %w", err)
+		}
+
+		err = ss.withTx(ctx, func(tx *sql.Tx) error {
+			return ss.reserve(ctx, tx, ordered, versions, record, data)
+		})
+		if errors.Is(err, errVersionChanged) {
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrIdempotencyKeyExists) {
+			return fmt.Errorf("reserve record failed: %w", err)
+		}
+		return err
+	}
+
+	return ErrReservationConflict
+}
+
+// errVersionChanged 预留期间指纹版本号已变化
+var errVersionChanged = errors.New("fingerprint version changed")
+
+// reserve 在事务中比较版本号并写入预留记录
+func (ss *SQLStorage) reserve(ctx context.Context, tx *sql.Tx, fingerprints []string, versions map[string]int64, record *TransactionRecord, data []byte) error {
+	if record.IdempotencyKey != "" {
+		var transactionID string
+		query := ss.dialect.rebind(fmt.Sprintf("SELECT transaction_id FROM %s WHERE idempotency_key = ?", ss.tables.idempotencyKeys))
+		err := tx.QueryRowContext(ctx, query, record.IdempotencyKey).Scan(&transactionID)
+		if err == nil {
+			return ErrIdempotencyKeyExists
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+	}
+
+	now := time.Now().UnixMilli()
+	for _, fingerprint := range fingerprints {
+		var (
+			affected int64
+			err      error
+		)
+		if versions[fingerprint] == 0 {
+			query := ss.dialect.insertIgnore(ss.tables.fingerprints, "fingerprint", "version", "touched_at")
+			affected, err = rowsAffected(tx.ExecContext(ctx, ss.dialect.rebind(query), fingerprint, 1, now))
+		} else {
+			query := fmt.Sprintf("UPDATE %s SET version = version + 1, touched_at = ? WHERE fingerprint = ? AND version = ?", ss.tables.fingerprints)
+			affected, err = rowsAffected(tx.ExecContext(ctx, ss.dialect.rebind(query), now, fingerprint, versions[fingerprint]))
+		}
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return errVersionChanged
+		}
+
+		if err := ss.insertRecord(ctx, tx, fingerprint, record, data); err != nil {
+			return err
+		}
+	}
+
+	if record.IdempotencyKey != "" {
+		query := ss.dialect.insertIgnore(ss.tables.idempotencyKeys, "idempotency_key", "transaction_id", "created_at")
+		affected, err := rowsAffected(tx.ExecContext(ctx, ss.dialect.rebind(query), record.IdempotencyKey, record.TransactionID, record.CreatedAt.UnixMilli()))
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return ErrIdempotencyKeyExists
+		}
+	}
+
+	return nil
+}
+
+// Get 按交易ID获取记录
+func (ss *SQLStorage) Get(ctx context.Context, transactionID string) (*TransactionRecord, error) {
+	record, _, err := ss.get(ctx, ss.db, transactionID)
+	return record, err
+}
+
+// get 按 transaction_id 索引读取记录及其修订号
+func (ss *SQLStorage) get(ctx context.Context, q queryer, transactionID string) (*TransactionRecord, int64, error) {
+	query := ss.dialect.rebind(fmt.Sprintf(
+		"SELECT data, revision FROM %s WHERE transaction_id = ? LIMIT 1", ss.tables.records))
+
+	var (
+		data     string
+		revision int64
+	)
+	err := q.QueryRowContext(ctx, query, transactionID).Scan(&data, &revision)
+	if err == sql.ErrNoRows {
+		return nil, 0, ErrTransactionNotFound
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("get record failed: %w", err)
+	}
+
+	var record TransactionRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, 0, fmt.Errorf("unmarshal record failed: %w", err)
+	}
+	return &record, revision, nil
+}
+
+// GetByIdempotencyKey 按幂等键获取记录
+func (ss *SQLStorage) GetByIdempotencyKey(ctx context.Context, idempotencyKey string) (*TransactionRecord, error) {
+	var transactionID string
+	query := ss.dialect.rebind(fmt.Sprintf("SELECT transaction_id FROM %s WHERE idempotency_key = ?", ss.tables.idempotencyKeys))
+	err := ss.db.QueryRowContext(ctx, query, idempotencyKey).Scan(&transactionID)
+	if err == sql.ErrNoRows {
+		return nil, ErrTransactionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get idempotency key failed: %w", err)
+	}
+
+	return ss.Get(ctx, transactionID)
+}
+
+// Update 按交易ID更新记录
+// 一条语句更新该交易在全部指纹下的行，通过修订号检测并发更新
+func (ss *SQLStorage) Update(ctx context.Context, transactionID string, update RecordUpdateFunc) (*TransactionRecord, error) {
+	for i := 0; i < maxUpdateRetries; i++ {
+		record, revision, err := ss.get(ctx, ss.db, transactionID)
+		if err != nil {
+			return nil, err
+		}
+
+		update(record)
+		record.UpdatedAt = time.Now()
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("marshal record failed: %w", err)
+		}
+
+		query := ss.dialect.rebind(fmt.Sprintf(
+			"UPDATE %s SET data = ?, status = ?, updated_at = ?, revision = revision + 1 WHERE transaction_id = ? AND revision = ?",
+			ss.tables.records))
+		affected, err := rowsAffected(ss.db.ExecContext(ctx, query, data, string(record.Status), record.UpdatedAt.UnixMilli(), transactionID, revision))
+		if err != nil {
+			return nil, fmt.Errorf("update record failed: %w", err)
+		}
+		if affected > 0 {
+			return record, nil
+		}
+	}
+
+	return nil, fmt.Errorf("update record failed: %w", ErrReservationConflict)
+}
+
+// Cleanup 分批删除早于时间窗口的记录、幂等键和指纹版本号
+func (ss *SQLStorage) Cleanup(ctx context.Context, timeWindow time.Duration) error {
+	cutoff := time.Now().Add(-timeWindow).UnixMilli()
+
+	if err := ss.deleteBatches(ctx, ss.tables.records, "transaction_id", "created_at", cutoff); err != nil {
+		return fmt.Errorf("cleanup records failed: %w", err)
+	}
+	if err := ss.deleteBatches(ctx, ss.tables.idempotencyKeys, "idempotency_key", "created_at", cutoff); err != nil {
+		return fmt.Errorf("cleanup idempotency keys failed: %w", err)
+	}
+	if err := ss.deleteBatches(ctx, ss.tables.fingerprints, "fingerprint", "touched_at", cutoff); err != nil {
+		return fmt.Errorf("cleanup fingerprints failed: %w", err)
+	}
+
+	return nil
+}
+
+// deleteBatches 每批读取 cleanupBatchSize 个过期的键后按键删除，避免长事务和大范围锁
+func (ss *SQLStorage) deleteBatches(ctx context.Context, table, keyColumn, timeColumn string, cutoff int64) error {
+	selectQuery := ss.dialect.rebind(fmt.Sprintf("SELECT %s FROM %s WHERE %s < ? LIMIT %d", keyColumn, table, timeColumn, ss.cleanupBatchSize))
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rows, err := ss.db.QueryContext(ctx, selectQuery, cutoff)
+		if err != nil {
+			return err
+		}
+		var keys []interface{}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return err
+			}
+			keys = append(keys, key)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		// 再次比较时间，跳过读取后被重新写入的行
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ")
+		deleteQuery := ss.dialect.rebind(fmt.Sprintf("DELETE FROM %s WHERE %s < ? AND %s IN (%s)", table, timeColumn, keyColumn, placeholders))
+		if _, err := ss.db.ExecContext(ctx, deleteQuery, append([]interface{}{cutoff}, keys...)...); err != nil {
+			return err
+		}
+
+		if len(keys) < ss.cleanupBatchSize {
+			return nil
+		}
+	}
+}
+
+// Close 关闭存储
+func (ss *SQLStorage) Close() error {
+	return ss.db.Close()
+}
+
+// queryer *sql.DB 与 *sql.Tx 共有的查询方法
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// withTx 在事务中执行 fn，fn 返回错误时回滚
+func (ss *SQLStorage) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// fingerprintVersion 读取指纹版本号，不存在时为0
+func (ss *SQLStorage) fingerprintVersion(ctx context.Context, fingerprint string) (int64, error) {
+	var version int64
+	query := ss.dialect.rebind(fmt.Sprintf("SELECT version FROM %s WHERE fingerprint = ?", ss.tables.fingerprints))
+	err := ss.db.QueryRowContext(ctx, query, fingerprint).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// touchFingerprint 递增指纹版本号，指纹不存在时创建
+func (ss *SQLStorage) touchFingerprint(ctx context.Context, tx *sql.Tx, fingerprint string) error {
+	now := time.Now().UnixMilli()
+	insert := ss.dialect.insertIgnore(ss.tables.fingerprints, "fingerprint", "version", "touched_at")
+	if _, err := tx.ExecContext(ctx, ss.dialect.rebind(insert), fingerprint, 0, now); err != nil {
+		return err
+	}
+
+	update := fmt.Sprintf("UPDATE %s SET version = version + 1, touched_at = ? WHERE fingerprint = ?", ss.tables.fingerprints)
+	_, err := tx.ExecContext(ctx, ss.dialect.rebind(update), now, fingerprint)
+	return err
+}
+
+// insertRecord 写入指纹下的记录，同一指纹下已存在该交易时跳过
+func (ss *SQLStorage) insertRecord(ctx context.Context, tx *sql.Tx, fingerprint string, record *TransactionRecord, data []byte) error {
+	query := ss.dialect.insertIgnore(ss.tables.records,
+		"fingerprint", "transaction_id", "status", "created_at", "updated_at", "revision", "data")
+	_, err := tx.ExecContext(ctx, ss.dialect.rebind(query),
+		fingerprint, record.TransactionID, string(record.Status), record.CreatedAt.UnixMilli(), record.UpdatedAt.UnixMilli(), 0, string(data))
+	return err
+}
@@ -2,6 +2,8 @@ package txndedup
 
 import (
 	"context"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -13,6 +15,19 @@ type Storage interface {
 	// 获取相似交易
 	GetSimilar(ctx context.Context, fingerprint string, timeWindow time.Duration) ([]*TransactionRecord, error)
 
+	// 原子地检查并预留：在给定指纹上串行执行 decide，decide 返回非nil记录时将该记录写入全部指纹；
+	// 记录的幂等键已被占用时返回 ErrIdempotencyKeyExists
+	Reserve(ctx context.Context, fingerprints []string, timeWindow time.Duration, decide ReserveFunc) error
+
+	// 按交易ID获取记录，交易不存在时返回 ErrTransactionNotFound
+	Get(ctx context.Context, transactionID string) (*TransactionRecord, error)
+
+	// 按幂等键获取记录，不存在时返回 ErrTransactionNotFound
+	GetByIdempotencyKey(ctx context.Context, idempotencyKey string) (*TransactionRecord, error)
+
+	// 按交易ID原地更新记录，交易不存在时返回 ErrTransactionNotFound
+	Update(ctx context.Context, transactionID string, update RecordUpdateFunc) (*TransactionRecord, error)
+
 	// 清理过期记录
 	Cleanup(ctx context.Context, timeWindow time.Duration) error
 
@@ -20,6 +35,24 @@ type Storage interface {
 	Close() error
 }
 
+// StorageStarter 需要后台任务的存储可实现此接口，由 Detector.Start 启动
+type StorageStarter interface {
+	Start(ctx context.Context) error
+}
+
+// StorageShutdowner 支持限时关闭的存储可实现此接口，Detector.Shutdown 优先调用 Shutdown，否则调用 Close
+// ctx 结束时返回 ctx.Err()，后台协程退出后可再次调用以完成关闭
+type StorageShutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// ReserveFunc 根据时间窗口内的相似交易（各指纹结果的并集，按创建时间升序）决定是否预留，
+// 返回需要写入的记录，nil表示不预留
+type ReserveFunc func(similarTx []*TransactionRecord) (*TransactionRecord, error)
+
+// RecordUpdateFunc 原地修改记录
+type RecordUpdateFunc func(record *TransactionRecord)
+
 // StorageFactory 存储工厂
 type StorageFactory struct{}
 
@@ -27,10 +60,73 @@ type StorageFactory struct{}
 func (sf *StorageFactory) NewStorage(config *Config) (Storage, error) {
 	switch config.StorageType {
 	case "memory":
-		return NewMemoryStorage(config), nil
+		return OpenMemoryStorage(config)
 	case "redis":
-		return NewRedisStorage(config.RedisConfig)
+		storage, err := NewRedisStorage(config.RedisConfig)
+		if err != nil {
+			return nil, err
+		}
+		if config.RedisConfig.RecordTTL <= 0 {
+			storage.recordTTL = config.Retention()
+		}
+		storage.maxRecordsPerKey = config.MaxRecordsPerKey
+		storage.cleanupInterval = config.CleanupInterval
+		storage.logger = config.Logger
+		if config.RedisConfig.MigrateScores {
+			migrated, err := storage.MigrateScores(context.Background())
+			if err != nil {
+				storage.Close()
+				return nil, err
+			}
+			config.Logger.WithField("migrated", migrated).Info("redis scores migrated")
+		}
+		return storage, nil
+	case "sql":
+		return NewSQLStorage(config.SQLConfig)
+	case "bolt":
+		return NewBoltStorage(config)
 	default:
 		return nil, ErrUnsupportedStorageType
 	}
 }
+
+// mergeRecords 合并多个指纹下的相似交易，按交易ID去重并按创建时间升序排列
+func mergeRecords(lists ...[]*TransactionRecord) []*TransactionRecord {
+	if len(lists) == 1 {
+		return lists[0]
+	}
+
+	var merged []*TransactionRecord
+	seen := make(map[string]bool)
+	for _, records := range lists {
+		for _, record := range records {
+			if seen[record.TransactionID] {
+				continue
+			}
+			seen[record.TransactionID] = true
+			merged = append(merged, record)
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].CreatedAt.Before(merged[j].CreatedAt)
+	})
+
+	return merged
+}
+
+// waitContext 等待后台协程退出，ctx 先结束时返回 ctx.Err()
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
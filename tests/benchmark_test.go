@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wzynn/txndedup"
+)
+
+const benchFingerprints = 100000
+
+// newBenchMemoryStorage 创建预先写入记录的内存存储，清理由基准测试显式触发
+func newBenchMemoryStorage(b *testing.B) *txndedup.MemoryStorage {
+	config := txndedup.DefaultConfig()
+	config.CleanupInterval = time.Hour
+	storage := txndedup.NewMemoryStorage(config)
+	b.Cleanup(func() { storage.Close() })
+
+	ctx := context.Background()
+	now := time.Now()
+	for i := 0; i < benchFingerprints; i++ {
+		record := &txndedup.TransactionRecord{
+			TransactionID: fmt.Sprintf("seed_%d", i),
+			Status:        txndedup.StatusSuccess,
+			CreatedAt:     now.Add(-time.Hour), // 全部过期，每次清理都需要处理
+		}
+		storage.Store(ctx, fmt.Sprintf("fp_%d", i), record)
+	}
+	return storage
+}
+
+func BenchmarkMemoryStorage_Store(b *testing.B) {
+	storage := newBenchMemoryStorage(b)
+	ctx := context.Background()
+	var seq atomic.Int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := seq.Add(1)
+			record := &txndedup.TransactionRecord{
+				TransactionID: fmt.Sprintf("tx_%d", n),
+				Status:        txndedup.StatusPending,
+				CreatedAt:     time.Now(),
+			}
+			storage.Store(ctx, fmt.Sprintf("fp_%d", n%benchFingerprints), record)
+		}
+	})
+}
+
+func BenchmarkMemoryStorage_GetSimilar(b *testing.B) {
+	storage := newBenchMemoryStorage(b)
+	ctx := context.Background()
+	var seq atomic.Int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := seq.Add(1)
+			storage.GetSimilar(ctx, fmt.Sprintf("fp_%d", n%benchFingerprints), 2*time.Hour)
+		}
+	})
+}
+
+// BenchmarkMemoryStorage_StoreDuringCleanup 清理与写入并发执行，报告写入延迟的p99、p999和最大值
+func BenchmarkMemoryStorage_StoreDuringCleanup(b *testing.B) {
+	storage := newBenchMemoryStorage(b)
+	ctx := context.Background()
+
+	stop := make(chan struct{})
+	var cleaner sync.WaitGroup
+	cleaner.Add(1)
+	go func() {
+		defer cleaner.Done()
+		now := time.Now()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// 每轮重新写入一批过期记录，保证清理始终有工作
+			for j := 0; j < 1000; j++ {
+				record := &txndedup.TransactionRecord{
+					TransactionID: fmt.Sprintf("expired_%d_%d", i, j),
+					CreatedAt:     now.Add(-time.Hour),
+				}
+				storage.Store(ctx, fmt.Sprintf("fp_%d", (i*1000+j)%benchFingerprints), record)
+			}
+			storage.Cleanup(ctx, 30*time.Minute)
+		}
+	}()
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		seq       atomic.Int64
+	)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		local := make([]time.Duration, 0, 1024)
+		for pb.Next() {
+			n := seq.Add(1)
+			record := &txndedup.TransactionRecord{
+				TransactionID: fmt.Sprintf("tx_%d", n),
+				Status:        txndedup.StatusPending,
+				CreatedAt:     time.Now(),
+			}
+			start := time.Now()
+			storage.Store(ctx, fmt.Sprintf("fp_%d", n%benchFingerprints), record)
+			local = append(local, time.Since(start))
+		}
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+
+	close(stop)
+	cleaner.Wait()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	if n := len(latencies); n > 0 {
+		b.ReportMetric(float64(latencies[n*99/100].Microseconds()), "p99-µs")
+		b.ReportMetric(float64(latencies[n*999/1000].Microseconds()), "p999-µs")
+		b.ReportMetric(float64(latencies[n-1].Microseconds()), "max-µs")
+	}
+}
@@ -1,15 +1,29 @@
 package tests
 
 import (
+	"bytes"
 	"context"
-	"github.com/wzynn/txndedup"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/wzynn/txndedup"
 )
 
 func TestDetector_CheckDuplicate(t *testing.T) {
 	config := txndedup.DefaultConfig()
-	config.TimeWindow = 1 * time.Minute
+	config.TimeWindow = 30 * time.Minute
 
 	detector, err := txndedup.New(config)
 	if err != nil {
@@ -22,7 +36,7 @@ func TestDetector_CheckDuplicate(t *testing.T) {
 	request := &txndedup.TransactionRequest{
 		FromAccount:  "test_001",
 		ToAccount:    "test_002",
-		Amount:       50.00,
+		Amount:       txndedup.NewMoney(5000, "USD"),
 		Currency:     "USD",
 		BusinessType: "transfer",
 		UserIP:       "127.0.0.1",
@@ -70,3 +84,2459 @@ func TestDetector_CheckDuplicate(t *testing.T) {
 		t.Errorf("应该有1个相似交易，实际有%d个", len(result2.SimilarTransactions))
 	}
 }
+
+func TestDetector_UpdateTransactionStatus(t *testing.T) {
+	config := txndedup.DefaultConfig()
+
+	detector, err := txndedup.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detector.Close()
+
+	ctx := context.Background()
+
+	request := &txndedup.TransactionRequest{
+		FromAccount:  "test_001",
+		ToAccount:    "test_002",
+		Amount:       txndedup.NewMoney(5000, "USD"),
+		Currency:     "USD",
+		BusinessType: "transfer",
+	}
+
+	record := &txndedup.TransactionRecord{
+		TransactionID: "tx_pending",
+		FromAccount:   request.FromAccount,
+		ToAccount:     request.ToAccount,
+		Amount:        request.Amount,
+		Currency:      request.Currency,
+		BusinessType:  request.BusinessType,
+		Status:        txndedup.StatusPending,
+	}
+	if err := detector.RecordTransaction(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	// pending状态应被阻止
+	result, err := detector.CheckDuplicate(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SuggestionAction != txndedup.ActionBlock {
+		t.Errorf("pending交易应被阻止，实际为%s", result.SuggestionAction)
+	}
+
+	if err := detector.UpdateTransactionStatus(ctx, "tx_pending", txndedup.StatusFailed); err != nil {
+		t.Fatal(err)
+	}
+
+	// 状态更新后不再命中pending规则
+	result, err = detector.CheckDuplicate(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SuggestionAction == txndedup.ActionBlock {
+		t.Error("交易失败后不应继续阻止")
+	}
+	if result.SimilarTransactions[0].Status != txndedup.StatusFailed {
+		t.Errorf("状态应为FAILED，实际为%s", result.SimilarTransactions[0].Status)
+	}
+
+	err = detector.UpdateTransactionStatus(ctx, "tx_unknown", txndedup.StatusSuccess)
+	if !errors.Is(err, txndedup.ErrTransactionNotFound) {
+		t.Errorf("未知交易应返回ErrTransactionNotFound，实际为%v", err)
+	}
+
+	// 并发检测与更新状态，-race 下不应报告数据竞争
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if _, err := detector.CheckDuplicate(ctx, request); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		statuses := []txndedup.TransactionStatus{txndedup.StatusPending, txndedup.StatusSuccess}
+		for i := 0; i < 200; i++ {
+			if err := detector.UpdateTransactionStatus(ctx, "tx_pending", statuses[i%2]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestRedisStorage_Update(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	storage, err := txndedup.NewRedisStorage(&txndedup.RedisConfig{
+		Address:   mr.Addr(),
+		KeyPrefix: "test:",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	ctx := context.Background()
+
+	record := &txndedup.TransactionRecord{
+		TransactionID: "tx_001",
+		Fingerprint:   "fp_001",
+		Status:        txndedup.StatusPending,
+		CreatedAt:     time.Now(),
+	}
+	if err := storage.Store(ctx, record.Fingerprint, record); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := storage.Update(ctx, "tx_001", func(record *txndedup.TransactionRecord) {
+		record.Status = txndedup.StatusSuccess
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Status != txndedup.StatusSuccess {
+		t.Errorf("状态应为SUCCESS，实际为%s", updated.Status)
+	}
+
+	records, err := storage.GetSimilar(ctx, "fp_001", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Status != txndedup.StatusSuccess {
+		t.Errorf("存储中的记录应已更新: %+v", records)
+	}
+
+	if _, err := storage.Get(ctx, "tx_unknown"); !errors.Is(err, txndedup.ErrTransactionNotFound) {
+		t.Errorf("未知交易应返回ErrTransactionNotFound，实际为%v", err)
+	}
+}
+
+func TestDetector_CheckAndReserve(t *testing.T) {
+	configs := backendConfigs(t, "test:")
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			detector, err := txndedup.New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer detector.Close()
+
+			ctx := context.Background()
+			request := &txndedup.TransactionRequest{
+				FromAccount:  "test_001",
+				ToAccount:    "test_002",
+				Amount:       txndedup.NewMoney(5000, "USD"),
+				Currency:     "USD",
+				BusinessType: "transfer",
+			}
+
+			// 并发预留，只允许一个请求通过
+			const workers = 20
+			results := make(chan *txndedup.DuplicateCheckResult, workers)
+			var wg sync.WaitGroup
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					result, err := detector.CheckAndReserve(ctx, request)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					results <- result
+				}()
+			}
+			wg.Wait()
+			close(results)
+
+			var reserved []string
+			for result := range results {
+				if result.TransactionID != "" {
+					reserved = append(reserved, result.TransactionID)
+				} else if result.SuggestionAction != txndedup.ActionBlock {
+					t.Errorf("未预留的请求应被阻止，实际为%s", result.SuggestionAction)
+				}
+			}
+			if len(reserved) != 1 {
+				t.Fatalf("应只有1个预留成功，实际有%d个", len(reserved))
+			}
+
+			// 预留的交易完成后可再次发起
+			if err := detector.UpdateTransactionStatus(ctx, reserved[0], txndedup.StatusFailed); err != nil {
+				t.Fatal(err)
+			}
+			result, err := detector.CheckAndReserve(ctx, request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.TransactionID == "" {
+				t.Errorf("原交易失败后应允许预留，实际为%s", result.SuggestionAction)
+			}
+		})
+	}
+}
+
+func TestDetector_IdempotencyKey(t *testing.T) {
+	configs := backendConfigs(t, "idem:")
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			detector, err := txndedup.New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer detector.Close()
+
+			ctx := context.Background()
+			request := &txndedup.TransactionRequest{
+				FromAccount:    "test_001",
+				ToAccount:      "test_002",
+				Amount:         txndedup.NewMoney(5000, "USD"),
+				Currency:       "USD",
+				BusinessType:   "transfer",
+				Extra:          map[string]interface{}{"order_id": "o_001", "sku": "s_001"},
+				IdempotencyKey: "order-001",
+			}
+
+			result, err := detector.CheckAndReserve(ctx, request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.IdempotentReplay || result.TransactionID == "" {
+				t.Fatal("首次请求应预留成功")
+			}
+
+			response := json.RawMessage(`{"payment_id":"p_001"}`)
+			if err := detector.CompleteTransaction(ctx, result.TransactionID, txndedup.StatusSuccess, response); err != nil {
+				t.Fatal(err)
+			}
+
+			// 相同幂等键的重放返回原响应
+			replay, err := detector.CheckAndReserve(ctx, request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !replay.IdempotentReplay {
+				t.Fatal("重放请求应识别为幂等重放")
+			}
+			if replay.OriginalTransaction.TransactionID != result.TransactionID {
+				t.Errorf("应返回原交易%s，实际为%s", result.TransactionID, replay.OriginalTransaction.TransactionID)
+			}
+			if string(replay.OriginalTransaction.Response) != string(response) {
+				t.Errorf("应返回原响应，实际为%s", replay.OriginalTransaction.Response)
+			}
+
+			// 相同幂等键、不同内容返回冲突
+			conflict := *request
+			conflict.Amount = txndedup.NewMoney(6000, "USD")
+			if _, err := detector.CheckDuplicate(ctx, &conflict); !errors.Is(err, txndedup.ErrIdempotencyKeyConflict) {
+				t.Errorf("应返回ErrIdempotencyKeyConflict，实际为%v", err)
+			}
+
+			// 只有扩展字段不同时同样返回冲突
+			conflict = *request
+			conflict.Extra = map[string]interface{}{"order_id": "o_001", "sku": "s_002"}
+			if _, err := detector.CheckAndReserve(ctx, &conflict); !errors.Is(err, txndedup.ErrIdempotencyKeyConflict) {
+				t.Errorf("扩展字段不同应返回ErrIdempotencyKeyConflict，实际为%v", err)
+			}
+		})
+	}
+}
+
+func TestDetector_CompositeFingerprinter(t *testing.T) {
+	configs := backendConfigs(t, "composite:")
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			// 字段指纹 + 订单号指纹
+			config.Fingerprinter = txndedup.NewCompositeFingerprinter(
+				txndedup.NewFingerprintGenerator(config.FingerprintConfig),
+				txndedup.NewExtraFingerprinter("order_id"),
+			)
+
+			detector, err := txndedup.New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer detector.Close()
+
+			ctx := context.Background()
+			request := &txndedup.TransactionRequest{
+				FromAccount:  "test_001",
+				ToAccount:    "test_002",
+				Amount:       txndedup.NewMoney(5000, "USD"),
+				Currency:     "USD",
+				BusinessType: "transfer",
+				Extra:        map[string]interface{}{"order_id": "o_001"},
+			}
+
+			result, err := detector.CheckAndReserve(ctx, request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Fingerprints) != 2 {
+				t.Fatalf("应生成2个指纹，实际为%d个", len(result.Fingerprints))
+			}
+
+			// 金额不同但订单号相同，通过订单号指纹命中
+			retry := *request
+			retry.Amount = txndedup.NewMoney(6000, "USD")
+			result2, err := detector.CheckDuplicate(ctx, &retry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result2.SuggestionAction != txndedup.ActionBlock {
+				t.Errorf("相同订单号的pending交易应被阻止，实际为%s", result2.SuggestionAction)
+			}
+
+			// 状态更新需同步到所有指纹
+			if err := detector.UpdateTransactionStatus(ctx, result.TransactionID, txndedup.StatusFailed); err != nil {
+				t.Fatal(err)
+			}
+			result3, err := detector.CheckDuplicate(ctx, &retry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result3.SuggestionAction == txndedup.ActionBlock {
+				t.Error("交易失败后不应继续阻止")
+			}
+		})
+	}
+}
+
+func TestExtraFingerprinter_Escaping(t *testing.T) {
+	// 值中包含分隔符时不应与其他字段组合混淆
+	fingerprinter := txndedup.NewExtraFingerprinter("a", "b")
+	first := fingerprinter.Fingerprints(&txndedup.TransactionRequest{Extra: map[string]interface{}{"a": "x|extra.b:y", "b": ""}})
+	second := fingerprinter.Fingerprints(&txndedup.TransactionRequest{Extra: map[string]interface{}{"a": "x", "b": "y|extra.b:"}})
+	if len(first) != 1 || len(second) != 1 || first[0] == second[0] {
+		t.Error("值中包含分隔符的不同字段组合不应生成相同指纹")
+	}
+
+	// 字段名中包含分隔符时不应与其他字段名混淆
+	first = txndedup.NewExtraFingerprinter("a:b").Fingerprints(&txndedup.TransactionRequest{Extra: map[string]interface{}{"a:b": "c"}})
+	second = txndedup.NewExtraFingerprinter("a").Fingerprints(&txndedup.TransactionRequest{Extra: map[string]interface{}{"a": "b:c"}})
+	if len(first) != 1 || len(second) != 1 || first[0] == second[0] {
+		t.Error("字段名中包含分隔符时不应与其他字段生成相同指纹")
+	}
+}
+
+func TestFingerprintGenerator_ExtraFields(t *testing.T) {
+	config := txndedup.DefaultConfig().FingerprintConfig
+	config.ExtraFields = []txndedup.ExtraField{
+		{Key: "order_id", Normalizers: []txndedup.FieldNormalizer{txndedup.NormalizeTrim, txndedup.NormalizeLowercase}},
+		{Key: "sku", Normalizers: []txndedup.FieldNormalizer{txndedup.NormalizeDigits}},
+		{Key: "merchant_ref", Normalizers: []txndedup.FieldNormalizer{txndedup.NormalizeRegex}, Pattern: `^REF-(\d+)`},
+	}
+	generator := txndedup.NewFingerprintGenerator(config)
+
+	request := &txndedup.TransactionRequest{
+		FromAccount: "test_001",
+		ToAccount:   "test_002",
+		Amount:      txndedup.NewMoney(5000, "USD"),
+		Currency:    "USD",
+		Extra: map[string]interface{}{
+			"order_id":     " ORDER-001 ",
+			"sku":          "SKU-123-456",
+			"merchant_ref": "REF-42-retry",
+		},
+	}
+	normalized := *request
+	normalized.Extra = map[string]interface{}{
+		"order_id":     "order-001",
+		"sku":          123456,
+		"merchant_ref": "REF-42",
+	}
+
+	if generator.Generate(request) != generator.Generate(&normalized) {
+		t.Error("标准化后相同的扩展字段应生成相同指纹")
+	}
+
+	different := *request
+	different.Extra = map[string]interface{}{"order_id": "order-002", "sku": "123456", "merchant_ref": "REF-42"}
+	if generator.Generate(request) == generator.Generate(&different) {
+		t.Error("不同订单号应生成不同指纹")
+	}
+
+	// 记录与请求使用相同的扩展字段计算指纹
+	record := &txndedup.TransactionRecord{
+		FromAccount: request.FromAccount,
+		ToAccount:   request.ToAccount,
+		Amount:      request.Amount,
+		Currency:    request.Currency,
+		Extra:       request.Extra,
+	}
+	if generator.GenerateFromRecord(record) != generator.Generate(request) {
+		t.Error("记录与请求应生成相同指纹")
+	}
+
+	invalid := txndedup.DefaultConfig()
+	invalid.FingerprintConfig.ExtraFields = []txndedup.ExtraField{
+		{Key: "order_id", Normalizers: []txndedup.FieldNormalizer{txndedup.NormalizeRegex}, Pattern: "("},
+	}
+	if err := invalid.Validate(); !errors.Is(err, txndedup.ErrInvalidFingerprintConfig) {
+		t.Errorf("无效正则应返回ErrInvalidFingerprintConfig，实际为%v", err)
+	}
+}
+
+func TestMoney(t *testing.T) {
+	// float64 兼容构造避免二进制舍入误差
+	if got, _ := txndedup.MoneyFromFloat(0.1+0.2, "USD"); got.Cmp(txndedup.NewMoney(30, "USD")) != 0 {
+		t.Errorf("0.1+0.2 应为0.30，实际为%s", got)
+	}
+	if got, _ := txndedup.MoneyFromFloat(1.005, "USD"); got.String() != "1.01" {
+		t.Errorf("1.005 应四舍五入为1.01，实际为%s", got)
+	}
+	if got := txndedup.NewMoney(1500, "JPY").String(); got != "1500" {
+		t.Errorf("JPY 无小数位，实际为%s", got)
+	}
+	if got := txndedup.NewMoney(1234, "BHD").String(); got != "1.234" {
+		t.Errorf("BHD 有3位小数，实际为%s", got)
+	}
+
+	// 兼容旧版本 float64 序列化的记录
+	var record txndedup.TransactionRecord
+	if err := json.Unmarshal([]byte(`{"amount":100.5}`), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Amount.Cmp(txndedup.NewMoney(10050, "USD")) != 0 {
+		t.Errorf("应解析为100.50，实际为%s", record.Amount)
+	}
+	data, err := json.Marshal(txndedup.TransactionRequest{Amount: txndedup.NewMoney(10050, "USD")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"amount":100.50`) {
+		t.Errorf("金额应序列化为精确的十进制数字: %s", data)
+	}
+
+	// 超出 int64 范围时返回错误而不是回绕
+	if _, err := txndedup.ParseMoney("10000000000000000000"); !errors.Is(err, txndedup.ErrAmountOverflow) {
+		t.Errorf("超出范围的金额应返回ErrAmountOverflow，实际为%v", err)
+	}
+	if got, err := txndedup.ParseMoney("1.50000000000000000000"); err != nil || got.String() != "1.5" {
+		t.Errorf("尾随零不应导致溢出，实际为%s, %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(`{"amount":1e30}`), &record); !errors.Is(err, txndedup.ErrAmountOverflow) {
+		t.Errorf("1e30 应返回ErrAmountOverflow，实际为%v", err)
+	}
+	if _, err := txndedup.NewMoney(1, "USD").Rescale(30); !errors.Is(err, txndedup.ErrAmountOverflow) {
+		t.Errorf("扩大精度溢出应返回ErrAmountOverflow，实际为%v", err)
+	}
+	if _, err := txndedup.MoneyFromFloat(1e30, "USD"); !errors.Is(err, txndedup.ErrAmountOverflow) {
+		t.Errorf("1e30 应返回ErrAmountOverflow，实际为%v", err)
+	}
+
+	// 缩小超过18位小数时四舍五入为0，不再回绕
+	if err := json.Unmarshal([]byte(`{"amount":1e-30}`), &record); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := record.Amount.Rescale(2); err != nil || !got.IsZero() {
+		t.Errorf("1e-30 应四舍五入为0，实际为%s, %v", got, err)
+	}
+	if got, _ := (txndedup.Money{Units: 6e18, Scale: 19}).Rescale(0); got.Units != 1 {
+		t.Errorf("0.6 应四舍五入为1，实际为%s", got)
+	}
+	if record.Amount.Cmp(txndedup.Money{Units: 1e18}) >= 0 || record.Amount.Cmp(txndedup.Money{}) <= 0 {
+		t.Error("小数位数相差过大时应仍能正确比较")
+	}
+
+	// math.MinInt64 取反会溢出：格式化保持正确的符号与数字，取绝对值返回错误
+	minimum := txndedup.Money{Units: math.MinInt64, Scale: 2}
+	if got := minimum.String(); got != "-92233720368547758.08" {
+		t.Errorf("最小金额应格式化为-92233720368547758.08，实际为%s", got)
+	}
+	if _, err := minimum.Abs(); !errors.Is(err, txndedup.ErrAmountOverflow) {
+		t.Errorf("最小金额取绝对值应返回ErrAmountOverflow，实际为%v", err)
+	}
+	if got, err := txndedup.NewMoney(-150, "USD").Abs(); err != nil || got.String() != "1.50" {
+		t.Errorf("-1.50 的绝对值应为1.50，实际为%s, %v", got, err)
+	}
+}
+
+func TestFingerprintGenerator_AmountPrecision(t *testing.T) {
+	config := txndedup.DefaultConfig().FingerprintConfig
+
+	// 默认按货币的小数位数：BHD 区分第三位小数，BTC 区分第八位小数，USD 四舍五入到分
+	generator := txndedup.NewFingerprintGenerator(config)
+	pairs := []struct {
+		currency string
+		a, b     txndedup.Money
+		same     bool
+	}{
+		{"BHD", txndedup.NewMoney(1234, "BHD"), txndedup.NewMoney(1231, "BHD"), false},
+		{"BTC", txndedup.NewMoney(100000001, "BTC"), txndedup.NewMoney(100000002, "BTC"), false},
+		{"USD", txndedup.Money{Units: 100001, Scale: 3}, txndedup.NewMoney(10000, "USD"), true},
+	}
+	for _, pair := range pairs {
+		a := &txndedup.TransactionRequest{Amount: pair.a, Currency: pair.currency}
+		b := &txndedup.TransactionRequest{Amount: pair.b, Currency: pair.currency}
+		if same := generator.Generate(a) == generator.Generate(b); same != pair.same {
+			t.Errorf("%s %s 与 %s 指纹相同应为%v", pair.currency, pair.a, pair.b, pair.same)
+		}
+	}
+
+	// 显式指定精度时覆盖货币的小数位数
+	config.AmountPrecision = 2
+	generator = txndedup.NewFingerprintGenerator(config)
+	a := &txndedup.TransactionRequest{Amount: txndedup.NewMoney(1234, "BHD"), Currency: "BHD"}
+	b := &txndedup.TransactionRequest{Amount: txndedup.NewMoney(1231, "BHD"), Currency: "BHD"}
+	if generator.Generate(a) != generator.Generate(b) {
+		t.Error("精度为2时1.234与1.231应生成相同指纹")
+	}
+
+	// 精度为0时精确匹配：100 与 100.00 相同，1.234 与 1.231 不同
+	config.AmountPrecision = 0
+	generator = txndedup.NewFingerprintGenerator(config)
+	c := &txndedup.TransactionRequest{Amount: txndedup.Money{Units: 100}, Currency: "JPY"}
+	d := &txndedup.TransactionRequest{Amount: txndedup.Money{Units: 10000, Scale: 2}, Currency: "JPY"}
+	if generator.Generate(c) != generator.Generate(d) {
+		t.Error("精确匹配时100与100.00应生成相同指纹")
+	}
+	e := &txndedup.TransactionRequest{Amount: txndedup.Money{Units: 1234, Scale: 3}, Currency: "USD"}
+	f := &txndedup.TransactionRequest{Amount: txndedup.Money{Units: 1231, Scale: 3}, Currency: "USD"}
+	if generator.Generate(e) == generator.Generate(f) {
+		t.Error("精确匹配时1.234与1.231不应生成相同指纹")
+	}
+}
+
+func TestDetector_AmountTolerance(t *testing.T) {
+	config := txndedup.DefaultConfig()
+	config.FingerprintConfig.AmountBucket = txndedup.NewMoney(100, "USD")
+	config.RiskRules = []txndedup.RiskRule{
+		{
+			Name:            "near_duplicate",
+			TimeWindow:      5 * time.Minute,
+			MaxCount:        0,
+			RiskLevel:       txndedup.RiskLevelMedium,
+			Action:          txndedup.ActionWarn,
+			CheckStatus:     []txndedup.TransactionStatus{txndedup.StatusSuccess},
+			AmountTolerance: txndedup.NewMoney(5, "USD"),
+		},
+	}
+
+	detector, err := txndedup.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detector.Close()
+
+	ctx := context.Background()
+
+	record := &txndedup.TransactionRecord{
+		FromAccount:  "test_001",
+		ToAccount:    "test_002",
+		Amount:       txndedup.NewMoney(10049, "USD"),
+		Currency:     "USD",
+		BusinessType: "transfer",
+		Status:       txndedup.StatusSuccess,
+	}
+	if err := detector.RecordTransaction(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		amount int64
+		action txndedup.SuggestionAction
+	}{
+		{10052, txndedup.ActionWarn},  // 跨越桶边界，差额0.03
+		{10044, txndedup.ActionWarn},  // 差额0.05
+		{10060, txndedup.ActionAllow}, // 差额超出容差
+		{20049, txndedup.ActionAllow}, // 不同的桶
+	}
+	for _, c := range cases {
+		request := &txndedup.TransactionRequest{
+			FromAccount:  record.FromAccount,
+			ToAccount:    record.ToAccount,
+			Amount:       txndedup.NewMoney(c.amount, "USD"),
+			Currency:     "USD",
+			BusinessType: "transfer",
+		}
+		result, err := detector.CheckDuplicate(ctx, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.SuggestionAction != c.action {
+			t.Errorf("金额%s应为%s，实际为%s", request.Amount, c.action, result.SuggestionAction)
+		}
+	}
+}
+
+func TestFingerprintGenerator_AccountCanonicalizers(t *testing.T) {
+	config := txndedup.DefaultConfig().FingerprintConfig
+	config.AccountCanonicalizers = []string{txndedup.CanonicalizerIBAN, txndedup.CanonicalizerCard, txndedup.CanonicalizerPhone}
+	generator := txndedup.NewFingerprintGenerator(config)
+
+	pairs := [][2]string{
+		{"6222 0000 1234", "622200001234"},
+		{"de89 3704 0044 0532 0130 00", "DE89370400440532013000"},
+		{"+86 138-0013-8000", "+8613800138000"},
+	}
+	for _, pair := range pairs {
+		a := &txndedup.TransactionRequest{FromAccount: "test_001", ToAccount: pair[0]}
+		b := &txndedup.TransactionRequest{FromAccount: "test_001", ToAccount: pair[1]}
+		if generator.Generate(a) != generator.Generate(b) {
+			t.Errorf("%q 与 %q 规范化后应生成相同指纹", pair[0], pair[1])
+		}
+	}
+}
+
+func TestDetector_PayeeSimilarity(t *testing.T) {
+	config := txndedup.DefaultConfig()
+	config.FingerprintConfig.IncludeToAccount = false
+	config.RiskRules = []txndedup.RiskRule{
+		{
+			Name:                "similar_payee",
+			TimeWindow:          5 * time.Minute,
+			MaxCount:            0,
+			RiskLevel:           txndedup.RiskLevelMedium,
+			Action:              txndedup.ActionWarn,
+			PayeeSimilarity:     0.9,
+			SimilarityAlgorithm: txndedup.SimilarityJaroWinkler,
+		},
+	}
+
+	detector, err := txndedup.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detector.Close()
+
+	ctx := context.Background()
+	record := &txndedup.TransactionRecord{
+		FromAccount:  "test_001",
+		ToAccount:    "6222000012345678",
+		Amount:       txndedup.NewMoney(5000, "USD"),
+		Currency:     "USD",
+		BusinessType: "transfer",
+		Status:       txndedup.StatusSuccess,
+	}
+	if err := detector.RecordTransaction(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]txndedup.SuggestionAction{
+		"6222000012345679": txndedup.ActionWarn,  // 末位输错
+		"9999888877776666": txndedup.ActionAllow, // 不同收款人
+	}
+	for payee, action := range cases {
+		request := &txndedup.TransactionRequest{
+			FromAccount:  record.FromAccount,
+			ToAccount:    payee,
+			Amount:       record.Amount,
+			Currency:     "USD",
+			BusinessType: "transfer",
+		}
+		result, err := detector.CheckDuplicate(ctx, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.SuggestionAction != action {
+			t.Errorf("收款账户%s应为%s，实际为%s", payee, action, result.SuggestionAction)
+		}
+	}
+}
+
+func TestExpression(t *testing.T) {
+	request := &txndedup.TransactionRequest{
+		Amount:  txndedup.NewMoney(1500000, "USD"),
+		Channel: "web",
+		Extra:   map[string]interface{}{"order_id": "o_001", "risk_score": 80},
+	}
+	similarTx := []*txndedup.TransactionRecord{
+		{Channel: "app", Amount: txndedup.NewMoney(1500000, "USD"), CreatedAt: time.Now()},
+		{Channel: "web", Amount: txndedup.NewMoney(1000, "USD"), CreatedAt: time.Now()},
+	}
+
+	cases := map[string]bool{
+		`amount > 10000 && count(similar, s.channel != req.channel) >= 1`:   true,
+		`count(similar) == 2 && all(similar, s.age_seconds < 60)`:           true,
+		`exists(similar, s.amount == amount && s.channel == "web")`:         false,
+		`sum(similar, s.amount) > 15000`:                                    true,
+		`channel in ["web", "h5"] && extra.risk_score >= 80`:                true,
+		`extra["order_id"] == "o_001" && !starts_with(lower(channel), "a")`: true,
+		`extra.missing == "x"`: false,
+	}
+	for source, want := range cases {
+		expr, err := txndedup.CompileExpression(source)
+		if err != nil {
+			t.Errorf("%s: %v", source, err)
+			continue
+		}
+		got, err := expr.Eval(request, similarTx)
+		if err != nil {
+			t.Errorf("%s: %v", source, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: 应为%v，实际为%v", source, want, got)
+		}
+	}
+
+	// 超出 int 范围的下标返回错误而不是 panic
+	for _, source := range []string{`similar[10000000000000000000].amount > 0`, `similar[-10000000000000000000].amount > 0`} {
+		expr, err := txndedup.CompileExpression(source)
+		if err != nil {
+			t.Fatalf("%s: %v", source, err)
+		}
+		if _, err := expr.Eval(request, similarTx); err == nil {
+			t.Errorf("%s: 下标越界应返回错误", source)
+		}
+	}
+
+	// 语法与类型错误在编译期报告
+	invalid := []string{
+		`amount >`,
+		`amount > "100"`,
+		`count(similar, s.unknown == 1) > 0`,
+		`channel + 1`,
+		`amount`,
+		`undefined_var == 1`,
+	}
+	for _, source := range invalid {
+		if _, err := txndedup.CompileExpression(source); err == nil {
+			t.Errorf("%s: 应编译失败", source)
+		}
+	}
+}
+
+func TestDetector_RuleCondition(t *testing.T) {
+	config := txndedup.DefaultConfig()
+	config.RiskRules = []txndedup.RiskRule{
+		{
+			Name:       "cross_channel_large",
+			TimeWindow: 5 * time.Minute,
+			MaxCount:   0,
+			RiskLevel:  txndedup.RiskLevelHigh,
+			Action:     txndedup.ActionBlock,
+			Condition:  `amount > 10000 && count(similar, s.channel != req.channel) >= 1`,
+		},
+	}
+
+	detector, err := txndedup.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detector.Close()
+
+	ctx := context.Background()
+	record := &txndedup.TransactionRecord{
+		FromAccount:  "test_001",
+		ToAccount:    "test_002",
+		Amount:       txndedup.NewMoney(2000000, "USD"),
+		Currency:     "USD",
+		BusinessType: "transfer",
+		Channel:      "app",
+		Status:       txndedup.StatusSuccess,
+	}
+	if err := detector.RecordTransaction(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]txndedup.SuggestionAction{
+		"web": txndedup.ActionBlock,
+		"app": txndedup.ActionAllow,
+	}
+	for channel, action := range cases {
+		request := &txndedup.TransactionRequest{
+			FromAccount:  record.FromAccount,
+			ToAccount:    record.ToAccount,
+			Amount:       record.Amount,
+			Currency:     "USD",
+			BusinessType: "transfer",
+			Channel:      channel,
+		}
+		result, err := detector.CheckDuplicate(ctx, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.SuggestionAction != action {
+			t.Errorf("渠道%s应为%s，实际为%s", channel, action, result.SuggestionAction)
+		}
+	}
+
+	config.RiskRules[0].Condition = `amount > "x"`
+	if err := config.Validate(); !errors.Is(err, txndedup.ErrInvalidRiskRule) {
+		t.Errorf("无效条件应返回ErrInvalidRiskRule，实际为%v", err)
+	}
+}
+
+func TestDetector_Scoring(t *testing.T) {
+	config := txndedup.DefaultConfig()
+	config.Scoring.Enabled = true
+
+	detector, err := txndedup.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detector.Close()
+
+	ctx := context.Background()
+	request := &txndedup.TransactionRequest{
+		FromAccount:  "test_001",
+		ToAccount:    "test_002",
+		Amount:       txndedup.NewMoney(10000, "USD"),
+		Currency:     "USD",
+		BusinessType: "transfer",
+		UserIP:       "10.0.0.1",
+		DeviceID:     "device_1",
+	}
+
+	// 两笔成功交易：rapid_duplicate(60) + frequent_duplicate(40) 同时命中
+	for i := 0; i < 2; i++ {
+		record := &txndedup.TransactionRecord{
+			FromAccount:  request.FromAccount,
+			ToAccount:    request.ToAccount,
+			Amount:       request.Amount,
+			Currency:     request.Currency,
+			BusinessType: request.BusinessType,
+			UserIP:       request.UserIP,
+			DeviceID:     request.DeviceID,
+			Status:       txndedup.StatusSuccess,
+		}
+		if err := detector.RecordTransaction(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := detector.CheckDuplicate(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Score != 100 {
+		t.Errorf("总分应为100，实际为%v", result.Score)
+	}
+	if len(result.MatchedRules) != 2 || result.MatchedRules[0].Name != "rapid_duplicate" || result.MatchedRules[1].Name != "frequent_duplicate" {
+		t.Errorf("命中规则不符: %+v", result.MatchedRules)
+	}
+	if result.RiskLevel != txndedup.RiskLevelHigh || result.SuggestionAction != txndedup.ActionBlock {
+		t.Errorf("总分100应为HIGH/BLOCK，实际为%s/%s", result.RiskLevel, result.SuggestionAction)
+	}
+
+	// 不同IP和设备只命中 frequent_duplicate(40)
+	request.UserIP = "10.0.0.2"
+	request.DeviceID = "device_2"
+	result, err = detector.CheckDuplicate(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Score != 40 || result.RiskLevel != txndedup.RiskLevelMedium || result.SuggestionAction != txndedup.ActionWarn {
+		t.Errorf("应为40分MEDIUM/WARN，实际为%v分%s/%s", result.Score, result.RiskLevel, result.SuggestionAction)
+	}
+
+	// 首条命中模式不计分，命中规则的分值为0
+	ruleSet := detector.RuleSet()
+	ruleSet.Scoring.Enabled = false
+	if err := detector.UpdateRules(ruleSet); err != nil {
+		t.Fatal(err)
+	}
+	result, err = detector.CheckDuplicate(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.MatchedRules) != 1 || result.MatchedRules[0].Score != 0 || result.Score != 0 {
+		t.Errorf("首条命中模式下分值应为0，实际为%v分%+v", result.Score, result.MatchedRules)
+	}
+}
+
+func TestDetector_Explain(t *testing.T) {
+	detector, err := txndedup.New(txndedup.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detector.Close()
+
+	ctx := context.Background()
+	request := &txndedup.TransactionRequest{
+		FromAccount:  "test_001",
+		ToAccount:    "test_002",
+		Amount:       txndedup.NewMoney(10000, "USD"),
+		Currency:     "USD",
+		BusinessType: "transfer",
+		UserIP:       "10.0.0.1",
+		DeviceID:     "device_1",
+	}
+
+	record := &txndedup.TransactionRecord{
+		FromAccount:  request.FromAccount,
+		ToAccount:    request.ToAccount,
+		Amount:       request.Amount,
+		Currency:     request.Currency,
+		BusinessType: request.BusinessType,
+		UserIP:       "10.0.0.2",
+		DeviceID:     request.DeviceID,
+		Status:       txndedup.StatusSuccess,
+	}
+	if err := detector.RecordTransaction(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := detector.CheckDuplicate(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Explanation != nil {
+		t.Error("未启用Explain时不应返回评估过程")
+	}
+
+	result, err = detector.CheckDuplicate(ctx, request, txndedup.WithExplain())
+	if err != nil {
+		t.Fatal(err)
+	}
+	explanation := result.Explanation
+	if explanation == nil || len(explanation.Rules) != 4 || explanation.Candidates != 1 {
+		t.Fatalf("应返回4条规则的评估过程: %+v", explanation)
+	}
+
+	// rapid_duplicate 在IP过滤后无剩余交易
+	rapid := explanation.Rules[1]
+	if rapid.Rule != "rapid_duplicate" || rapid.Matched {
+		t.Errorf("rapid_duplicate 不应命中: %+v", rapid)
+	}
+	want := []txndedup.FilterCount{
+		{Filter: txndedup.FilterWindow, Remaining: 1},
+		{Filter: txndedup.FilterStatus, Remaining: 1},
+		{Filter: txndedup.FilterSameIP, Remaining: 0},
+		{Filter: txndedup.FilterSameDevice, Remaining: 0},
+	}
+	if len(rapid.Filters) != len(want) {
+		t.Fatalf("过滤计数不符: %+v", rapid.Filters)
+	}
+	for i := range want {
+		if rapid.Filters[i] != want[i] {
+			t.Errorf("过滤计数不符: %+v", rapid.Filters)
+			break
+		}
+	}
+
+	// frequent_duplicate 只有一笔交易，未超过 MaxCount
+	frequent := explanation.Rules[2]
+	if frequent.Matched || len(frequent.MatchedTransactionIDs) != 1 || frequent.MatchedTransactionIDs[0] != record.TransactionID {
+		t.Errorf("frequent_duplicate 评估过程不符: %+v", frequent)
+	}
+	if frequent.Reason == "" {
+		t.Error("应记录未命中原因")
+	}
+}
+
+func TestDetector_LocalizedMessages(t *testing.T) {
+	config := txndedup.DefaultConfig()
+	config.RiskRules = append(config.RiskRules, txndedup.RiskRule{
+		Name:        "custom_duplicate",
+		TimeWindow:  5 * time.Minute,
+		MaxCount:    0,
+		RiskLevel:   txndedup.RiskLevelMedium,
+		Action:      txndedup.ActionWarn,
+		CheckStatus: []txndedup.TransactionStatus{txndedup.StatusFailed},
+	})
+	config.MessageCatalog = txndedup.MapCatalog{
+		"en": {"custom_duplicate": "{{len .Matched}} failed attempt(s) to {{.Request.ToAccount}}"},
+	}
+
+	detector, err := txndedup.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detector.Close()
+
+	ctx := context.Background()
+	request := &txndedup.TransactionRequest{
+		FromAccount:  "test_001",
+		ToAccount:    "test_002",
+		Amount:       txndedup.NewMoney(10000, "USD"),
+		Currency:     "USD",
+		BusinessType: "transfer",
+	}
+
+	record := &txndedup.TransactionRecord{
+		FromAccount:  request.FromAccount,
+		ToAccount:    request.ToAccount,
+		Amount:       request.Amount,
+		Currency:     request.Currency,
+		BusinessType: request.BusinessType,
+		Status:       txndedup.StatusPending,
+	}
+	if err := detector.RecordTransaction(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ctx    context.Context
+		locale string
+		want   string
+	}{
+		{ctx, "", "检测到您有一笔相同的交易正在处理中，请勿重复提交"},
+		{ctx, "en-US", "An identical transaction is already being processed. Please do not submit it again."},
+		{txndedup.WithLocale(ctx, "ja"), "", "同じ取引が処理中です。重複して送信しないでください。"},
+		{txndedup.WithLocale(ctx, "ja"), "zh_TW", "检测到您有一笔相同的交易正在处理中，请勿重复提交"},
+		{ctx, "fr", "检测到您有一笔相同的交易正在处理中，请勿重复提交"},
+	}
+	for _, c := range cases {
+		request.Locale = c.locale
+		result, err := detector.CheckDuplicate(c.ctx, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Message != c.want {
+			t.Errorf("语言%q应为%q，实际为%q", c.locale, c.want, result.Message)
+		}
+	}
+
+	// 自定义规则：自定义目录中的英文模板，其他语言回退到通用提示
+	if err := detector.UpdateTransactionStatus(ctx, record.TransactionID, txndedup.StatusFailed); err != nil {
+		t.Fatal(err)
+	}
+	request.Locale = "en"
+	result, err := detector.CheckDuplicate(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Message != "1 failed attempt(s) to test_002" {
+		t.Errorf("自定义模板渲染结果不符: %q", result.Message)
+	}
+	request.Locale = "ja"
+	if result, err = detector.CheckDuplicate(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	if result.Message != "類似の取引が検出されました。" {
+		t.Errorf("应回退到通用提示，实际为%q", result.Message)
+	}
+
+	config.RiskRules[len(config.RiskRules)-1].Message = "{{.Request.ToAccount"
+	if err := config.Validate(); !errors.Is(err, txndedup.ErrInvalidRiskRule) {
+		t.Errorf("无效模板应返回ErrInvalidRiskRule，实际为%v", err)
+	}
+}
+
+func TestDetector_UpdateRules(t *testing.T) {
+	detector, err := txndedup.New(txndedup.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detector.Close()
+
+	ctx := context.Background()
+	request := &txndedup.TransactionRequest{
+		FromAccount:  "test_001",
+		ToAccount:    "test_002",
+		Amount:       txndedup.NewMoney(10000, "USD"),
+		Currency:     "USD",
+		BusinessType: "transfer",
+		UserIP:       "10.0.0.1",
+	}
+	record := &txndedup.TransactionRecord{
+		FromAccount:  request.FromAccount,
+		ToAccount:    request.ToAccount,
+		Amount:       request.Amount,
+		Currency:     request.Currency,
+		BusinessType: request.BusinessType,
+		UserIP:       "10.0.0.2",
+		Status:       txndedup.StatusSuccess,
+	}
+	if err := detector.RecordTransaction(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := detector.CheckDuplicate(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initialVersion := result.RulesVersion
+	if initialVersion == "" || initialVersion != detector.RuleSet().Version {
+		t.Fatalf("结果应包含当前规则版本，实际为%q", initialVersion)
+	}
+	if result.SuggestionAction != txndedup.ActionAllow {
+		t.Fatalf("默认规则应为ALLOW，实际为%s", result.SuggestionAction)
+	}
+
+	// 从规则文件加载并监听变更
+	writeRules := func(path, version string, action txndedup.SuggestionAction) {
+		ruleSet := detector.RuleSet()
+		ruleSet.Version = version
+		ruleSet.RiskRules = []txndedup.RiskRule{{
+			Name:       "any_duplicate",
+			TimeWindow: 5 * time.Minute,
+			RiskLevel:  txndedup.RiskLevelHigh,
+			Action:     action,
+		}}
+		data, err := json.Marshal(ruleSet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeRules(path, "v1", txndedup.ActionWarn)
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := detector.WatchRuleFile(watchCtx, path, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = detector.CheckDuplicate(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RulesVersion != "v1" || result.SuggestionAction != txndedup.ActionWarn {
+		t.Errorf("加载v1后应为WARN，实际为%s/%s", result.RulesVersion, result.SuggestionAction)
+	}
+
+	writeRules(path, "v2-longer", txndedup.ActionBlock)
+	deadline := time.Now().Add(2 * time.Second)
+	for detector.RuleSet().Version != "v2-longer" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	result, err = detector.CheckDuplicate(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RulesVersion != "v2-longer" || result.SuggestionAction != txndedup.ActionBlock {
+		t.Errorf("文件变更后应为BLOCK，实际为%s/%s", result.RulesVersion, result.SuggestionAction)
+	}
+
+	// 校验失败时保留原规则
+	invalid := detector.RuleSet()
+	invalid.RiskRules[0].Condition = `amount >`
+	if err := detector.UpdateRules(invalid); !errors.Is(err, txndedup.ErrInvalidRiskRule) {
+		t.Errorf("无效规则应返回ErrInvalidRiskRule，实际为%v", err)
+	}
+	if version := detector.RuleSet().Version; version != "v2-longer" {
+		t.Errorf("校验失败后版本应保持不变，实际为%q", version)
+	}
+
+	// 未指定版本时按内容生成
+	ruleSet := detector.RuleSet()
+	ruleSet.Version = ""
+	if err := detector.UpdateRules(ruleSet); err != nil {
+		t.Fatal(err)
+	}
+	if version := detector.RuleSet().Version; version == "" || version == "v2-longer" {
+		t.Errorf("应按内容生成版本号，实际为%q", version)
+	}
+
+	// 自定义指纹策略不随规则热更新，修改指纹配置应返回错误而不是静默忽略
+	custom := txndedup.DefaultConfig()
+	custom.Fingerprinter = txndedup.NewFingerprintGenerator(custom.FingerprintConfig)
+	customDetector, err := txndedup.New(custom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer customDetector.Close()
+
+	ruleSet = customDetector.RuleSet()
+	ruleSet.FingerprintConfig.IncludeChannel = true
+	if err := customDetector.UpdateRules(ruleSet); !errors.Is(err, txndedup.ErrInvalidFingerprintConfig) {
+		t.Errorf("自定义指纹策略下修改指纹配置应返回ErrInvalidFingerprintConfig，实际为%v", err)
+	}
+	if customDetector.RuleSet().FingerprintConfig.IncludeChannel {
+		t.Error("更新失败后指纹配置应保持不变")
+	}
+
+	// 未指定指纹配置时沿用当前配置
+	ruleSet.FingerprintConfig = txndedup.FingerprintConfig{}
+	ruleSet.Version = "custom-v2"
+	if err := customDetector.UpdateRules(ruleSet); err != nil {
+		t.Fatal(err)
+	}
+	if current := customDetector.RuleSet(); current.Version != "custom-v2" || !current.FingerprintConfig.IncludeAmount {
+		t.Errorf("应只更新规则并沿用当前指纹配置，实际为%+v", current.FingerprintConfig)
+	}
+}
+
+func TestDetector_UpdateRulesWithoutFingerprintConfig(t *testing.T) {
+	detector, err := txndedup.New(txndedup.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detector.Close()
+
+	// 规则文件只包含风险规则，省略指纹配置
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := `{"version":"rules-only","risk_rules":[{"name":"pending_duplicate","time_window":"5m","check_status":["PENDING"],"risk_level":"HIGH","action":"BLOCK"}]}`
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := detector.WatchRuleFile(ctx, path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if current := detector.RuleSet(); current.Version != "rules-only" || !current.FingerprintConfig.IncludeFromAccount {
+		t.Fatalf("应沿用当前指纹配置，实际为%+v", current.FingerprintConfig)
+	}
+
+	pending := &txndedup.TransactionRequest{
+		FromAccount:  "alice",
+		ToAccount:    "bob",
+		Amount:       txndedup.NewMoney(10000, "USD"),
+		Currency:     "USD",
+		BusinessType: "transfer",
+	}
+	if result, err := detector.CheckAndReserve(ctx, pending); err != nil || result.IsDuplicate {
+		t.Fatalf("首次预留不应重复，实际为%+v, %v", result, err)
+	}
+
+	unrelated := &txndedup.TransactionRequest{
+		FromAccount:  "carol",
+		ToAccount:    "dave",
+		Amount:       txndedup.NewMoney(5000, "EUR"),
+		Currency:     "EUR",
+		BusinessType: "transfer",
+	}
+	result, err := detector.CheckDuplicate(ctx, unrelated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.IsDuplicate || result.SuggestionAction != txndedup.ActionAllow {
+		t.Errorf("无关请求不应被拦截，实际为%s/%v", result.SuggestionAction, result.IsDuplicate)
+	}
+
+	// 不含任何字段的指纹配置校验失败
+	config := txndedup.DefaultConfig()
+	config.FingerprintConfig = txndedup.FingerprintConfig{AmountPrecision: 2}
+	if err := config.Validate(); !errors.Is(err, txndedup.ErrInvalidFingerprintConfig) {
+		t.Errorf("不含任何字段的指纹配置应返回ErrInvalidFingerprintConfig，实际为%v", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlPath := filepath.Join(dir, "config.yaml")
+	yamlConfig := `
+time_window: 10m
+cleanup_interval: 30s
+log_level: warning
+redis_config:
+  address: localhost:6379
+  dial_timeout: 2s
+risk_rules:
+  - name: pending
+    time_window: 10m
+    max_count: 0
+    risk_level: HIGH
+    action: BLOCK
+    check_status: [PENDING]
+  - name: recent
+    time_window: 90s
+    max_count: 1
+    risk_level: LOW
+    action: WARN
+`
+	if err := os.WriteFile(yamlPath, []byte(yamlConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := txndedup.LoadConfig(yamlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TimeWindow != 10*time.Minute || config.CleanupInterval != 30*time.Second {
+		t.Errorf("时间字段解析错误: %v %v", config.TimeWindow, config.CleanupInterval)
+	}
+	if config.RedisConfig == nil || config.RedisConfig.DialTimeout != 2*time.Second {
+		t.Errorf("Redis配置解析错误: %+v", config.RedisConfig)
+	}
+	if len(config.RiskRules) != 2 || config.RiskRules[1].TimeWindow != 90*time.Second {
+		t.Fatalf("规则解析错误: %+v", config.RiskRules)
+	}
+	if len(config.RiskRules[1].CheckStatus) != 0 {
+		t.Errorf("规则不应残留默认规则的字段: %+v", config.RiskRules[1])
+	}
+	if config.WorkerPoolSize != 10 {
+		t.Errorf("未配置的字段应保留默认值，实际为%d", config.WorkerPoolSize)
+	}
+
+	// JSON 往返
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"time_window":"10m0s"`) {
+		t.Errorf("时间字段应序列化为字符串: %s", data)
+	}
+	jsonPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(jsonPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := txndedup.LoadConfig(jsonPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// 未知字段
+	if err := os.WriteFile(jsonPath, []byte(`{"time_windw": "5m"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := txndedup.LoadConfig(jsonPath); err == nil {
+		t.Error("未知字段应返回错误")
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	config := txndedup.DefaultConfig()
+	config.TimeWindow = 10 * time.Minute
+	config.WorkerPoolSize = 0
+	config.RiskRules = []txndedup.RiskRule{
+		{Name: "a", TimeWindow: time.Minute, RiskLevel: txndedup.RiskLevelHigh, Action: txndedup.ActionBlock},
+		{Name: "a", TimeWindow: time.Minute, RiskLevel: "CRITICAL", Action: txndedup.ActionBlock},
+		{Name: "b", TimeWindow: time.Hour, MaxCount: -1, RiskLevel: txndedup.RiskLevelLow, Action: "DENY"},
+	}
+
+	err := config.Validate()
+	if !errors.Is(err, txndedup.ErrInvalidConfig) || !errors.Is(err, txndedup.ErrInvalidRiskRule) {
+		t.Fatalf("应同时返回配置和规则错误，实际为%v", err)
+	}
+	for _, want := range []string{"worker_pool_size", "duplicate rule name", `invalid risk level "CRITICAL"`, `invalid action "DENY"`, "max_count", "exceeds global time_window"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("错误信息应包含%q: %v", want, err)
+		}
+	}
+
+	if err := txndedup.DefaultConfig().Validate(); err != nil {
+		t.Errorf("默认配置应通过校验: %v", err)
+	}
+}
+
+func TestRedisConfig_Deployment(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	// 集群模式下同一指纹的记录key与版本key使用哈希标签
+	storage, err := txndedup.NewRedisStorage(&txndedup.RedisConfig{ClusterAddresses: []string{mr.Addr()}, KeyPrefix: "slot:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	ctx := context.Background()
+	record := &txndedup.TransactionRecord{TransactionID: "tx_001", Fingerprint: "fp", Status: txndedup.StatusPending, CreatedAt: time.Now()}
+	if err := storage.Store(ctx, "fp", record); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"slot:tx:{fp}", "slot:ver:{fp}", "slot:txid:tx_001"} {
+		if !mr.Exists(key) {
+			t.Errorf("应存在key %s，实际为%v", key, mr.Keys())
+		}
+	}
+	if _, err := storage.Get(ctx, "tx_001"); err != nil {
+		t.Error(err)
+	}
+
+	// TLS证书文件无效时创建失败
+	_, err = txndedup.NewRedisStorage(&txndedup.RedisConfig{
+		Address: mr.Addr(),
+		TLS:     &txndedup.RedisTLSConfig{Enabled: true, CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+	})
+	if err == nil {
+		t.Error("CA文件不存在时应返回错误")
+	}
+
+	config := txndedup.DefaultConfig()
+	config.StorageType = "redis"
+	config.RedisConfig = &txndedup.RedisConfig{
+		ClusterAddresses:  []string{"127.0.0.1:7000"},
+		MasterName:        "mymaster",
+		SentinelAddresses: []string{"127.0.0.1:26379"},
+		TLS:               &txndedup.RedisTLSConfig{Enabled: true, CertFile: "client.pem"},
+	}
+	err = config.Validate()
+	for _, want := range []string{"mutually exclusive", "cert_file and key_file"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("错误信息应包含%q: %v", want, err)
+		}
+	}
+}
+
+func TestDetector_RuleWindowHorizon(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	configs := map[string]*txndedup.Config{
+		"memory": txndedup.DefaultConfig(),
+		"redis":  txndedup.DefaultConfig(),
+	}
+	configs["redis"].StorageType = "redis"
+	configs["redis"].RedisConfig = &txndedup.RedisConfig{Address: mr.Addr(), KeyPrefix: "horizon:"}
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			detector, err := txndedup.New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer detector.Close()
+
+			ctx := context.Background()
+			request := &txndedup.TransactionRequest{
+				FromAccount:  "test_001",
+				ToAccount:    "test_002",
+				Amount:       txndedup.NewMoney(5000, "USD"),
+				Currency:     "USD",
+				BusinessType: "transfer",
+			}
+
+			// 20分钟前的PENDING交易仍在 pending_duplicate 的30分钟窗口内
+			record := &txndedup.TransactionRecord{
+				FromAccount:  request.FromAccount,
+				ToAccount:    request.ToAccount,
+				Amount:       request.Amount,
+				Currency:     request.Currency,
+				BusinessType: request.BusinessType,
+				Status:       txndedup.StatusPending,
+				CreatedAt:    time.Now().Add(-20 * time.Minute),
+			}
+			if err := detector.RecordTransaction(ctx, record); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := detector.CheckDuplicate(ctx, request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.SuggestionAction != txndedup.ActionBlock {
+				t.Errorf("应命中 pending_duplicate，实际为%s", result.SuggestionAction)
+			}
+
+			// 只保留5分钟窗口的规则后不再查询更早的记录
+			ruleSet := detector.RuleSet()
+			ruleSet.RiskRules = ruleSet.RiskRules[3:]
+			if err := detector.UpdateRules(ruleSet); err != nil {
+				t.Fatal(err)
+			}
+			result, err = detector.CheckDuplicate(ctx, request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.IsDuplicate {
+				t.Errorf("查询范围应缩小为5分钟，实际返回%d笔相似交易", len(result.SimilarTransactions))
+			}
+
+			if name == "redis" {
+				ttl := mr.TTL("horizon:tx:" + record.Fingerprint)
+				if ttl != config.Retention() {
+					t.Errorf("Redis过期时间应为%v，实际为%v", config.Retention(), ttl)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisStorage_ScoresAndTrim(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	config := txndedup.DefaultConfig()
+	config.MaxRecordsPerKey = 3
+	config.StorageType = "redis"
+	config.RedisConfig = &txndedup.RedisConfig{Address: mr.Addr(), KeyPrefix: "trim:", RecordTTL: 10 * time.Minute}
+
+	storage, err := (&txndedup.StorageFactory{}).NewStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	ctx := context.Background()
+	base := time.Now().Add(-time.Minute)
+	for i := 0; i < 5; i++ {
+		record := &txndedup.TransactionRecord{
+			TransactionID: fmt.Sprintf("tx_%d", i),
+			Status:        txndedup.StatusSuccess,
+			CreatedAt:     base.Add(time.Duration(i) * time.Millisecond),
+		}
+		if err := storage.Store(ctx, "fp", record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := storage.GetSimilar(ctx, "fp", 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].TransactionID != "tx_2" || records[2].TransactionID != "tx_4" {
+		t.Fatalf("应只保留最新的3笔记录，实际为%d笔", len(records))
+	}
+	if ttl := mr.TTL("trim:tx:fp"); ttl != 10*time.Minute {
+		t.Errorf("过期时间应为RecordTTL，实际为%v", ttl)
+	}
+
+	// 旧版本秒级score的记录迁移后可见
+	legacy, err := json.Marshal(&txndedup.TransactionRecord{TransactionID: "tx_legacy", CreatedAt: base})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mr.ZAdd("trim:tx:legacy", float64(base.Unix()), string(legacy)); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ := storage.GetSimilar(ctx, "legacy", 5*time.Minute); len(records) != 0 {
+		t.Fatal("未迁移的秒级score不应在毫秒级查询中可见")
+	}
+
+	migrated, err := storage.(*txndedup.RedisStorage).MigrateScores(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 1 {
+		t.Errorf("应迁移1笔记录，实际为%d", migrated)
+	}
+	if records, _ := storage.GetSimilar(ctx, "legacy", 5*time.Minute); len(records) != 1 {
+		t.Error("迁移后的记录应可见")
+	}
+}
+
+func TestRedisStorage_ReservePipelineError(t *testing.T) {
+	mr := miniredis.RunT(t)
+	storage, err := txndedup.NewRedisStorage(&txndedup.RedisConfig{Address: mr.Addr(), KeyPrefix: "pipe:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	// fp_a 的版本key不存在，管道的第一个错误为 redis.Nil；fp_b 的记录key类型错误，读取失败
+	if err := mr.Set("pipe:tx:fp_b", "not-a-zset"); err != nil {
+		t.Fatal(err)
+	}
+
+	decided := false
+	err = storage.Reserve(context.Background(), []string{"fp_a", "fp_b"}, time.Minute, func([]*txndedup.TransactionRecord) (*txndedup.TransactionRecord, error) {
+		decided = true
+		return &txndedup.TransactionRecord{TransactionID: "tx_1", CreatedAt: time.Now()}, nil
+	})
+	if err == nil {
+		t.Error("读取相似交易失败时应返回错误")
+	}
+	if decided {
+		t.Error("读取不完整时不应基于部分数据判定")
+	}
+}
+
+func TestRedisStorage_CleanupExpiryIndex(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	configs := map[string]*txndedup.RedisConfig{
+		"single":  {Address: mr.Addr(), KeyPrefix: "expiry:"},
+		"cluster": {ClusterAddresses: []string{mr.Addr()}, KeyPrefix: "expiry_cluster:"},
+	}
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			storage, err := txndedup.NewRedisStorage(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.Close()
+
+			ctx := context.Background()
+			now := time.Now()
+
+			// 600个过期指纹超过单批数量，另有1个指纹同时包含过期与未过期的记录
+			for i := 0; i < 600; i++ {
+				record := &txndedup.TransactionRecord{TransactionID: fmt.Sprintf("old_%d", i), CreatedAt: now.Add(-time.Hour)}
+				if err := storage.Store(ctx, fmt.Sprintf("fp_%d", i), record); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// 先写入新记录再写入补录的旧记录，最后写入时间不应回退
+			for i, createdAt := range []time.Time{now, now.Add(-time.Hour)} {
+				record := &txndedup.TransactionRecord{TransactionID: fmt.Sprintf("live_%d", i), CreatedAt: createdAt}
+				if err := storage.Store(ctx, "live", record); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// 与过期索引无关的key不应被访问
+			mr.Set(config.KeyPrefix+"unrelated", "value")
+
+			if err := storage.Cleanup(ctx, 30*time.Minute); err != nil {
+				t.Fatal(err)
+			}
+
+			records, err := storage.GetSimilar(ctx, "fp_0", 2*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 0 {
+				t.Errorf("过期指纹的记录应被清理，实际剩余%d笔", len(records))
+			}
+
+			// 仍有新记录的指纹不在本次清理范围内，其中的旧记录在下次写入时删除
+			records, err = storage.GetSimilar(ctx, "live", 30*time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 || records[0].TransactionID != "live_0" {
+				t.Errorf("未过期的记录应保留，实际为%d笔", len(records))
+			}
+
+			members, err := mr.ZMembers(config.KeyPrefix + "expiry")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(members) != 1 || members[0] != "live" {
+				t.Errorf("过期索引应只保留live，实际为%d个指纹", len(members))
+			}
+			if score, _ := mr.ZScore(config.KeyPrefix+"expiry", "live"); int64(score) != now.UnixMilli() {
+				t.Errorf("最后写入时间应为最新记录的时间%d，实际为%d", now.UnixMilli(), int64(score))
+			}
+		})
+	}
+}
+
+// sqliteConfig 返回使用临时SQLite文件的SQL存储配置
+// backendConfigs 返回各存储后端的配置，Redis 单节点与集群模式共用一个 miniredis，key 前缀分别为 prefix 与 "cluster:"+prefix
+func backendConfigs(t *testing.T, prefix string) map[string]*txndedup.Config {
+	mr := miniredis.RunT(t)
+
+	configs := map[string]*txndedup.Config{
+		"memory":        txndedup.DefaultConfig(),
+		"redis":         txndedup.DefaultConfig(),
+		"redis_cluster": txndedup.DefaultConfig(),
+		"sql":           sqliteConfig(t),
+		"bolt":          boltConfig(t),
+	}
+	configs["redis"].StorageType = "redis"
+	configs["redis"].RedisConfig = &txndedup.RedisConfig{Address: mr.Addr(), KeyPrefix: prefix}
+	configs["redis_cluster"].StorageType = "redis"
+	configs["redis_cluster"].RedisConfig = &txndedup.RedisConfig{ClusterAddresses: []string{mr.Addr()}, KeyPrefix: "cluster:" + prefix}
+	return configs
+}
+
+func sqliteConfig(t *testing.T) *txndedup.Config {
+	config := txndedup.DefaultConfig()
+	config.StorageType = "sql"
+	config.SQLConfig = &txndedup.SQLConfig{
+		Driver: "sqlite3",
+		DSN:    filepath.Join(t.TempDir(), "txndedup.db") + "?_busy_timeout=5000",
+	}
+	return config
+}
+
+func TestSQLStorage(t *testing.T) {
+	config := sqliteConfig(t)
+	config.SQLConfig.CleanupBatch = 10
+
+	storage, err := txndedup.NewSQLStorage(config.SQLConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	ctx := context.Background()
+
+	// 重复执行迁移不报错
+	if err := storage.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 25; i++ {
+		record := &txndedup.TransactionRecord{
+			TransactionID:  fmt.Sprintf("old_%d", i),
+			IdempotencyKey: fmt.Sprintf("key_%d", i),
+			Status:         txndedup.StatusSuccess,
+			CreatedAt:      now.Add(-2 * time.Hour),
+		}
+		if err := storage.Store(ctx, "fp", record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record := &txndedup.TransactionRecord{
+		TransactionID: "tx_001",
+		Fingerprint:   "fp",
+		Fingerprints:  []string{"fp", "fp_order"},
+		Status:        txndedup.StatusPending,
+		CreatedAt:     now,
+	}
+	for _, fingerprint := range record.Fingerprints {
+		if err := storage.Store(ctx, fingerprint, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := storage.GetSimilar(ctx, "fp", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].TransactionID != "tx_001" {
+		t.Fatalf("时间窗口内应只有tx_001，实际为%d笔", len(records))
+	}
+
+	// 状态更新同步到全部指纹
+	if _, err := storage.Update(ctx, "tx_001", func(r *txndedup.TransactionRecord) { r.Status = txndedup.StatusSuccess }); err != nil {
+		t.Fatal(err)
+	}
+	records, err = storage.GetSimilar(ctx, "fp_order", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Status != txndedup.StatusSuccess {
+		t.Error("其他指纹下的记录也应更新状态")
+	}
+	if _, err := storage.Update(ctx, "missing", func(*txndedup.TransactionRecord) {}); !errors.Is(err, txndedup.ErrTransactionNotFound) {
+		t.Errorf("应返回ErrTransactionNotFound，实际为%v", err)
+	}
+
+	// 分批清理过期记录及其幂等键
+	if err := storage.Cleanup(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Get(ctx, "old_0"); !errors.Is(err, txndedup.ErrTransactionNotFound) {
+		t.Errorf("过期记录应被清理，实际为%v", err)
+	}
+	if _, err := storage.GetByIdempotencyKey(ctx, "key_24"); !errors.Is(err, txndedup.ErrTransactionNotFound) {
+		t.Errorf("过期幂等键应被清理，实际为%v", err)
+	}
+	if _, err := storage.Get(ctx, "tx_001"); err != nil {
+		t.Errorf("未过期的记录应保留: %v", err)
+	}
+}
+
+// boltConfig 返回使用临时文件的磁盘存储配置
+func boltConfig(t *testing.T) *txndedup.Config {
+	config := txndedup.DefaultConfig()
+	config.StorageType = "bolt"
+	config.BoltConfig = &txndedup.BoltConfig{Path: filepath.Join(t.TempDir(), "txndedup.bolt")}
+	return config
+}
+
+func TestBoltStorage_Recovery(t *testing.T) {
+	config := boltConfig(t)
+	config.MaxRecordsPerKey = 3
+	config.BoltConfig.FsyncPolicy = txndedup.FsyncInterval
+	config.BoltConfig.CheckOnOpen = true
+
+	storage, err := txndedup.NewBoltStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+
+	// 文件被占用时打开超时
+	locked := *config.BoltConfig
+	locked.OpenTimeout = 50 * time.Millisecond
+	lockedConfig := *config
+	lockedConfig.BoltConfig = &locked
+	if _, err := txndedup.NewBoltStorage(&lockedConfig); err == nil {
+		t.Fatal("文件被占用时应返回错误")
+	}
+
+	// 过期记录在重启时清理
+	expired := &txndedup.TransactionRecord{TransactionID: "tx_expired", Status: txndedup.StatusSuccess, CreatedAt: now.Add(-2 * time.Hour)}
+	if err := storage.Store(ctx, "fp_old", expired); err != nil {
+		t.Fatal(err)
+	}
+
+	// 超出 MaxRecordsPerKey 时删除最旧的记录
+	for i := 0; i < 5; i++ {
+		record := &txndedup.TransactionRecord{
+			TransactionID: fmt.Sprintf("tx_%d", i),
+			Status:        txndedup.StatusSuccess,
+			CreatedAt:     now.Add(time.Duration(i-10) * time.Second),
+		}
+		if err := storage.Store(ctx, "fp", record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pending := &txndedup.TransactionRecord{
+		TransactionID:  "tx_pending",
+		IdempotencyKey: "order-001",
+		Fingerprint:    "fp_a",
+		Fingerprints:   []string{"fp_a", "fp_b"},
+		Status:         txndedup.StatusPending,
+		CreatedAt:      now,
+	}
+	err = storage.Reserve(ctx, pending.Fingerprints, time.Minute, func([]*txndedup.TransactionRecord) (*txndedup.TransactionRecord, error) {
+		return pending, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后处理中的交易仍在
+	storage, err = txndedup.NewBoltStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	record, err := storage.GetByIdempotencyKey(ctx, "order-001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.TransactionID != "tx_pending" || record.Status != txndedup.StatusPending {
+		t.Errorf("重启后应恢复处理中的交易，实际为%s/%s", record.TransactionID, record.Status)
+	}
+
+	if _, err := storage.Update(ctx, "tx_pending", func(r *txndedup.TransactionRecord) { r.Status = txndedup.StatusSuccess }); err != nil {
+		t.Fatal(err)
+	}
+	records, err := storage.GetSimilar(ctx, "fp_b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Status != txndedup.StatusSuccess {
+		t.Error("其他指纹下的记录也应更新状态")
+	}
+
+	records, err = storage.GetSimilar(ctx, "fp", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].TransactionID != "tx_2" {
+		t.Errorf("应只保留最新的3笔记录，实际为%d笔", len(records))
+	}
+	if _, err := storage.Get(ctx, "tx_0"); !errors.Is(err, txndedup.ErrTransactionNotFound) {
+		t.Errorf("被裁剪的记录应删除索引，实际为%v", err)
+	}
+	if _, err := storage.Get(ctx, "tx_expired"); !errors.Is(err, txndedup.ErrTransactionNotFound) {
+		t.Errorf("重启时应清理过期记录，实际为%v", err)
+	}
+}
+
+func TestMemoryStorage_Sharding(t *testing.T) {
+	config := txndedup.DefaultConfig()
+	config.CleanupInterval = time.Hour
+	config.MaxRecordsPerKey = 3
+	config.MemoryConfig = &txndedup.MemoryConfig{Shards: 3, ExpiryBucket: time.Second}
+
+	storage := txndedup.NewMemoryStorage(config)
+	defer storage.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+
+	// 过期指纹数超过单批清理数量，另有1个指纹同时包含过期与未过期的记录
+	for i := 0; i < 5000; i++ {
+		record := &txndedup.TransactionRecord{TransactionID: fmt.Sprintf("old_%d", i), CreatedAt: now.Add(-time.Hour)}
+		storage.Store(ctx, fmt.Sprintf("fp_%d", i), record)
+	}
+	for i, createdAt := range []time.Time{now.Add(-time.Hour), now} {
+		record := &txndedup.TransactionRecord{TransactionID: fmt.Sprintf("live_%d", i), CreatedAt: createdAt}
+		storage.Store(ctx, "live", record)
+	}
+
+	// 超出 MaxRecordsPerKey 时覆盖最旧的记录
+	for i := 0; i < 5; i++ {
+		record := &txndedup.TransactionRecord{TransactionID: fmt.Sprintf("tx_%d", i), CreatedAt: now.Add(time.Duration(i-10) * time.Second)}
+		storage.Store(ctx, "fp", record)
+	}
+	records, _ := storage.GetSimilar(ctx, "fp", time.Hour)
+	if len(records) != 3 || records[0].TransactionID != "tx_2" || records[2].TransactionID != "tx_4" {
+		t.Errorf("应按写入顺序保留最新的3笔记录，实际为%d笔", len(records))
+	}
+	if _, err := storage.Get(ctx, "tx_0"); !errors.Is(err, txndedup.ErrTransactionNotFound) {
+		t.Errorf("被覆盖的记录应删除索引，实际为%v", err)
+	}
+
+	if err := storage.Cleanup(ctx, 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Get(ctx, "old_4999"); !errors.Is(err, txndedup.ErrTransactionNotFound) {
+		t.Errorf("过期记录应被清理，实际为%v", err)
+	}
+	records, _ = storage.GetSimilar(ctx, "live", 2*time.Hour)
+	if len(records) != 1 || records[0].TransactionID != "live_1" {
+		t.Errorf("应只保留未过期的记录，实际为%d笔", len(records))
+	}
+
+	// 同一幂等键在不同分片的指纹上并发预留，只有一个成功
+	var (
+		wg        sync.WaitGroup
+		succeeded atomic.Int32
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			record := &txndedup.TransactionRecord{
+				TransactionID:  fmt.Sprintf("tx_key_%d", i),
+				IdempotencyKey: "order-001",
+				Fingerprint:    fmt.Sprintf("fp_key_%d", i),
+				Fingerprints:   []string{fmt.Sprintf("fp_key_%d", i), "fp_shared"},
+				Status:         txndedup.StatusPending,
+				CreatedAt:      time.Now(),
+			}
+			err := storage.Reserve(ctx, record.Fingerprints, time.Minute, func([]*txndedup.TransactionRecord) (*txndedup.TransactionRecord, error) {
+				return record, nil
+			})
+			if err == nil {
+				succeeded.Add(1)
+			} else if !errors.Is(err, txndedup.ErrIdempotencyKeyExists) {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if succeeded.Load() != 1 {
+		t.Fatalf("同一幂等键应只预留一次，实际为%d次", succeeded.Load())
+	}
+
+	// 多指纹记录跨分片共享，状态更新在各指纹下可见
+	record, err := storage.GetByIdempotencyKey(ctx, "order-001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Update(ctx, record.TransactionID, func(r *txndedup.TransactionRecord) { r.Status = txndedup.StatusSuccess }); err != nil {
+		t.Fatal(err)
+	}
+	records, _ = storage.GetSimilar(ctx, "fp_shared", time.Minute)
+	if len(records) != 1 || records[0].Status != txndedup.StatusSuccess {
+		t.Error("其他指纹下的记录也应更新状态")
+	}
+}
+
+func TestMemoryStorage_Capacity(t *testing.T) {
+	ctx := context.Background()
+
+	for _, policy := range []txndedup.MemoryEvictionPolicy{txndedup.EvictLRU, txndedup.EvictOldest} {
+		t.Run(string(policy), func(t *testing.T) {
+			config := txndedup.DefaultConfig()
+			config.CleanupInterval = time.Hour
+			config.MemoryConfig = &txndedup.MemoryConfig{Shards: 4, MaxRecords: 40, EvictionPolicy: policy}
+
+			storage := txndedup.NewMemoryStorage(config)
+			defer storage.Close()
+
+			// 唯一收款方的卡测攻击：每笔交易一个新指纹
+			now := time.Now()
+			for i := 0; i < 1000; i++ {
+				record := &txndedup.TransactionRecord{TransactionID: fmt.Sprintf("tx_%d", i), CreatedAt: now.Add(time.Duration(i) * time.Millisecond)}
+				if err := storage.Store(ctx, fmt.Sprintf("fp_%d", i), record); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			stats := storage.Stats()
+			if stats.Records > 40 || stats.Fingerprints != stats.Records {
+				t.Errorf("记录数应不超过上限，实际为%+v", stats)
+			}
+			if stats.Evictions != 1000-stats.Records {
+				t.Errorf("淘汰数应为%d，实际为%d", 1000-stats.Records, stats.Evictions)
+			}
+			if _, err := storage.Get(ctx, "tx_999"); err != nil {
+				t.Errorf("刚写入的记录不应被淘汰: %v", err)
+			}
+			if _, err := storage.Get(ctx, "tx_0"); !errors.Is(err, txndedup.ErrTransactionNotFound) {
+				t.Errorf("被淘汰的记录应删除索引，实际为%v", err)
+			}
+		})
+	}
+
+	t.Run("bytes", func(t *testing.T) {
+		config := txndedup.DefaultConfig()
+		config.CleanupInterval = time.Hour
+		config.MemoryConfig = &txndedup.MemoryConfig{Shards: 1, MaxBytes: 64 << 10}
+
+		storage := txndedup.NewMemoryStorage(config)
+		defer storage.Close()
+
+		for i := 0; i < 1000; i++ {
+			record := &txndedup.TransactionRecord{TransactionID: fmt.Sprintf("tx_%d", i), UserAgent: strings.Repeat("x", 512), CreatedAt: time.Now()}
+			storage.Store(ctx, fmt.Sprintf("fp_%d", i), record)
+		}
+		if stats := storage.Stats(); stats.Bytes > 64<<10 || stats.Evictions == 0 {
+			t.Errorf("估算字节数应不超过上限，实际为%+v", stats)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		config := txndedup.DefaultConfig()
+		config.MemoryConfig = &txndedup.MemoryConfig{Shards: 1, MaxRecords: 2, EvictionPolicy: txndedup.EvictReject}
+
+		detector, err := txndedup.New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer detector.Close()
+
+		for i := 0; i < 3; i++ {
+			request := &txndedup.TransactionRequest{
+				FromAccount:  "acc_001",
+				ToAccount:    fmt.Sprintf("payee_%d", i),
+				Amount:       txndedup.NewMoney(100, "USD"),
+				Currency:     "USD",
+				BusinessType: "transfer",
+			}
+			_, err := detector.CheckAndReserve(ctx, request)
+			if i < 2 && err != nil {
+				t.Fatal(err)
+			}
+			if i == 2 && !errors.Is(err, txndedup.ErrStorageFull) {
+				t.Errorf("超出容量时应拒绝预留，实际为%v", err)
+			}
+		}
+	})
+}
+
+func TestDetector_Lifecycle(t *testing.T) {
+	ctx := context.Background()
+
+	// 关闭后不残留清理协程
+	before := runtime.NumGoroutine()
+	for i := 0; i < 200; i++ {
+		detector, err := txndedup.New(txndedup.DefaultConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := detector.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Errorf("关闭后协程应退出，创建前%d个，关闭后%d个", before, after)
+	}
+
+	mr := miniredis.RunT(t)
+	config := txndedup.DefaultConfig()
+	config.CleanupInterval = 20 * time.Millisecond
+	config.StorageType = "redis"
+	config.RedisConfig = &txndedup.RedisConfig{Address: mr.Addr(), KeyPrefix: "lifecycle:", RecordTTL: 50 * time.Millisecond}
+
+	detector, err := txndedup.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := &txndedup.TransactionRequest{
+		FromAccount:  "acc_001",
+		ToAccount:    "acc_002",
+		Amount:       txndedup.NewMoney(100, "USD"),
+		Currency:     "USD",
+		BusinessType: "transfer",
+	}
+	if _, err := detector.CheckAndReserve(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+
+	// 未调用 Start 时 Redis 存储不在后台清理
+	time.Sleep(100 * time.Millisecond)
+	if members, _ := mr.ZMembers("lifecycle:expiry"); len(members) != 1 {
+		t.Fatalf("Start 前过期索引应保留，实际为%d个指纹", len(members))
+	}
+
+	if err := detector.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := detector.Start(ctx); !errors.Is(err, txndedup.ErrDetectorStarted) {
+		t.Errorf("重复启动应返回 ErrDetectorStarted，实际为%v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for mr.Exists("lifecycle:expiry") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mr.Exists("lifecycle:expiry") {
+		t.Error("Start 后应在后台清理过期索引")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := detector.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+	if err := detector.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("重复关闭应返回nil，实际为%v", err)
+	}
+	if err := detector.Start(ctx); !errors.Is(err, txndedup.ErrDetectorClosed) {
+		t.Errorf("关闭后启动应返回 ErrDetectorClosed，实际为%v", err)
+	}
+}
+
+func TestMemoryStorage_Snapshot(t *testing.T) {
+	config := txndedup.DefaultConfig()
+	config.MemoryConfig = &txndedup.MemoryConfig{SnapshotPath: filepath.Join(t.TempDir(), "memory.snapshot")}
+
+	storage := txndedup.NewMemoryStorage(config)
+	ctx := context.Background()
+	now := time.Now()
+
+	expired := &txndedup.TransactionRecord{TransactionID: "tx_expired", Status: txndedup.StatusSuccess, CreatedAt: now.Add(-2 * time.Hour)}
+	storage.Store(ctx, "fp", expired)
+	for i := 0; i < 3; i++ {
+		record := &txndedup.TransactionRecord{TransactionID: fmt.Sprintf("tx_%d", i), Status: txndedup.StatusSuccess, CreatedAt: now.Add(time.Duration(i-10) * time.Second)}
+		storage.Store(ctx, "fp", record)
+	}
+	pending := &txndedup.TransactionRecord{
+		TransactionID:  "tx_pending",
+		IdempotencyKey: "order-001",
+		Fingerprint:    "fp_a",
+		Fingerprints:   []string{"fp_a", "fp_b"},
+		Amount:         txndedup.NewMoney(10050, "USD"),
+		Status:         txndedup.StatusPending,
+		CreatedAt:      now,
+	}
+	err := storage.Reserve(ctx, pending.Fingerprints, time.Minute, func([]*txndedup.TransactionRecord) (*txndedup.TransactionRecord, error) {
+		return pending, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 快照损坏时拒绝恢复
+	var buf bytes.Buffer
+	if err := storage.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte(nil), buf.Bytes()...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	empty := txndedup.NewMemoryStorage(txndedup.DefaultConfig())
+	defer empty.Close()
+	if err := empty.Restore(bytes.NewReader(corrupted)); !errors.Is(err, txndedup.ErrInvalidSnapshot) {
+		t.Errorf("校验和不匹配时应返回 ErrInvalidSnapshot，实际为%v", err)
+	}
+
+	// 容量不足时超出部分计入拒绝数，而不是静默丢弃
+	small := txndedup.DefaultConfig()
+	small.MemoryConfig = &txndedup.MemoryConfig{Shards: 1, MaxRecords: 2, EvictionPolicy: txndedup.EvictReject}
+	undersized := txndedup.NewMemoryStorage(small)
+	defer undersized.Close()
+	if err := undersized.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if stats := undersized.Stats(); stats.Records != 2 || stats.Rejections != 2 {
+		t.Errorf("应恢复2笔并拒绝2笔，实际恢复%d笔、拒绝%d笔", stats.Records, stats.Rejections)
+	}
+
+	// 关闭时写入快照，重启后自动恢复
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	storage = txndedup.NewMemoryStorage(config)
+	defer storage.Close()
+
+	record, err := storage.GetByIdempotencyKey(ctx, "order-001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.TransactionID != "tx_pending" || record.Status != txndedup.StatusPending || record.Amount.Cmp(pending.Amount) != 0 {
+		t.Errorf("重启后应恢复处理中的交易，实际为%+v", record)
+	}
+
+	if _, err := storage.Update(ctx, "tx_pending", func(r *txndedup.TransactionRecord) { r.Status = txndedup.StatusSuccess }); err != nil {
+		t.Fatal(err)
+	}
+	records, _ := storage.GetSimilar(ctx, "fp_b", time.Minute)
+	if len(records) != 1 || records[0].Status != txndedup.StatusSuccess {
+		t.Error("恢复后多指纹记录应仍然共享，状态更新在各指纹下可见")
+	}
+
+	records, _ = storage.GetSimilar(ctx, "fp", time.Hour)
+	if len(records) != 3 || records[0].TransactionID != "tx_0" {
+		t.Errorf("应按时间顺序恢复未过期的3笔记录，实际为%d笔", len(records))
+	}
+	if _, err := storage.Get(ctx, "tx_expired"); !errors.Is(err, txndedup.ErrTransactionNotFound) {
+		t.Errorf("恢复时应丢弃超出保留时长的记录，实际为%v", err)
+	}
+}
+
+func TestMemoryStorage_WAL(t *testing.T) {
+	dir := t.TempDir()
+	config := txndedup.DefaultConfig()
+	config.CleanupInterval = time.Hour
+	config.MemoryConfig = &txndedup.MemoryConfig{
+		ExpiryBucket: time.Second,
+		SnapshotPath: filepath.Join(dir, "memory.snapshot"),
+		WALDir:       filepath.Join(dir, "wal"),
+	}
+
+	storage, err := txndedup.OpenMemoryStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+
+	// 并发写入合并刷盘
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			record := &txndedup.TransactionRecord{TransactionID: fmt.Sprintf("tx_%d", i), Status: txndedup.StatusSuccess, CreatedAt: now}
+			if err := storage.Store(ctx, fmt.Sprintf("fp_%d", i%5), record); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stale := &txndedup.TransactionRecord{TransactionID: "tx_stale", CreatedAt: now.Add(-time.Minute)}
+	storage.Store(ctx, "fp_stale", stale)
+	if err := storage.Cleanup(ctx, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	pending := &txndedup.TransactionRecord{
+		TransactionID:  "tx_pending",
+		IdempotencyKey: "order-001",
+		Fingerprint:    "fp_a",
+		Fingerprints:   []string{"fp_a", "fp_b"},
+		Status:         txndedup.StatusPending,
+		CreatedAt:      now,
+	}
+	err = storage.Reserve(ctx, pending.Fingerprints, time.Minute, func([]*txndedup.TransactionRecord) (*txndedup.TransactionRecord, error) {
+		return pending, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = storage.Update(ctx, "tx_pending", func(r *txndedup.TransactionRecord) {
+		r.Status = txndedup.StatusSuccess
+		r.Response = json.RawMessage(`{"status":"ok"}`)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟崩溃：复制此时的日志目录，最后一个段末尾残留写到一半的帧
+	crashDir := filepath.Join(t.TempDir(), "wal")
+	copyDir(t, config.MemoryConfig.WALDir, crashDir)
+	segments, _ := filepath.Glob(filepath.Join(crashDir, "*.wal"))
+	file, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+	file.Close()
+
+	crashConfig := *config
+	crashConfig.MemoryConfig = &txndedup.MemoryConfig{
+		SnapshotPath: filepath.Join(t.TempDir(), "memory.snapshot"),
+		WALDir:       crashDir,
+	}
+	recovered, err := txndedup.OpenMemoryStorage(&crashConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+
+	for i := 0; i < 50; i++ {
+		if _, err := recovered.Get(ctx, fmt.Sprintf("tx_%d", i)); err != nil {
+			t.Fatalf("崩溃前已返回的写入应全部恢复: %v", err)
+		}
+	}
+	if _, err := recovered.Get(ctx, "tx_stale"); !errors.Is(err, txndedup.ErrTransactionNotFound) {
+		t.Errorf("重放清理后记录应被删除，实际为%v", err)
+	}
+	record, err := recovered.GetByIdempotencyKey(ctx, "order-001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != txndedup.StatusSuccess {
+		t.Errorf("应重放状态更新，实际为%s", record.Status)
+	}
+	records, _ := recovered.GetSimilar(ctx, "fp_b", time.Minute)
+	if len(records) != 1 || records[0].Status != txndedup.StatusSuccess {
+		t.Error("重放后多指纹记录的各指纹下应为更新后的记录")
+	}
+
+	// 重放更新后的用量应与从快照重新写入的用量一致
+	var buf bytes.Buffer
+	if err := recovered.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	reference := txndedup.NewMemoryStorage(txndedup.DefaultConfig())
+	defer reference.Close()
+	if err := reference.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := recovered.Stats().Bytes, reference.Stats().Bytes; got != want {
+		t.Errorf("重放更新后字节数应为%d，实际为%d", want, got)
+	}
+
+	// 并发写入快照依次执行，快照完成后删除已被覆盖的段
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := storage.SnapshotToFile(config.MemoryConfig.SnapshotPath); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if segments, _ := filepath.Glob(filepath.Join(config.MemoryConfig.WALDir, "*.wal")); len(segments) != 1 {
+		t.Errorf("快照后应只保留当前段，实际为%d个", len(segments))
+	}
+
+	// 没有过期记录时清理不写入日志
+	segments, _ = filepath.Glob(filepath.Join(config.MemoryConfig.WALDir, "*.wal"))
+	before, _ := os.Stat(segments[0])
+	if err := storage.Cleanup(ctx, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.Stat(segments[0]); after.Size() != before.Size() {
+		t.Errorf("没有过期记录时不应写入日志，段大小从%d变为%d", before.Size(), after.Size())
+	}
+}
+
+func TestMemoryStorage_WALOpenFailure(t *testing.T) {
+	// 日志目录位置已存在同名文件，无法打开
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, "wal")
+	if err := os.WriteFile(walDir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := txndedup.DefaultConfig()
+	config.MemoryConfig = &txndedup.MemoryConfig{
+		SnapshotPath: filepath.Join(dir, "memory.snapshot"),
+		WALDir:       walDir,
+	}
+
+	if _, err := txndedup.OpenMemoryStorage(config); err == nil {
+		t.Error("打开预写日志失败时应返回错误")
+	}
+
+	storage := txndedup.NewMemoryStorage(config)
+	defer storage.Close()
+
+	ctx := context.Background()
+	record := &txndedup.TransactionRecord{TransactionID: "tx_1", CreatedAt: time.Now()}
+	if err := storage.Store(ctx, "fp_1", record); err == nil {
+		t.Error("打开预写日志失败后写入应返回错误")
+	}
+	err := storage.Reserve(ctx, []string{"fp_1"}, time.Minute, func([]*txndedup.TransactionRecord) (*txndedup.TransactionRecord, error) {
+		return record, nil
+	})
+	if err == nil {
+		t.Error("打开预写日志失败后预留应返回错误")
+	}
+	if _, err := storage.Get(ctx, "tx_1"); !errors.Is(err, txndedup.ErrTransactionNotFound) {
+		t.Errorf("写入失败的记录不应生效，实际为%v", err)
+	}
+}
+
+func TestMemoryStorage_WALTornHeader(t *testing.T) {
+	config := txndedup.DefaultConfig()
+	config.CleanupInterval = time.Hour
+	open := func(walDir string) *txndedup.MemoryStorage {
+		memoryConfig := &txndedup.MemoryConfig{
+			SnapshotPath: filepath.Join(t.TempDir(), "memory.snapshot"),
+			WALDir:       walDir,
+		}
+		storageConfig := *config
+		storageConfig.MemoryConfig = memoryConfig
+		storage, err := txndedup.OpenMemoryStorage(&storageConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { storage.Close() })
+		return storage
+	}
+
+	ctx := context.Background()
+	walDir := filepath.Join(t.TempDir(), "wal")
+	storage := open(walDir)
+	if err := storage.Store(ctx, "fp_1", &txndedup.TransactionRecord{TransactionID: "tx_1", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟创建新段时崩溃：最后一个段只写入了部分文件头
+	crashDir := filepath.Join(t.TempDir(), "wal")
+	copyDir(t, walDir, crashDir)
+	segments, _ := filepath.Glob(filepath.Join(crashDir, "*.wal"))
+	torn := filepath.Join(crashDir, fmt.Sprintf("%020d.wal", len(segments)+1))
+	if err := os.WriteFile(torn, []byte("TX"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// 连续两次崩溃重启均能恢复，文件头不完整的段不会变成中间的损坏段
+	first := open(crashDir)
+	if err := first.Store(ctx, "fp_2", &txndedup.TransactionRecord{TransactionID: "tx_2", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	secondDir := filepath.Join(t.TempDir(), "wal")
+	copyDir(t, crashDir, secondDir)
+
+	second := open(secondDir)
+	for _, id := range []string{"tx_1", "tx_2"} {
+		if _, err := second.Get(ctx, id); err != nil {
+			t.Errorf("第二次重启后应恢复%s: %v", id, err)
+		}
+	}
+}
+
+func TestMemoryStorage_RestoreWithWAL(t *testing.T) {
+	ctx := context.Background()
+	source := txndedup.NewMemoryStorage(txndedup.DefaultConfig())
+	defer source.Close()
+	record := &txndedup.TransactionRecord{TransactionID: "tx_1", Fingerprints: []string{"fp_1", "fp_2"}, CreatedAt: time.Now()}
+	if err := source.Store(ctx, "fp_1", record); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := source.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	config := txndedup.DefaultConfig()
+	config.CleanupInterval = time.Hour
+	config.MemoryConfig = &txndedup.MemoryConfig{
+		SnapshotPath: filepath.Join(dir, "memory.snapshot"),
+		WALDir:       filepath.Join(dir, "wal"),
+	}
+	storage, err := txndedup.OpenMemoryStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if err := storage.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// 运行期间恢复的记录写入预写日志，下一次快照之前崩溃也不会丢失
+	crashConfig := *config
+	crashConfig.MemoryConfig = &txndedup.MemoryConfig{
+		SnapshotPath: filepath.Join(t.TempDir(), "memory.snapshot"),
+		WALDir:       filepath.Join(t.TempDir(), "wal"),
+	}
+	copyDir(t, config.MemoryConfig.WALDir, crashConfig.MemoryConfig.WALDir)
+	recovered, err := txndedup.OpenMemoryStorage(&crashConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	if _, err := recovered.Get(ctx, "tx_1"); err != nil {
+		t.Errorf("崩溃后应从预写日志恢复运行期间恢复的记录: %v", err)
+	}
+}
+
+// copyDir 复制目录下的文件
+func copyDir(t *testing.T, src, dst string) {
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, entry.Name()), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
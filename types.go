@@ -1,6 +1,7 @@
 package txndedup
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -8,7 +9,7 @@ import (
 type TransactionRequest struct {
 	FromAccount  string                 `json:"from_account"`
 	ToAccount    string                 `json:"to_account"`
-	Amount       float64                `json:"amount"`
+	Amount       Money                  `json:"amount"`
 	Currency     string                 `json:"currency"`
 	BusinessType string                 `json:"business_type"`
 	Channel      string                 `json:"channel"`
@@ -16,15 +17,22 @@ type TransactionRequest struct {
 	DeviceID     string                 `json:"device_id"`
 	UserAgent    string                 `json:"user_agent"`
 	Extra        map[string]interface{} `json:"extra,omitempty"` // 扩展字段
+
+	// 客户端提供的幂等键，相同幂等键的重放请求直接返回原交易
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// 提示消息的语言，如 "en"、"zh"、"ja"，为空时使用上下文或默认语言
+	Locale string `json:"locale,omitempty"`
 }
 
 // TransactionRecord 交易记录
 type TransactionRecord struct {
 	TransactionID string                 `json:"transaction_id"`
 	Fingerprint   string                 `json:"fingerprint"`
+	Fingerprints  []string               `json:"fingerprints,omitempty"` // 多粒度匹配时的全部指纹，第一个为 Fingerprint
 	FromAccount   string                 `json:"from_account"`
 	ToAccount     string                 `json:"to_account"`
-	Amount        float64                `json:"amount"`
+	Amount        Money                  `json:"amount"`
 	Currency      string                 `json:"currency"`
 	BusinessType  string                 `json:"business_type"`
 	Channel       string                 `json:"channel"`
@@ -35,6 +43,11 @@ type TransactionRecord struct {
 	DeviceID      string                 `json:"device_id"`
 	UserAgent     string                 `json:"user_agent"`
 	Extra         map[string]interface{} `json:"extra,omitempty"`
+
+	// 幂等相关
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	PayloadHash    string          `json:"payload_hash,omitempty"` // 请求内容摘要，用于识别幂等键冲突
+	Response       json.RawMessage `json:"response,omitempty"`     // 交易完成后保存的响应，重放时返回
 }
 
 // TransactionStatus 交易状态
@@ -55,7 +68,23 @@ type DuplicateCheckResult struct {
 	SuggestionAction    SuggestionAction     `json:"suggestion_action"`
 	Message             string               `json:"message"`
 	Fingerprint         string               `json:"fingerprint"`
+	Fingerprints        []string             `json:"fingerprints,omitempty"`
+	TransactionID       string               `json:"transaction_id,omitempty"` // CheckAndReserve 预留的交易ID
 	CheckedAt           time.Time            `json:"checked_at"`
+
+	// 风险评分：评分模式下为命中规则的权重之和，MatchedRules 列出全部命中的规则
+	Score        float64            `json:"score,omitempty"`
+	MatchedRules []RuleContribution `json:"matched_rules,omitempty"`
+
+	// 检测使用的规则集版本
+	RulesVersion string `json:"rules_version,omitempty"`
+
+	// 评估过程，仅在使用 WithExplain 检测时返回
+	Explanation *Explanation `json:"explanation,omitempty"`
+
+	// 幂等重放：IdempotentReplay 为true时 OriginalTransaction 为该幂等键对应的原交易
+	IdempotentReplay    bool               `json:"idempotent_replay,omitempty"`
+	OriginalTransaction *TransactionRecord `json:"original_transaction,omitempty"`
 }
 
 // RiskLevel 风险级别
@@ -76,6 +105,12 @@ const (
 	ActionBlock SuggestionAction = "BLOCK"
 )
 
+// 指纹金额精度的特殊取值，正数表示固定的小数位数
+const (
+	AmountPrecisionExact    = 0  // 不四舍五入，去除尾随零后精确匹配
+	AmountPrecisionCurrency = -1 // 按请求货币的 ISO-4217 小数位数四舍五入
+)
+
 // FingerprintConfig 指纹配置
 type FingerprintConfig struct {
 	IncludeFromAccount  bool `json:"include_from_account"`
@@ -84,9 +119,36 @@ type FingerprintConfig struct {
 	IncludeCurrency     bool `json:"include_currency"`
 	IncludeBusinessType bool `json:"include_business_type"`
 	IncludeChannel      bool `json:"include_channel"`
-	AmountPrecision     int  `json:"amount_precision"` // 金额精度，0表示精确匹配
+	AmountPrecision     int  `json:"amount_precision"` // 金额精度（小数位数），0表示精确匹配，AmountPrecisionCurrency 按货币的最小单位
+
+	// 金额分桶宽度，非零时按桶生成指纹：每笔交易落入相邻的两个桶，差额小于桶宽的交易至少共享一个指纹
+	// 配合 RiskRule 的金额容差使用，桶宽应不小于容差
+	AmountBucket Money `json:"amount_bucket"`
+
+	// 账户规范化规则，按顺序应用于转出、转入账户，如 ["iban", "card", "phone"]
+	AccountCanonicalizers []string `json:"account_canonicalizers,omitempty"`
+
+	// 参与指纹计算的扩展字段
+	ExtraFields []ExtraField `json:"extra_fields,omitempty"`
+}
+
+// ExtraField 参与指纹计算的扩展字段
+type ExtraField struct {
+	Key         string            `json:"key"`
+	Normalizers []FieldNormalizer `json:"normalizers,omitempty"` // 按顺序应用
+	Pattern     string            `json:"pattern,omitempty"`     // NormalizeRegex 使用的正则，取第一个捕获组
 }
 
+// FieldNormalizer 字段标准化规则
+type FieldNormalizer string
+
+const (
+	NormalizeTrim      FieldNormalizer = "trim"      // 去除首尾空白
+	NormalizeLowercase FieldNormalizer = "lowercase" // 转小写
+	NormalizeDigits    FieldNormalizer = "digits"    // 仅保留数字
+	NormalizeRegex     FieldNormalizer = "regex"     // 正则捕获
+)
+
 // RiskRule 风险规则
 type RiskRule struct {
 	Name            string              `json:"name"`
@@ -97,4 +159,74 @@ type RiskRule struct {
 	CheckSameIP     bool                `json:"check_same_ip"`
 	CheckSameDevice bool                `json:"check_same_device"`
 	CheckStatus     []TransactionStatus `json:"check_status"`
+
+	// 金额容差，任一非零时只匹配金额差在容差内的交易（绝对值或请求金额的百分比，满足其一即可）
+	AmountTolerance        Money   `json:"amount_tolerance"`
+	AmountTolerancePercent float64 `json:"amount_tolerance_percent"` // 如 0.5 表示 0.5%
+
+	// 收款账户相似度阈值，大于0时只匹配收款账户相似度不低于阈值的交易
+	// 需在指纹中排除收款账户（IncludeToAccount=false）才能召回近似账户的交易
+	PayeeSimilarity     float64 `json:"payee_similarity"`
+	SimilarityAlgorithm string  `json:"similarity_algorithm,omitempty"` // levenshtein | jaro_winkler
+
+	// 自定义条件表达式，非空时规则需同时满足条件才命中，语法见 Expression
+	Condition string `json:"condition,omitempty"`
+
+	// 评分模式下规则命中时累计的分值
+	Weight float64 `json:"weight"`
+
+	// 提示消息模板（text/template，数据为 MessageData），为空时按规则名称从消息目录查找
+	Message string `json:"message,omitempty"`
+}
+
+// ScoringConfig 评分模式配置
+type ScoringConfig struct {
+	Enabled    bool             `json:"enabled"`
+	Thresholds []ScoreThreshold `json:"thresholds"` // 总分达到的最高阈值决定风险级别和建议操作，未达到任何阈值时为 LOW/ALLOW
+}
+
+// ScoreThreshold 评分阈值
+type ScoreThreshold struct {
+	MinScore  float64          `json:"min_score"`
+	RiskLevel RiskLevel        `json:"risk_level"`
+	Action    SuggestionAction `json:"action"`
+}
+
+// 风险评估模式
+const (
+	ExplainModeFirstMatch = "first_match" // 取第一条命中的规则
+	ExplainModeScoring    = "scoring"     // 累计命中规则的权重
+)
+
+// Explanation 风险评估过程
+type Explanation struct {
+	Mode       string          `json:"mode"`
+	Candidates int             `json:"candidates"`          // 参与评估的相似交易数
+	Rules      []RuleTrace     `json:"rules"`               // 按规则顺序排列的评估过程
+	Score      float64         `json:"score,omitempty"`     // 评分模式下的总分
+	Threshold  *ScoreThreshold `json:"threshold,omitempty"` // 评分模式下达到的阈值
+}
+
+// RuleTrace 单条规则的评估过程
+type RuleTrace struct {
+	Rule                  string        `json:"rule"`
+	Matched               bool          `json:"matched"`                           // 规则条件是否满足
+	Applied               bool          `json:"applied"`                           // 是否参与最终结果
+	Reason                string        `json:"reason"`                            // 命中或未命中的原因
+	Filters               []FilterCount `json:"filters,omitempty"`                 // 依次应用各过滤条件后剩余的交易数
+	MatchedTransactionIDs []string      `json:"matched_transaction_ids,omitempty"` // 通过全部过滤条件的交易
+	MaxCount              int           `json:"max_count"`
+	Score                 float64       `json:"score,omitempty"` // 参与最终结果时贡献的分值，仅评分模式下有值
+}
+
+// FilterCount 过滤条件及应用后剩余的交易数
+type FilterCount struct {
+	Filter    string `json:"filter"`
+	Remaining int    `json:"remaining"`
+}
+
+// RuleContribution 命中规则及其贡献的分值
+type RuleContribution struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"` // 规则权重，仅评分模式下有值，首条命中模式下为0
 }